@@ -36,11 +36,37 @@ func main() {
 			Usage: "[optional] Address to listening",
 			Value: ":9090",
 		},
+		cli.StringFlag{
+			Name:  "tls-cert-file",
+			Usage: "[optional] Certificate to serve TLS on the listening address",
+		},
+		cli.StringFlag{
+			Name:  "tls-key-file",
+			Usage: "[optional] Private key to serve TLS on the listening address",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-ca-file",
+			Usage: "[optional] CA bundle to verify client certificates, the CN is the user and the Os are the groups of a verified client",
+		},
 		cli.StringFlag{
 			Name:  "proxy-url",
 			Usage: "[optional] URL to proxy",
 			Value: "http://localhost:9999",
 		},
+		cli.StringSliceFlag{
+			Name:  "proxy-replica-url",
+			Usage: "[optional] URL of another HA replica of the Prometheus to proxy, the tenant requests are sent to every replica and their series are deduplicated by the replica label",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "replica-label",
+			Usage: "[optional] External label distinguishing the HA replicas of an upstream, dropped from the deduplicated series",
+			Value: "prometheus_replica",
+		},
+		cli.StringFlag{
+			Name:  "upstreams-config",
+			Usage: "[optional] YAML file routing namespaces or projects to other upstream Prometheus instances than the proxy URL, the requests over the namespaces of several upstreams are sent to each of them and their results are merged",
+		},
 		cli.StringFlag{
 			Name:   "monitoring-namespace",
 			Usage:  "[optional] rancher monitoring deployed namespace",
@@ -57,11 +83,238 @@ func main() {
 			Usage: "[optional] Maximum number of simultaneous connections",
 			Value: 512,
 		},
+		cli.IntFlag{
+			Name:  "access-cache-size",
+			Usage: "[optional] Maximum number of users whose accessible namespaces are cached until a namespace or RBAC change, 0 disables the caching",
+			Value: 4096,
+		},
+		cli.StringFlag{
+			Name:  "rate-limit-config",
+			Usage: "[optional] YAML file with the token bucket rate limits of the tenants by endpoint class",
+		},
+		cli.StringFlag{
+			Name:  "scheduler-config",
+			Usage: "[optional] YAML file capping the in-flight upstream requests per tenant and queueing the excess ones in a weighted fair order",
+		},
+		cli.StringFlag{
+			Name:  "query-limits-config",
+			Usage: "[optional] YAML file limiting the range, lookback, step, selectors, depth, length and estimated series of the tenant queries by group or project",
+		},
+		cli.StringFlag{
+			Name:  "series-over-budget",
+			Usage: "[optional] 'reject' the tenant queries whose estimated series exceed the maxSeries query limit, or 'downgrade' them to the lowPriority scheduler level",
+			Value: "reject",
+		},
+		cli.DurationFlag{
+			Name:  "series-counts-cache-ttl",
+			Usage: "[optional] Duration the upstream series counts per metric name and namespace are cached to estimate the series of the queries",
+			Value: 5 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:  "query-range-cache-size",
+			Usage: "[optional] Maximum number of the time buckets of the range query results cached in memory, 0 disables the caching",
+		},
+		cli.DurationFlag{
+			Name:  "query-range-cache-bucket",
+			Usage: "[optional] Duration of the time buckets the range query results are cached in",
+			Value: time.Hour,
+		},
+		cli.DurationFlag{
+			Name:  "query-range-cache-max-freshness",
+			Usage: "[optional] Duration before now whose range query results are never cached, as the samples may still arrive",
+			Value: 10 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:  "query-shards",
+			Usage: "[optional] Split the tenant aggregations safe to shard, like 'sum(rate(...))', into this many concurrent upstream queries over disjoint sets of namespaces, and merge their results. 0 or 1 disables the sharding",
+		},
+		cli.IntFlag{
+			Name:  "query-shard-min-namespaces",
+			Usage: "[optional] Minimum number of accessible namespaces to shard the tenant aggregations",
+			Value: 100,
+		},
+		cli.IntFlag{
+			Name:  "expression-cache-size",
+			Usage: "[optional] Maximum number of the parsed query expressions, and of their rewrites per set of namespaces, cached in memory, 0 disables the caching",
+			Value: 1000,
+		},
+		cli.DurationFlag{
+			Name:  "metric-names-cache-ttl",
+			Usage: "[optional] TTL of the metric names listed per set of namespaces, 0 disables the caching",
+			Value: 30 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:  "namespace-matcher-complement",
+			Usage: "[optional] Exclude the inaccessible namespaces, instead of selecting the accessible ones, when the matcher is shorter. The excluded namespaces include the namespace label values of the deleted namespaces still in Prometheus",
+		},
+		cli.BoolFlag{
+			Name:  "coalesce-requests",
+			Usage: "[optional] Share a single upstream response between the identical rewritten requests in flight of the tenants accessing the same namespaces",
+		},
+		cli.StringFlag{
+			Name:  "unbounded-metric-selectors",
+			Usage: "[optional] 'allow' or 'reject' the tenant series selectors without a concrete metric name, like '{__name__=~\".+\"}'",
+			Value: "allow",
+		},
+		cli.StringSliceFlag{
+			Name:  "unbounded-metric-selectors-groups",
+			Usage: "[optional] Groups still allowed to use series selectors without a concrete metric name when they are rejected",
+			Value: &cli.StringSlice{},
+		},
 		cli.StringSliceFlag{
 			Name:  "filter-reader-labels",
 			Usage: "[optional] Filter out the configured labels when calling '/api/v1/read'",
 			Value: &cli.StringSlice{},
 		},
+		cli.StringFlag{
+			Name:  "standalone-config",
+			Usage: "[optional] Run without Kubernetes, loading the users and their accessible namespaces from this YAML file",
+		},
+		cli.DurationFlag{
+			Name:  "standalone-reload-interval",
+			Usage: "[optional] Interval to check the standalone config and its htpasswd file for changes",
+			Value: 30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "namespace-webhook-url",
+			Usage: "[optional] Endpoint receiving the user as a JSON POST and answering the accessible namespaces as '{\"namespaces\":[...]}'",
+		},
+		cli.DurationFlag{
+			Name:  "namespace-webhook-timeout",
+			Usage: "[optional] Maximum duration of a namespace webhook call, the user can access no namespace after it",
+			Value: 5 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "namespace-webhook-cache-ttl",
+			Usage: "[optional] Duration to cache the namespace webhook answer of a user, 0 disables the caching",
+			Value: time.Minute,
+		},
+		cli.StringFlag{
+			Name:  "namespace-webhook-mode",
+			Usage: "[optional] Combine the namespace webhook with the RBAC or standalone namespaces by 'union' or 'intersection'",
+			Value: "union",
+		},
+		cli.StringSliceFlag{
+			Name:  "authenticators",
+			Usage: "[optional] Ordered authenticators among 'rancher-headers', 'service-account-token', 'standalone-token', 'oidc', 'standalone-basic' and 'client-certificate', all the configured ones in this order if not set",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "authenticator-chain-mode",
+			Usage: "[optional] 'first-match' takes the first authenticator accepting the request, 'all-must-agree' requires all authenticators finding credentials to accept the same user and groups",
+			Value: "first-match",
+		},
+		cli.StringSliceFlag{
+			Name:  "rancher-header-trusted-cidrs",
+			Usage: "[optional] Only honor the 'X-Rancher-User' and 'X-Rancher-Group' headers from these source CIDRs",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "rancher-header-trusted-client-cns",
+			Usage: "[optional] Only honor the 'X-Rancher-User' and 'X-Rancher-Group' headers from the verified client certificates with these CNs",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "rancher-header-hmac-secret",
+			Usage: "[optional] Only honor the 'X-Rancher-User' and 'X-Rancher-Group' headers signed by the key in this secret, as 'namespace/name'",
+		},
+		cli.StringFlag{
+			Name:  "rancher-header-hmac-secret-key",
+			Usage: "[optional] Data key of the HMAC signing key in the secret",
+			Value: "key",
+		},
+		cli.StringFlag{
+			Name:  "rancher-header-untrusted-action",
+			Usage: "[optional] How to handle the untrusted 'X-Rancher-User' and 'X-Rancher-Group' headers, 'strip' or 'reject'",
+			Value: "strip",
+		},
+		cli.IntFlag{
+			Name:  "auth-failure-threshold",
+			Usage: "[optional] Lock out a client IP or token after this many failed authentications, 0 disables the throttling",
+		},
+		cli.IntFlag{
+			Name:  "auth-client-ip-failure-threshold",
+			Usage: "[optional] Lock out a client IP after this many failed authentications, as the clients behind a proxy share its IP, 10 times --auth-failure-threshold if 0",
+		},
+		cli.DurationFlag{
+			Name:  "auth-failure-window",
+			Usage: "[optional] Forget the failed authentications older than this",
+			Value: 15 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "auth-lockout",
+			Usage: "[optional] First lockout after exceeding the failure threshold, doubled by every further failure",
+			Value: time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "auth-max-lockout",
+			Usage: "[optional] Maximum lockout after exceeding the failure threshold",
+			Value: time.Hour,
+		},
+		cli.StringFlag{
+			Name:  "audit-log-path",
+			Usage: "[optional] Write the audit events as JSON lines into this file, '-' means the stdout, disable the auditing if blank",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-maxsize",
+			Usage: "[optional] Maximum size in megabytes of the audit log file before it gets rotated",
+			Value: 100,
+		},
+		cli.IntFlag{
+			Name:  "audit-log-maxbackup",
+			Usage: "[optional] Maximum number of rotated audit log files to retain",
+			Value: 10,
+		},
+		cli.IntFlag{
+			Name:  "audit-log-maxage",
+			Usage: "[optional] Maximum number of days to retain the rotated audit log files",
+			Value: 30,
+		},
+		cli.StringFlag{
+			Name:  "audit-level",
+			Usage: "[optional] Audit level of the events no policy rule matches, 'None', 'Metadata' or 'Request' which also records the original and rewritten queries",
+			Value: "Metadata",
+		},
+		cli.StringFlag{
+			Name:  "audit-policy-file",
+			Usage: "[optional] YAML file with the rules choosing the audit level by users, user groups and paths",
+		},
+		cli.StringFlag{
+			Name:  "oidc-issuer-url",
+			Usage: "[optional] Expected issuer of the OIDC/JWT bearer tokens, required by --oidc-jwks",
+		},
+		cli.StringSliceFlag{
+			Name:  "oidc-audience",
+			Usage: "[optional] Accepted audiences of the OIDC/JWT bearer tokens, at least one is required by --oidc-jwks",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "oidc-jwks",
+			Usage: "[optional] Local file or URL of the JWKS to verify OIDC/JWT bearer tokens, enable the OIDC/JWT authentication if set",
+		},
+		cli.DurationFlag{
+			Name:  "oidc-jwks-refresh-interval",
+			Usage: "[optional] Interval to refresh the JWKS",
+			Value: time.Hour,
+		},
+		cli.StringFlag{
+			Name:  "oidc-username-claim",
+			Usage: "[optional] JWT claim to use as the user name",
+			Value: "sub",
+		},
+		cli.StringFlag{
+			Name:  "oidc-groups-claim",
+			Usage: "[optional] JWT claim to use as the user groups",
+			Value: "groups",
+		},
+		cli.StringFlag{
+			Name:  "oidc-username-prefix",
+			Usage: "[optional] Prefix of the OIDC/JWT user names, the issuer URL followed by '#' unless the username claim is 'email' if blank, '-' disables it",
+		},
+		cli.StringFlag{
+			Name:  "oidc-groups-prefix",
+			Usage: "[optional] Prefix of the OIDC/JWT groups, like 'oidc:'",
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
@@ -4,6 +4,9 @@ const (
 	contentTypeHeader     = "Content-Type"
 	contentEncodingHeader = "Content-Encoding"
 	acceptHeader          = "Accept"
+	acceptEncodingHeader  = "Accept-Encoding"
+	retryAfterHeader      = "Retry-After"
 	jsonContentType       = "application/json"
 	protoContentType      = "application/x-protobuf"
+	formContentType       = "application/x-www-form-urlencoded"
 )
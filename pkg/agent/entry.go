@@ -2,6 +2,8 @@ package agent
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,16 +16,25 @@ import (
 	"time"
 
 	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/prometheus-auth/pkg/audit"
+	"github.com/rancher/prometheus-auth/pkg/auth"
+	"github.com/rancher/prometheus-auth/pkg/cardinality"
+	"github.com/rancher/prometheus-auth/pkg/coalesce"
 	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/fairqueue"
 	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/rancher/prometheus-auth/pkg/querylimit"
+	"github.com/rancher/prometheus-auth/pkg/ratelimit"
+	"github.com/rancher/prometheus-auth/pkg/resultcache"
+	"github.com/rancher/prometheus-auth/pkg/standalone"
+	"github.com/rancher/prometheus-auth/pkg/upstream"
 	"github.com/rancher/steve/pkg/accesscontrol"
 	"github.com/rancher/wrangler-api/pkg/generated/controllers/core"
 	"github.com/rancher/wrangler-api/pkg/generated/controllers/rbac"
 
-	"github.com/cockroachdb/cmux"
 	"github.com/juju/errors"
 	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
-	promapi "github.com/prometheus/client_golang/api"
 	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -33,6 +44,7 @@ import (
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
@@ -40,6 +52,20 @@ import (
 
 const (
 	defaultThreadiness = 5
+
+	unboundedSelectorsAllow  = "allow"
+	unboundedSelectorsReject = "reject"
+)
+
+var (
+	defaultAuthenticators = []string{
+		auth.RancherHeadersAuthenticator,
+		auth.ServiceAccountTokenAuthenticator,
+		auth.StandaloneTokenAuthenticator,
+		auth.OIDCAuthenticator,
+		auth.StandaloneBasicAuthenticator,
+		auth.ClientCertificateAuthenticator,
+	}
 )
 
 func Run(cliContext *cli.Context) {
@@ -52,12 +78,76 @@ func Run(cliContext *cli.Context) {
 	defer cancel()
 
 	cfg := &agentConfig{
-		ctx:                  ctx,
-		listenAddress:        cliContext.String("listen-address"),
-		monitoringNamespace:  cliContext.String("monitoring-namespace"),
-		readTimeout:          cliContext.Duration("read-timeout"),
-		maxConnections:       cliContext.Int("max-connections"),
-		filterReaderLabelSet: data.NewSet(cliContext.StringSlice("filter-reader-labels")...),
+		ctx:                      ctx,
+		listenAddress:            cliContext.String("listen-address"),
+		monitoringNamespace:      cliContext.String("monitoring-namespace"),
+		readTimeout:              cliContext.Duration("read-timeout"),
+		maxConnections:           cliContext.Int("max-connections"),
+		filterReaderLabelSet:     data.NewSet(cliContext.StringSlice("filter-reader-labels")...),
+		accessCacheSize:          cliContext.Int("access-cache-size"),
+		upstreamsConfig:          cliContext.String("upstreams-config"),
+		replicaLabel:             cliContext.String("replica-label"),
+		rateLimitConfig:          cliContext.String("rate-limit-config"),
+		schedulerConfig:          cliContext.String("scheduler-config"),
+		queryLimitsConfig:        cliContext.String("query-limits-config"),
+		seriesOverBudget:         cliContext.String("series-over-budget"),
+		seriesCountsCacheTTL:     cliContext.Duration("series-counts-cache-ttl"),
+		queryShards:              cliContext.Int("query-shards"),
+		queryShardMinNamespaces:  cliContext.Int("query-shard-min-namespaces"),
+		metricNamesCacheTTL:      cliContext.Duration("metric-names-cache-ttl"),
+		expressionCacheSize:      cliContext.Int("expression-cache-size"),
+		coalesceRequests:         cliContext.Bool("coalesce-requests"),
+		namespaceComplement:      cliContext.Bool("namespace-matcher-complement"),
+		unboundedSelectors:       cliContext.String("unbounded-metric-selectors"),
+		unboundedSelectorsGroups: data.NewSet(cliContext.StringSlice("unbounded-metric-selectors-groups")...),
+		tlsCertFile:              cliContext.String("tls-cert-file"),
+		tlsKeyFile:               cliContext.String("tls-key-file"),
+		tlsClientCAFile:          cliContext.String("tls-client-ca-file"),
+		headerTrustedCIDRs:       cliContext.StringSlice("rancher-header-trusted-cidrs"),
+		headerTrustedClientCNs:   cliContext.StringSlice("rancher-header-trusted-client-cns"),
+		headerHMACSecret:         cliContext.String("rancher-header-hmac-secret"),
+		headerHMACSecretKey:      cliContext.String("rancher-header-hmac-secret-key"),
+		headerUntrustedAction:    cliContext.String("rancher-header-untrusted-action"),
+		standaloneConfig:         cliContext.String("standalone-config"),
+		standaloneReloadInterval: cliContext.Duration("standalone-reload-interval"),
+		authenticators:           cliContext.StringSlice("authenticators"),
+		authenticatorChainMode:   cliContext.String("authenticator-chain-mode"),
+		namespaceWebhookMode:     cliContext.String("namespace-webhook-mode"),
+		namespaceWebhook: kube.WebhookConfig{
+			URL:      cliContext.String("namespace-webhook-url"),
+			Timeout:  cliContext.Duration("namespace-webhook-timeout"),
+			CacheTTL: cliContext.Duration("namespace-webhook-cache-ttl"),
+		},
+		resultCache: resultcache.Config{
+			Size:         cliContext.Int("query-range-cache-size"),
+			BucketSize:   cliContext.Duration("query-range-cache-bucket"),
+			MaxFreshness: cliContext.Duration("query-range-cache-max-freshness"),
+		},
+		audit: audit.Config{
+			Path:       cliContext.String("audit-log-path"),
+			MaxSize:    cliContext.Int("audit-log-maxsize"),
+			MaxBackups: cliContext.Int("audit-log-maxbackup"),
+			MaxAge:     cliContext.Int("audit-log-maxage"),
+			Level:      audit.Level(cliContext.String("audit-level")),
+			PolicyFile: cliContext.String("audit-policy-file"),
+		},
+		authThrottle: auth.ThrottleConfig{
+			MaxFailures:         cliContext.Int("auth-failure-threshold"),
+			MaxClientIPFailures: cliContext.Int("auth-client-ip-failure-threshold"),
+			FailureWindow:       cliContext.Duration("auth-failure-window"),
+			BaseLockout:         cliContext.Duration("auth-lockout"),
+			MaxLockout:          cliContext.Duration("auth-max-lockout"),
+		},
+		oidc: auth.JWTConfig{
+			IssuerURL:       cliContext.String("oidc-issuer-url"),
+			Audiences:       cliContext.StringSlice("oidc-audience"),
+			JWKS:            cliContext.String("oidc-jwks"),
+			RefreshInterval: cliContext.Duration("oidc-jwks-refresh-interval"),
+			UsernameClaim:   cliContext.String("oidc-username-claim"),
+			GroupsClaim:     cliContext.String("oidc-groups-claim"),
+			UsernamePrefix:  cliContext.String("oidc-username-prefix"),
+			GroupsPrefix:    cliContext.String("oidc-groups-prefix"),
+		},
 	}
 
 	proxyURLString := cliContext.String("proxy-url")
@@ -69,6 +159,13 @@ func Run(cliContext *cli.Context) {
 		log.Fatal("Unable to parse agent.proxy-url")
 	}
 	cfg.proxyURL = proxyURL
+	for _, replicaURLString := range cliContext.StringSlice("proxy-replica-url") {
+		replicaURL, err := url.Parse(replicaURLString)
+		if err != nil {
+			log.Fatal("Unable to parse agent.proxy-replica-url")
+		}
+		cfg.proxyReplicaURLs = append(cfg.proxyReplicaURLs, replicaURL)
+	}
 
 	log.Println(cfg)
 
@@ -83,22 +180,115 @@ func Run(cliContext *cli.Context) {
 }
 
 type agentConfig struct {
-	ctx                  context.Context
-	listenAddress        string
-	proxyURL             *url.URL
-	readTimeout          time.Duration
-	maxConnections       int
-	filterReaderLabelSet data.Set
-	monitoringNamespace  string
+	ctx                      context.Context
+	listenAddress            string
+	proxyURL                 *url.URL
+	proxyReplicaURLs         []*url.URL
+	replicaLabel             string
+	upstreamsConfig          string
+	readTimeout              time.Duration
+	maxConnections           int
+	filterReaderLabelSet     data.Set
+	monitoringNamespace      string
+	accessCacheSize          int
+	rateLimitConfig          string
+	schedulerConfig          string
+	queryLimitsConfig        string
+	seriesOverBudget         string
+	seriesCountsCacheTTL     time.Duration
+	resultCache              resultcache.Config
+	queryShards              int
+	queryShardMinNamespaces  int
+	metricNamesCacheTTL      time.Duration
+	expressionCacheSize      int
+	coalesceRequests         bool
+	namespaceComplement      bool
+	unboundedSelectors       string
+	unboundedSelectorsGroups data.Set
+	tlsCertFile              string
+	tlsKeyFile               string
+	tlsClientCAFile          string
+	headerTrustedCIDRs       []string
+	headerTrustedClientCNs   []string
+	headerHMACSecret         string
+	headerHMACSecretKey      string
+	headerUntrustedAction    string
+	standaloneConfig         string
+	standaloneReloadInterval time.Duration
+	authenticators           []string
+	authenticatorChainMode   string
+	namespaceWebhook         kube.WebhookConfig
+	namespaceWebhookMode     string
+	audit                    audit.Config
+	authThrottle             auth.ThrottleConfig
+	oidc                     auth.JWTConfig
 }
 
 func (a *agentConfig) String() string {
 	sb := &strings.Builder{}
 
 	sb.WriteString(fmt.Sprint("listening on ", a.listenAddress))
+	if a.tlsCertFile != "" {
+		sb.WriteString(" with TLS")
+		if a.tlsClientCAFile != "" {
+			sb.WriteString(fmt.Sprint(" verifying client certificates against ", a.tlsClientCAFile))
+		}
+	}
 	sb.WriteString(fmt.Sprint(", proxying to ", a.proxyURL.String()))
+	for _, replicaURL := range a.proxyReplicaURLs {
+		sb.WriteString(fmt.Sprint(" and its replica ", replicaURL.String()))
+	}
+	if len(a.proxyReplicaURLs) != 0 {
+		sb.WriteString(fmt.Sprint(" deduplicated by ", a.replicaLabel))
+	}
+	if a.upstreamsConfig != "" {
+		sb.WriteString(fmt.Sprint(" and to the upstreams of the namespaces routed by ", a.upstreamsConfig))
+	}
+	if a.standaloneConfig != "" {
+		sb.WriteString(fmt.Sprint(" in standalone mode with tenants from ", a.standaloneConfig))
+	}
+	if a.namespaceWebhook.URL != "" {
+		sb.WriteString(fmt.Sprintf(", resolving namespaces by the %s of the webhook %s", a.namespaceWebhookMode, a.namespaceWebhook.URL))
+	}
 	sb.WriteString(fmt.Sprintf(" with ignoring 'remote reader' labels [%s]", a.filterReaderLabelSet))
 	sb.WriteString(fmt.Sprintf(", only allow maximum %d connections with %v read timeout", a.maxConnections, a.readTimeout))
+	if a.authThrottle.MaxFailures > 0 {
+		sb.WriteString(fmt.Sprintf(", locking out clients after %d failed authentications", a.authThrottle.MaxFailures))
+	}
+	if a.oidc.JWKS != "" {
+		sb.WriteString(fmt.Sprintf(", verifying OIDC/JWT bearer tokens against %s", a.oidc.JWKS))
+	}
+	if a.rateLimitConfig != "" {
+		sb.WriteString(fmt.Sprint(", rate limiting tenants by ", a.rateLimitConfig))
+	}
+	if a.schedulerConfig != "" {
+		sb.WriteString(fmt.Sprint(", queueing upstream requests fairly by ", a.schedulerConfig))
+	}
+	if a.queryLimitsConfig != "" {
+		sb.WriteString(fmt.Sprint(", limiting query costs by ", a.queryLimitsConfig))
+		sb.WriteString(fmt.Sprintf(" and applying %q to the queries over their series budget", a.seriesOverBudget))
+	}
+	if a.resultCache.Size > 0 {
+		sb.WriteString(fmt.Sprintf(", caching %d range query buckets of %v", a.resultCache.Size, a.resultCache.BucketSize))
+	}
+	if a.queryShards > 1 {
+		sb.WriteString(fmt.Sprintf(", sharding the aggregations over at least %d namespaces into %d upstream queries", a.queryShardMinNamespaces, a.queryShards))
+	}
+	if a.namespaceComplement {
+		sb.WriteString(", excluding the inaccessible namespaces when it is shorter than selecting the accessible ones")
+	}
+	if a.expressionCacheSize > 0 {
+		sb.WriteString(fmt.Sprintf(", caching %d parsed and rewritten expressions", a.expressionCacheSize))
+	}
+	if a.coalesceRequests {
+		sb.WriteString(", coalescing the identical upstream requests in flight")
+	}
+	if a.unboundedSelectors == unboundedSelectorsReject {
+		sb.WriteString(fmt.Sprintf(", rejecting series selectors without concrete metric name unless in groups [%s]", a.unboundedSelectorsGroups))
+	}
+	if a.audit.Path != "" {
+		sb.WriteString(fmt.Sprintf(", auditing at %s level into %s", a.audit.Level, a.audit.Path))
+	}
 	sb.WriteString(" .")
 
 	return sb.String()
@@ -111,17 +301,40 @@ type agent struct {
 	namespaces        kube.Namespaces
 	secrets           *kube.Secrets
 	remoteAPI         promapiv1.API
+	defaultUpstream   *upstream.Upstream
+	router            *upstream.Router
 	controllerFactory controller.SharedControllerFactory
 	myToken           string
+	authenticator     *auth.Chain
+	headerTrust       *auth.HeaderTrust
+	throttle          *auth.Throttle
+	tenants           *standalone.Tenants
+	auditLogger       *audit.Logger
+	rateLimiter       *ratelimit.Limiter
+	scheduler         *fairqueue.Scheduler
+	queryLimits       *querylimit.Resolver
+	admission         *cardinality.Admission
+	resultCache       *resultcache.Cache
+	coalescer         *coalesce.Group
+	metricNames       upstream.MetricNames
+	expressions       *prom.ExpressionCache
+	namespaceUniverse *kube.NamespaceUniverse
+	projectOf         func(namespace string) string
+}
+
+func (a *agent) isMyToken(token string) bool {
+	return len(a.myToken) != 0 && subtle.ConstantTimeCompare([]byte(a.myToken), []byte(token)) == 1
 }
 
 func (a *agent) serve() error {
 	//start controller
-	if err := a.controllerFactory.Start(a.cfg.ctx, defaultThreadiness); err != nil {
-		return err
+	if a.controllerFactory != nil {
+		if err := a.controllerFactory.Start(a.cfg.ctx, defaultThreadiness); err != nil {
+			return err
+		}
 	}
 
-	listenerMux := cmux.New(a.listener)
+	listenerMux := createListenerMux(a.listener)
 	httpProxy := a.createHTTPProxy()
 	grpcProxy := a.createGRPCProxy()
 
@@ -171,23 +384,252 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 		},
 	}
 
+	if cfg.unboundedSelectors != unboundedSelectorsAllow && cfg.unboundedSelectors != unboundedSelectorsReject {
+		return nil, errors.Errorf("invalid --unbounded-metric-selectors %q, expected %q or %q", cfg.unboundedSelectors, unboundedSelectorsAllow, unboundedSelectorsReject)
+	}
+
 	listener, err := net.Listen("tcp", cfg.listenAddress)
 	if err != nil {
 		return nil, errors.Annotatef(err, "unable to listen on addr %s", cfg.listenAddress)
 	}
 	listener = netutil.LimitListener(listener, cfg.maxConnections)
 
+	if cfg.tlsCertFile != "" || cfg.tlsKeyFile != "" {
+		tlsConfig, err := createTLSConfig(cfg.tlsCertFile, cfg.tlsKeyFile, cfg.tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	} else if cfg.tlsClientCAFile != "" {
+		return nil, errors.New("--tls-client-ca-file requires --tls-cert-file and --tls-key-file")
+	}
+
 	// create Prometheus client
-	promClient, err := promapi.NewClient(promapi.Config{
-		Address: cfg.proxyURL.String(),
-	})
+	upstreamOptions := upstream.Options{
+		ReplicaLabel:        cfg.replicaLabel,
+		MetricNamesCacheTTL: cfg.metricNamesCacheTTL,
+	}
+	defaultUpstream, err := upstream.New(cfg.ctx, upstream.DefaultName, append([]*url.URL{cfg.proxyURL}, cfg.proxyReplicaURLs...), upstreamOptions)
 	if err != nil {
-		return nil, errors.Annotate(err, "unable to new Prometheus client")
+		return nil, err
 	}
 
+	agt := &agent{
+		cfg:             cfg,
+		listener:        listener,
+		remoteAPI:       defaultUpstream.API,
+		defaultUpstream: defaultUpstream,
+		metricNames:     defaultUpstream.MetricNames,
+	}
+	if cfg.expressionCacheSize > 0 {
+		agt.expressions = prom.NewExpressionCache(cfg.expressionCacheSize)
+	}
+
+	if cfg.namespaceComplement && cfg.standaloneConfig != "" {
+		return nil, errors.New("--namespace-matcher-complement is not supported in standalone mode")
+	}
+	if cfg.namespaceComplement && cfg.upstreamsConfig != "" {
+		// the namespaces of the series are only listed from the default upstream
+		return nil, errors.New("--namespace-matcher-complement is not supported with --upstreams-config")
+	}
+
+	if cfg.standaloneConfig != "" {
+		err = agt.initStandalone()
+	} else {
+		err = agt.initKubernetes()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.upstreamsConfig != "" || defaultUpstream.Replicated() {
+		upstreams := upstream.Config{}
+		if cfg.upstreamsConfig != "" {
+			upstreams, err = upstream.LoadConfig(cfg.upstreamsConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		agt.router, err = upstream.NewRouter(cfg.ctx, upstreams, defaultUpstream, upstreamOptions, agt.projectOf)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create upstream router")
+		}
+	}
+
+	if cfg.namespaceWebhook.URL != "" {
+		webhook, err := kube.NewWebhookNamespaces(cfg.ctx, cfg.namespaceWebhook)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create namespace webhook")
+		}
+
+		agt.namespaces, err = kube.ComposeNamespaces(cfg.namespaceWebhookMode, agt.namespaces, webhook)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	agt.headerTrust, err = createHeaderTrust(cfg, agt.secrets)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create identity headers trust policy")
+	}
+
+	if cfg.audit.Path != "" {
+		agt.auditLogger, err = audit.NewLogger(cfg.audit)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create audit logger")
+		}
+	}
+
+	if cfg.rateLimitConfig != "" {
+		rateLimits, err := ratelimit.LoadConfig(cfg.rateLimitConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		agt.rateLimiter, err = ratelimit.NewLimiter(cfg.ctx, rateLimits, agt.projectOf)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create rate limiter")
+		}
+	}
+
+	if cfg.queryLimitsConfig != "" {
+		queryLimits, err := querylimit.LoadConfig(cfg.queryLimitsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		agt.queryLimits, err = querylimit.NewResolver(queryLimits, agt.projectOf)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create query limits")
+		}
+
+		if queryLimits.HasSeriesBudget() {
+			agt.admission, err = cardinality.NewAdmission(cfg.ctx, cfg.seriesCountsCacheTTL, cfg.seriesOverBudget)
+			if err != nil {
+				return nil, errors.Annotate(err, "unable to create cardinality admission")
+			}
+		}
+	}
+
+	if cfg.schedulerConfig != "" {
+		schedulerCfg, err := fairqueue.LoadConfig(cfg.schedulerConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		agt.scheduler, err = fairqueue.NewScheduler(schedulerCfg)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create scheduler")
+		}
+	}
+
+	if cfg.resultCache.Size > 0 {
+		agt.resultCache, err = resultcache.NewCache(cfg.resultCache)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create range query results cache")
+		}
+	}
+
+	if cfg.coalesceRequests {
+		agt.coalescer = coalesce.NewGroup()
+	}
+
+	if agt.admission != nil && agt.admission.OverBudget() == cardinality.OverBudgetDowngrade &&
+		(agt.scheduler == nil || !agt.scheduler.HasLevel(fairqueue.LevelLowPriority)) {
+		return nil, errors.New("--series-over-budget=downgrade requires the lowPriority level in --scheduler-config")
+	}
+
+	if cfg.authThrottle.MaxFailures > 0 {
+		agt.throttle, err = auth.NewThrottle(cfg.ctx, cfg.authThrottle)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create authentication throttle")
+		}
+		registerLockoutHandlers(http.DefaultServeMux, agt.throttle)
+	}
+	if agt.throttle == nil && agt.tenants.HasCredentials() {
+		// the failed basic authentications are locked out before verifying their bcrypt hashes otherwise
+		log.Warn("the standalone basic-auth users are not throttled, set --auth-failure-threshold to lock out the password guessing")
+	}
+
+	agt.authenticator, err = agt.createAuthenticator()
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create authenticator chain")
+	}
+	log.Infof("authenticating by %s in %s mode", strings.Join(agt.authenticator.Names(), ","), cfg.authenticatorChainMode)
+
+	return agt, nil
+}
+
+func (a *agent) createAuthenticator() (*auth.Chain, error) {
+	cfg := a.cfg
+
+	names, explicit := cfg.authenticators, len(cfg.authenticators) != 0
+	if !explicit {
+		names = defaultAuthenticators
+	}
+
+	available := map[string]auth.Authenticator{}
+	if a.tenants == nil || a.headerTrust.Enabled() {
+		available[auth.RancherHeadersAuthenticator] = auth.NewRancherHeaders(a.headerTrust)
+	} else if _, exist := data.NewSet(names...)[auth.RancherHeadersAuthenticator]; explicit && exist {
+		// any client could claim the groups of the standalone administrators by the headers
+		return nil, errors.Errorf("authenticator %q requires a trust policy of the identity headers in standalone mode", auth.RancherHeadersAuthenticator)
+	}
+
+	if a.secrets != nil {
+		available[auth.ServiceAccountTokenAuthenticator] = auth.NewServiceAccountToken(a.secrets)
+	}
+
+	if a.tenants != nil {
+		tenants := a.tenants
+		available[auth.StandaloneTokenAuthenticator] = auth.NewBearerToken(auth.StandaloneTokenAuthenticator, func(token string) (user.Info, error) {
+			if info, ok := tenants.AuthenticateToken(token); ok {
+				return info, nil
+			}
+			return nil, errors.New("unknown token")
+		})
+		available[auth.StandaloneBasicAuthenticator] = auth.NewBasicAuth(auth.StandaloneBasicAuthenticator, func(name, password string) (user.Info, error) {
+			if info, ok := tenants.AuthenticateBasic(name, password); ok {
+				return info, nil
+			}
+			return nil, errors.New("invalid user or password")
+		})
+	}
+
+	if cfg.oidc.JWKS != "" {
+		jwtAuthenticator, err := auth.NewJWTAuthenticator(cfg.ctx, cfg.oidc)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create OIDC/JWT authenticator")
+		}
+		available[auth.OIDCAuthenticator] = auth.NewOIDC(jwtAuthenticator)
+	}
+
+	if cfg.tlsClientCAFile != "" {
+		available[auth.ClientCertificateAuthenticator] = auth.NewClientCertificate()
+	}
+
+	authenticators := make([]auth.Authenticator, 0, len(names))
+	for _, name := range names {
+		authenticator, exist := available[name]
+		if !exist {
+			if explicit {
+				return nil, errors.Errorf("authenticator %q is unknown or not configured", name)
+			}
+			continue
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	return auth.NewChain(auth.ChainMode(cfg.authenticatorChainMode), authenticators...)
+}
+
+func (a *agent) initKubernetes() error {
+	cfg := a.cfg
+
 	k8sConfig, err := getKubeConfig()
 	if err != nil {
-		return nil, errors.Annotate(err, "unable to create Kubernetes config")
+		return errors.Annotate(err, "unable to create Kubernetes config")
 	}
 
 	scheme := runtime.NewScheme()
@@ -196,7 +638,7 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 
 	controllerFactory, err := controller.NewSharedControllerFactoryFromConfig(k8sConfig, scheme)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	coreClient := core.New(controllerFactory)
@@ -211,30 +653,108 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 	}
 
 	if err := coreClient.V1().Namespace().Informer().AddIndexers(nsIndexers); err != nil {
-		return nil, errors.Annotate(err, "unable to add namespace indexer")
+		return errors.Annotate(err, "unable to add namespace indexer")
 	}
 
 	if err := coreClient.V1().Secret().Informer().AddIndexers(secIndexers); err != nil {
-		return nil, errors.Annotate(err, "unable to add secret indexer")
+		return errors.Annotate(err, "unable to add secret indexer")
 	}
 	secrets := kube.NewSecrets(cfg.ctx, coreClient.V1().Secret().Cache())
-	return &agent{
-		cfg:       cfg,
-		listener:  listener,
-		remoteAPI: promapiv1.NewAPI(promClient),
-		nodes:     kube.NewNodes(cfg.ctx, userAccessStore),
-		namespaces: kube.NewNamespaces(cfg.ctx, coreClient.V1().Namespace().Cache(), secrets,
-			userAccessStore, cfg.monitoringNamespace),
-		secrets:           secrets,
-		controllerFactory: controllerFactory,
-		myToken:           k8sConfig.BearerToken,
-	}, nil
+
+	a.nodes = kube.NewNodes(cfg.ctx, userAccessStore)
+	a.namespaces = kube.NewNamespaces(cfg.ctx, coreClient.V1().Namespace().Cache(), secrets,
+		userAccessStore, cfg.monitoringNamespace)
+	if cfg.accessCacheSize > 0 {
+		accessCache := kube.NewAccessCache(userAccessStore, cfg.accessCacheSize)
+		accessCache.Register(cfg.ctx, coreClient.V1().Namespace(), rbacClient.V1())
+		a.nodes = accessCache.Nodes(a.nodes)
+		a.namespaces = accessCache.Namespaces(a.namespaces)
+	}
+	a.secrets = secrets
+	a.projectOf = kube.NewProjectLookup(coreClient.V1().Namespace().Cache())
+	if cfg.namespaceComplement {
+		a.namespaceUniverse = kube.NewNamespaceUniverse(cfg.ctx, coreClient.V1().Namespace(), a.upstreamNamespaces)
+	}
+	a.controllerFactory = controllerFactory
+	a.myToken = k8sConfig.BearerToken
+
+	return nil
+}
+
+// upstreamNamespaces lists the namespace label values of the upstream series.
+func (a *agent) upstreamNamespaces(ctx context.Context) ([]string, error) {
+	values, _, err := a.remoteAPI.LabelValues(ctx, "namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(values))
+	for _, value := range values {
+		ret = append(ret, string(value))
+	}
+
+	return ret, nil
+}
+
+func (a *agent) initStandalone() error {
+	tenants, err := standalone.NewTenants(a.cfg.ctx, a.cfg.standaloneConfig, a.cfg.standaloneReloadInterval)
+	if err != nil {
+		return errors.Annotate(err, "unable to load standalone config")
+	}
+
+	a.nodes = tenants
+	a.namespaces = tenants
+	a.tenants = tenants
+
+	return nil
+}
+
+func createHeaderTrust(cfg *agentConfig, secrets *kube.Secrets) (*auth.HeaderTrust, error) {
+	trustCfg := auth.HeaderTrustConfig{
+		CIDRs:           cfg.headerTrustedCIDRs,
+		ClientCNs:       cfg.headerTrustedClientCNs,
+		UntrustedAction: cfg.headerUntrustedAction,
+	}
+
+	if len(cfg.headerTrustedClientCNs) != 0 && cfg.tlsClientCAFile == "" {
+		return nil, errors.New("--rancher-header-trusted-client-cns requires --tls-client-ca-file")
+	}
+
+	if cfg.headerHMACSecret != "" {
+		if secrets == nil {
+			return nil, errors.New("--rancher-header-hmac-secret is not supported in standalone mode")
+		}
+
+		parts := strings.SplitN(cfg.headerHMACSecret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid HMAC secret %q, expected 'namespace/name'", cfg.headerHMACSecret)
+		}
+
+		secretNamespace, secretName, secretKey := parts[0], parts[1], cfg.headerHMACSecretKey
+		trustCfg.HMACKey = func() ([]byte, error) {
+			return secrets.GetData(secretNamespace, secretName, secretKey)
+		}
+	}
+
+	headerTrust, err := auth.NewHeaderTrust(trustCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !headerTrust.Enabled() && cfg.standaloneConfig != "" {
+		log.Info("'X-Rancher-User' and 'X-Rancher-Group' headers are ignored in standalone mode without a trust policy")
+	} else if !headerTrust.Enabled() {
+		log.Warn("'X-Rancher-User' and 'X-Rancher-Group' headers are trusted from any client, configure a trust policy to restrict them")
+	}
+
+	return headerTrust, nil
 }
 
 func (a *agent) createHTTPProxy() *http.Server {
 	return &http.Server{
 		Handler:     a.httpBackend(),
 		ReadTimeout: a.cfg.readTimeout,
+		ConnContext: withTLSConn,
 	}
 }
 
@@ -0,0 +1,228 @@
+// +build test
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/auth"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAgentConfig configures an agent proxying to the URL, in standalone mode with the tenants config.
+func newTestAgentConfig(t *testing.T, proxyURL string, standaloneConfig string) *agentConfig {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	configPath := filepath.Join(dir, "tenants.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(standaloneConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &agentConfig{
+		ctx:                    ctx,
+		listenAddress:          "127.0.0.1:0",
+		maxConnections:         16,
+		proxyURL:               u,
+		replicaLabel:           "prometheus_replica",
+		unboundedSelectors:     unboundedSelectorsAllow,
+		standaloneConfig:       configPath,
+		authenticatorChainMode: string(auth.FirstMatch),
+		headerUntrustedAction:  auth.UntrustedHeadersStrip,
+	}
+}
+
+func newTestAgent(t *testing.T, cfg *agentConfig) *agent {
+	agt, err := createAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agt.listener.Close() })
+
+	return agt
+}
+
+const testStandaloneConfig = `
+users:
+- name: exporter
+  token: static-token
+  namespaces: [ns-a]
+groups:
+- name: ops
+  admin: true
+`
+
+func Test_standaloneIdentityHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	agt := newTestAgent(t, newTestAgentConfig(t, upstream.URL, testStandaloneConfig))
+	for _, name := range agt.authenticator.Names() {
+		if name == auth.RancherHeadersAuthenticator {
+			t.Fatal("expected the identity headers not to authenticate in standalone mode without a trust policy")
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("X-Rancher-User", "exporter")
+	req.Header.Set("X-Rancher-Group", "ops")
+	res := httptest.NewRecorder()
+	agt.httpBackend().ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected the header-only request unauthorized, got %d: %s", res.Code, res.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Authorization", "Bearer static-token")
+	res = httptest.NewRecorder()
+	agt.httpBackend().ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("expected the token authenticated, got %d: %s", res.Code, res.Body)
+	}
+
+	cfg := newTestAgentConfig(t, upstream.URL, testStandaloneConfig)
+	cfg.authenticators = []string{auth.RancherHeadersAuthenticator}
+	if _, err := createAgent(cfg); err == nil {
+		t.Error("expected the identity headers to require a trust policy in standalone mode")
+	}
+
+	cfg = newTestAgentConfig(t, upstream.URL, testStandaloneConfig)
+	cfg.headerTrustedCIDRs = []string{"10.0.0.0/8"}
+	agt = newTestAgent(t, cfg)
+	if names := agt.authenticator.Names(); len(names) == 0 || names[0] != auth.RancherHeadersAuthenticator {
+		t.Errorf("expected the trusted identity headers to authenticate, got %v", names)
+	}
+}
+
+// coalescedFollowers returns the number of the requests which shared the upstream response of an identical one.
+func coalescedFollowers(t *testing.T) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "prometheus_auth_coalesced_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "role" && label.GetValue() == "follower" {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func Test_coalesceRequests(t *testing.T) {
+	var upstreamCalls int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		<-release
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := newTestAgentConfig(t, upstream.URL, testStandaloneConfig)
+	cfg.coalesceRequests = true
+	agt := newTestAgent(t, cfg)
+	backend := agt.httpBackend()
+
+	followers := coalescedFollowers(t)
+	responses := make([]*httptest.ResponseRecorder, 2)
+	wg := sync.WaitGroup{}
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+
+		wg.Add(1)
+		go func(res *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+			req.Header.Set("Authorization", "Bearer static-token")
+			backend.ServeHTTP(res, req)
+		}(responses[i])
+	}
+
+	for i := 0; i < 1000 && coalescedFollowers(t) == followers; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if upstreamCalls != 1 {
+		t.Errorf("expected a single upstream request, got %d", upstreamCalls)
+	}
+	for i, res := range responses {
+		if res.Code != http.StatusOK {
+			t.Errorf("unexpected response %d: %d %s", i, res.Code, res.Body)
+		}
+	}
+}
+
+func Test_throttleBasicAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestAgentConfig(t, upstream.URL, "htpasswd: htpasswd\n"+testStandaloneConfig)
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(cfg.standaloneConfig), "htpasswd"), []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.authThrottle = auth.ThrottleConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, FailureWindow: time.Hour}
+	backend := newTestAgent(t, cfg).httpBackend()
+
+	query := func(password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.SetBasicAuth("alice", password)
+		res := httptest.NewRecorder()
+		backend.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	if code := query("password"); code != http.StatusOK {
+		t.Fatalf("expected alice authenticated, got %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := query("wrong"); code != http.StatusUnauthorized {
+			t.Errorf("%d: expected the wrong password unauthorized, got %d", i, code)
+		}
+	}
+	// the locked out credentials are refused before verifying the password
+	if code := query("password"); code != http.StatusTooManyRequests {
+		t.Errorf("expected alice locked out, got %d", code)
+	}
+}
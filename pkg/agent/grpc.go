@@ -2,20 +2,44 @@ package agent
 
 import (
 	"context"
+	"time"
 
 	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// grpcReplicaDialTimeout is the time to connect a replica before failing over to the next one.
+	grpcReplicaDialTimeout = 5 * time.Second
+)
+
 func (a *agent) grpcBackend() grpc.StreamHandler {
 	return grpcproxy.TransparentHandler(func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
-		con, err := grpc.DialContext(ctx, a.cfg.proxyURL.String(), grpc.WithDefaultCallOptions(grpc.CallCustomCodec(grpcproxy.Codec())))
-		if err != nil {
-			return ctx, nil, status.Errorf(codes.Unavailable, "Unavailable endpoint")
+		replicaURLs := a.defaultUpstream.ReplicaURLs()
+		for idx, replicaURL := range replicaURLs {
+			con, err := dialGRPCReplica(ctx, replicaURL.Host, idx < len(replicaURLs)-1)
+			if err == nil {
+				return ctx, con, nil
+			}
+			log.Warnf("unable to connect the replica %s of the gRPC upstream: %v", replicaURL.Host, err)
 		}
 
-		return ctx, con, nil
+		return ctx, nil, status.Errorf(codes.Unavailable, "Unavailable endpoint")
 	})
 }
+
+// dialGRPCReplica connects a replica, waiting for the connection when the next replica can be failed over to.
+func dialGRPCReplica(ctx context.Context, host string, failover bool) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.CallCustomCodec(grpcproxy.Codec()))}
+	if !failover {
+		return grpc.DialContext(ctx, host, opts...)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, grpcReplicaDialTimeout)
+	defer cancel()
+
+	return grpc.DialContext(dialCtx, host, append(opts, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))...)
+}
@@ -0,0 +1,65 @@
+// +build test
+
+package agent
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/upstream"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_grpcBackendFailover(t *testing.T) {
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := grpc.NewServer()
+	healthpb.RegisterHealthServer(backend, health.NewServer())
+	go backend.Serve(backendListener)
+	defer backend.Stop()
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedListener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	urls := []*url.URL{{Scheme: "http", Host: closedListener.Addr().String()}, {Scheme: "http", Host: backendListener.Addr().String()}}
+	defaultUpstream, err := upstream.New(ctx, upstream.DefaultName, urls, upstream.Options{ReplicaLabel: "prometheus_replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := (&agent{defaultUpstream: defaultUpstream}).createGRPCProxy()
+	go proxy.Serve(proxyListener)
+	defer proxy.Stop()
+
+	conn, err := grpc.DialContext(ctx, proxyListener.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("expected the call proxied to the next replica, got %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected status %s", resp.Status)
+	}
+}
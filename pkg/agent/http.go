@@ -2,13 +2,21 @@ package agent
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/rancher/prometheus-auth/pkg/audit"
+	"github.com/rancher/prometheus-auth/pkg/auth"
 	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/fairqueue"
+	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/rancher/prometheus-auth/pkg/upstream"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -17,9 +25,19 @@ import (
 )
 
 func (a *agent) httpBackend() http.Handler {
-	proxy := httputil.NewSingleHostReverseProxy(a.cfg.proxyURL)
+	proxy := a.defaultUpstream.Proxy
 	router := mux.NewRouter()
 
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.TLS == nil {
+				req.TLS = tlsConnectionState(req)
+			}
+
+			next.ServeHTTP(resp, req)
+		})
+	})
+
 	if log.GetLevel() == log.DebugLevel {
 		router.Use(func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
@@ -62,61 +80,110 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			//user header
-			rancherUser := r.Header.Get(rancherUserHeaderKey)
-			rancherGroup := r.Header[rancherGroupHeaderKey]
-
-			//sa header
-			accessToken := strings.TrimPrefix(r.Header.Get(authorizationHeaderKey), "Bearer ")
+			auditEvent, w := agt.auditLogger.NewEvent(w, r)
+			defer agt.auditLogger.Log(auditEvent)
+			auditEvent.SetSourceIP(auth.ClientIP(r, agt.headerTrust))
 
-			if rancherUser == "" && len(rancherGroup) == 0 && len(accessToken) == 0 {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			accessToken := auth.BearerToken(r)
+			if agt.isMyToken(accessToken) {
+				auditEvent.SetAdminBypass()
+				if agt.rejectRoutedSeries(w, r, auditEvent) {
+					return
+				}
+				auditEvent.Proxied()
+				proxyHandler.ServeHTTP(w, r)
 				return
 			}
 
-			var namespaceSet data.Set
-			var info *user.DefaultInfo
-			if rancherUser != "" || len(rancherGroup) != 0 {
-				log.Debugf("%s - %s - access by userID", r.Method, r.URL.Path)
-				info = &user.DefaultInfo{
-					Name:   rancherUser,
-					UID:    rancherUser,
-					Groups: rancherGroup,
+			var throttleKeys []string
+			if credential := throttleCredential(r, accessToken); agt.throttle != nil && credential != "" {
+				throttleKeys = []string{
+					auth.ClientIPThrottleKey(auth.ClientIP(r, agt.headerTrust)),
+					auth.TokenThrottleKey(kube.HashToken(credential)),
 				}
-			} else if len(accessToken) != 0 {
-				log.Debugf("%s - %s - access by accessToken", r.Method, r.URL.Path)
 
-				if agt.myToken == accessToken {
-					proxyHandler.ServeHTTP(w, r)
+				if remaining, locked := agt.throttle.Locked(throttleKeys...); locked {
+					auditEvent.SetError("too many failed authentications")
+					w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+					http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
 					return
 				}
+			}
 
-				sa, err := agt.secrets.GetSA(accessToken)
-				if err != nil {
-					http.Error(w, "unauthorized", http.StatusUnauthorized)
-					return
-				}
+			result, ok, err := agt.authenticator.AuthenticateRequest(r)
+			if err != nil {
+				log.Debugf("%s - %s - unauthorized: %v", r.Method, r.URL.Path, err)
+				auditEvent.SetError(err.Error())
 
-				info = &user.DefaultInfo{
-					Name: fmt.Sprintf("system:serviceaccount:%s:%s", sa.Namespace, sa.Name),
+				if len(throttleKeys) != 0 {
+					for _, lockout := range agt.throttle.Failure(throttleKeys...) {
+						auditEvent.AddLockout(lockout.Key, lockout.Failures, lockout.LockedUntil)
+					}
 				}
 			}
+			if !ok || err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			log.Debugf("%s - %s - access by %s as %q", r.Method, r.URL.Path, result.Authenticator, result.User.GetName())
+			info := auth.DefaultInfo(result.User)
+			auditEvent.SetUser(info, result.Authenticator)
 
 			if agt.nodes.CanList(info) {
-				proxyHandler.ServeHTTP(w, r)
+				auditEvent.SetAdminBypass()
+				if agt.rejectRoutedSeries(w, r, auditEvent) {
+					return
+				}
+				auditEvent.Proxied()
+				agt.scheduled(fairqueue.LevelAdmin, info.Name, proxyHandler).ServeHTTP(w, r)
 				return
 			}
 
-			namespaceSet = agt.namespaces.QueryByUser(info)
+			namespaceSet := agt.namespaces.QueryByUser(info)
+			auditEvent.SetNamespaces(namespaceSet.Values())
+			tenant := agt.tenantOf(info, namespaceSet)
+
+			// the namespaces of a single upstream are proxied to it, the others are sent to each upstream,
+			// as the namespaces of replicated upstreams to deduplicate their results
+			upstreamName, upstreamProxy, remoteAPI, metricNames, deduplicated := upstream.DefaultName, proxyHandler, agt.remoteAPI, agt.metricNames, agt.defaultUpstream.Replicated()
+			partitions := agt.router.Partition(namespaceSet)
+			if len(partitions) == 1 {
+				owner := partitions[0].Upstream
+				upstreamName, upstreamProxy, remoteAPI, metricNames, deduplicated = owner.Name, owner.Proxy, owner.API, owner.MetricNames, owner.Replicated()
+				if !deduplicated {
+					partitions = nil
+				}
+			}
 
 			apiCtx := &apiContext{
-				tag:                  fmt.Sprintf("%016x", time.Now().Unix()),
-				response:             w,
-				request:              r,
-				proxyHandler:         proxyHandler,
-				filterReaderLabelSet: agt.cfg.filterReaderLabelSet,
-				namespaceSet:         namespaceSet,
-				remoteAPI:            agt.remoteAPI,
+				tag:                     fmt.Sprintf("%016x", time.Now().Unix()),
+				response:                w,
+				request:                 r,
+				proxyHandler:            agt.scheduled(fairqueue.LevelTenants, tenant, upstreamProxy),
+				lowPriorityHandler:      agt.scheduled(fairqueue.LevelLowPriority, tenant, upstreamProxy),
+				filterReaderLabelSet:    agt.cfg.filterReaderLabelSet,
+				namespaceSet:            namespaceSet,
+				namespaceUniverse:       agt.namespaceUniverse.Namespaces(),
+				upstreamName:            upstreamName,
+				remoteAPI:               remoteAPI,
+				partitions:              partitions,
+				deduplicated:            deduplicated,
+				auditEvent:              auditEvent,
+				user:                    info,
+				rateLimiter:             agt.rateLimiter,
+				limits:                  agt.queryLimits.For(info, namespaceSet),
+				allowUnboundedSelectors: agt.allowsUnboundedSelectors(info),
+				admission:               agt.admission,
+				resultCache:             agt.resultCache,
+				scheduler:               agt.scheduler,
+				priorityLevel:           fairqueue.LevelTenants,
+				tenant:                  tenant,
+				coalescer:               agt.coalescer,
+				queryShards:             agt.cfg.queryShards,
+				queryShardMinNamespaces: agt.cfg.queryShardMinNamespaces,
+				metricNames:             metricNames,
+				expressions:             agt.expressions,
 			}
 
 			log.Debugf("common[%s] %s - %s can access namespaces %+v", apiCtx.tag, r.Method, r.URL.Path, apiCtx.namespaceSet.Values())
@@ -132,7 +199,7 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 	router.Path("/api/v1/read").Methods("POST").Handler(apiContextHandler(hijackRead))
 	router.Path("/api/v1/label/__name__/values").Methods("GET").Handler(apiContextHandler(hijackLabelName))
 	router.Path("/api/v1/label/namespace/values").Methods("GET").Handler(apiContextHandler(hijackLabelNamespaces))
-	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(proxyHandler)
+	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(apiContextHandler(hijackLabelValues))
 	router.Path("/federate").Methods("GET").Handler(apiContextHandler(hijackFederate))
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -141,3 +208,84 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 
 	return router
 }
+
+// throttleCredential identifies the guessable credentials of the request,
+// the bearer token or the basic authentication user.
+func throttleCredential(r *http.Request, accessToken string) string {
+	if name, _, ok := r.BasicAuth(); ok {
+		return "basic:" + name
+	}
+
+	return accessToken
+}
+
+// scheduled waits for the fair queueing of the tenant before proxying upstream.
+// rejectRoutedSeries rejects the series requests of the administrators when the series are spread over several upstreams:
+// they are proxied unchanged to the default upstream, which would answer with its own series only.
+func (a *agent) rejectRoutedSeries(w http.ResponseWriter, r *http.Request, auditEvent *audit.Event) bool {
+	if !a.router.Routed() || !readsSeries(r) {
+		return false
+	}
+
+	const message = "the series are spread over several upstreams, the administrators must query them directly"
+	auditEvent.SetError(message)
+	http.Error(w, message, http.StatusBadRequest)
+	return true
+}
+
+// readsSeries tells whether the request reads the series, or their labels.
+func readsSeries(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/read", "/api/v1/labels", "/federate":
+		return true
+	}
+
+	return strings.HasPrefix(r.URL.Path, "/api/v1/label/")
+}
+
+func (a *agent) scheduled(level, tenant string, proxyHandler http.Handler) http.Handler {
+	if a.scheduler == nil {
+		return proxyHandler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := a.scheduler.Wait(r.Context(), level, tenant)
+		if err != nil {
+			log.Debugf("%s - %s - not scheduled in %s priority level: %v", r.Method, r.URL.Path, level, err)
+
+			if err == fairqueue.ErrQueueFull || err == fairqueue.ErrQueueTimeout {
+				w.Header().Set(retryAfterHeader, "1")
+				http.Error(w, "too many requests, please try again later", http.StatusTooManyRequests)
+			}
+			return
+		}
+		defer release()
+
+		proxyHandler.ServeHTTP(w, r)
+	})
+}
+
+// tenantOf identifies the queue of a user in the fair queueing.
+func (a *agent) tenantOf(info *user.DefaultInfo, namespaceSet data.Set) string {
+	if a.scheduler == nil || a.scheduler.Tenant() == fairqueue.TenantUser {
+		return info.Name
+	}
+
+	digest := sha256.Sum256([]byte(namespaceSet.String()))
+	return hex.EncodeToString(digest[:8])
+}
+
+// allowsUnboundedSelectors tells whether the user can select series without a concrete metric name.
+func (a *agent) allowsUnboundedSelectors(info *user.DefaultInfo) bool {
+	if a.cfg.unboundedSelectors != unboundedSelectorsReject {
+		return true
+	}
+
+	for _, group := range info.Groups {
+		if _, exist := a.cfg.unboundedSelectorsGroups[group]; exist {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,10 +1,19 @@
 package agent
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
@@ -12,9 +21,20 @@ import (
 	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	promgo "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/audit"
+	"github.com/rancher/prometheus-auth/pkg/cardinality"
+	"github.com/rancher/prometheus-auth/pkg/coalesce"
 	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/fairqueue"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/rancher/prometheus-auth/pkg/ratelimit"
+	"github.com/rancher/prometheus-auth/pkg/resultcache"
+	"github.com/rancher/prometheus-auth/pkg/upstream"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
 )
 
 type contextKey string
@@ -23,21 +43,50 @@ const (
 	apiContextKey contextKey = "_apiContext_"
 )
 
+const (
+	upstreamTimeoutGrace = time.Second
+)
+
 var (
+	// safeHeaders are copied from the client requests to the rewritten upstream requests,
+	// the credentials and the impersonation headers never are.
+	safeHeaders = []string{acceptHeader, acceptEncodingHeader, "Accept-Language", "User-Agent", "X-Prometheus-Remote-Read-Version"}
+
 	badRequestErr     = errors.BadRequestf("bad_data")
 	notProvisionedErr = errors.NotProvisionedf("execution")
+	rateLimitedErr    = errors.QuotaLimitExceededf("too_many_requests")
 	errInternal       = errors.New("internal")
 )
 
 type apiContext struct {
 	sync.Once
-	tag                  string
-	response             http.ResponseWriter
-	request              *http.Request
-	proxyHandler         http.Handler
-	filterReaderLabelSet data.Set
-	namespaceSet         data.Set
-	remoteAPI            promapiv1.API
+	tag                     string
+	response                http.ResponseWriter
+	request                 *http.Request
+	proxyHandler            http.Handler
+	lowPriorityHandler      http.Handler
+	filterReaderLabelSet    data.Set
+	namespaceSet            data.Set
+	namespaceUniverse       data.Set
+	upstreamName            string
+	remoteAPI               promapiv1.API
+	partitions              []upstream.Partition
+	deduplicated            bool
+	auditEvent              *audit.Event
+	user                    *user.DefaultInfo
+	rateLimiter             *ratelimit.Limiter
+	limits                  *prom.Limits
+	allowUnboundedSelectors bool
+	admission               *cardinality.Admission
+	resultCache             *resultcache.Cache
+	scheduler               *fairqueue.Scheduler
+	priorityLevel           string
+	tenant                  string
+	coalescer               *coalesce.Group
+	queryShards             int
+	queryShardMinNamespaces int
+	metricNames             upstream.MetricNames
+	expressions             *prom.ExpressionCache
 }
 
 type jsonResponseData struct {
@@ -45,16 +94,22 @@ type jsonResponseData struct {
 	Data      interface{} `json:"data,omitempty"`
 	ErrorType string      `json:"errorType,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
 }
 
 func (c *apiContext) responseJSON(data interface{}) (err error) {
+	return c.responseJSONWithWarnings(data, nil)
+}
+
+func (c *apiContext) responseJSONWithWarnings(data interface{}, warnings []string) (err error) {
 	c.Do(func() {
 		resp := c.response
 		resp.Header().Set(contentTypeHeader, jsonContentType)
 
 		responseData := &jsonResponseData{
-			Status: "success",
-			Data:   data,
+			Status:   "success",
+			Data:     data,
+			Warnings: warnings,
 		}
 
 		respBytes, marshalErr := json.Marshal(responseData)
@@ -97,7 +152,7 @@ func (c *apiContext) responseProto(data proto.Message) (err error) {
 	return
 }
 
-func (c *apiContext) responseMetrics(data *promgo.MetricFamily) (err error) {
+func (c *apiContext) responseMetrics(families []*promgo.MetricFamily) (err error) {
 	c.Do(func() {
 		req, resp := c.request, c.response
 
@@ -105,12 +160,11 @@ func (c *apiContext) responseMetrics(data *promgo.MetricFamily) (err error) {
 		respEncoder := expfmt.NewEncoder(resp, respFormat)
 		resp.Header().Set(contentTypeHeader, string(respFormat))
 
-		if data == nil {
-			return
-		}
-
-		if encodeErr := respEncoder.Encode(data); encodeErr != nil {
-			err = errors.Wrap(encodeErr, errInternal)
+		for _, family := range families {
+			if encodeErr := respEncoder.Encode(family); encodeErr != nil {
+				err = errors.Wrap(encodeErr, errInternal)
+				return
+			}
 		}
 	})
 
@@ -119,6 +173,7 @@ func (c *apiContext) responseMetrics(data *promgo.MetricFamily) (err error) {
 
 func (c *apiContext) proxy() error {
 	c.Do(func() {
+		c.auditEvent.Proxied()
 		c.proxyHandler.ServeHTTP(c.response, c.request)
 	})
 
@@ -127,12 +182,228 @@ func (c *apiContext) proxy() error {
 
 func (c *apiContext) proxyWith(request *http.Request) error {
 	c.Do(func() {
+		c.auditEvent.Proxied()
+		if c.coalescer != nil {
+			// waits for the shared upstream response as long as the client is connected
+			c.coalescer.ServeHTTP(coalesceKey(request, c.namespaceSet), c.response, request, c.proxyHandler)
+			return
+		}
 		c.proxyHandler.ServeHTTP(c.response, request)
 	})
 
 	return nil
 }
 
+// coalesceKey identifies the identical rewritten requests of the tenants accessing the same namespaces.
+func coalesceKey(request *http.Request, namespaceSet data.Set) string {
+	digest := sha256.New()
+	fmt.Fprintf(digest, "%s\n%s\n%s\n%s\n", request.Method, request.URL.Path, request.URL.Query().Encode(), namespaceSet)
+	fmt.Fprintf(digest, "%s\n%s\n", request.Header.Get(acceptHeader), request.Header.Get(acceptEncodingHeader))
+	if request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			io.Copy(digest, body)
+		}
+	}
+
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+func (c *apiContext) rateLimit() error {
+	class := ratelimit.ClassOf(c.request.URL.Path)
+
+	retryAfter, ok := c.rateLimiter.Allow(class, c.user, c.namespaceSet)
+	if ok {
+		return nil
+	}
+
+	if class != ratelimit.ClassFederate && class != ratelimit.ClassRead {
+		c.response.Header().Set(contentTypeHeader, jsonContentType)
+	}
+	c.response.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	return errors.Wrap(errors.Errorf("rate limit of %q requests exceeded", class), rateLimitedErr)
+}
+
+// admit checks the estimated series of the selectors against the series budget of the tenant,
+// the queries over budget are rejected or downgraded to the low-priority upstream requests.
+func (c *apiContext) admit(selectors [][]*promlb.Matcher) error {
+	var budget int
+	if c.limits != nil {
+		budget = c.limits.MaxSeries
+	}
+
+	decision, series := c.admission.Admit(c.request.Context(), selectors, c.admissionPartitions(), budget, c.wait)
+	switch decision {
+	case cardinality.DecisionDowngrade:
+		log.Debugf("admission[%s] downgrades the query touching an estimated %d series", c.tag, series)
+		c.proxyHandler = c.lowPriorityHandler
+		c.priorityLevel = fairqueue.LevelLowPriority
+	case cardinality.DecisionReject:
+		return errors.Wrap(errors.Errorf("query touches an estimated %d series, exceeding the budget of %d", series, budget), badRequestErr)
+	}
+
+	return nil
+}
+
+// admissionPartitions returns the accessible namespaces by the upstream counting their series.
+func (c *apiContext) admissionPartitions() []cardinality.Partition {
+	if len(c.partitions) < 2 {
+		return []cardinality.Partition{{Upstream: c.upstreamName, API: c.remoteAPI, Namespaces: c.namespaceSet}}
+	}
+
+	ret := make([]cardinality.Partition, 0, len(c.partitions))
+	for _, partition := range c.partitions {
+		ret = append(ret, cardinality.Partition{Upstream: partition.Upstream.Name, API: partition.Upstream.API, Namespaces: partition.Namespaces})
+	}
+
+	return ret
+}
+
+// wait schedules an upstream request sent through the remote API on behalf of the tenant,
+// the returned function must be called once the request completes.
+func (c *apiContext) wait(ctx context.Context) (func(), error) {
+	if c.scheduler == nil {
+		return func() {}, nil
+	}
+
+	release, err := c.scheduler.Wait(ctx, c.priorityLevel, c.tenant)
+	if err == fairqueue.ErrQueueFull || err == fairqueue.ErrQueueTimeout {
+		return nil, errors.Wrap(err, rateLimitedErr)
+	}
+
+	return release, err
+}
+
+// queryContext cancels the upstream requests with the client request, or at the timeout of the query.
+// The upstream gets a grace period to report its own timeout first.
+func (c *apiContext) queryContext() (context.Context, context.CancelFunc, error) {
+	ctx := c.request.Context()
+	if to := c.request.FormValue("timeout"); len(to) != 0 {
+		timeout, err := parseDuration(to)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, badRequestErr)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout+upstreamTimeoutGrace)
+		return ctx, cancel, nil
+	}
+
+	return ctx, func() {}, nil
+}
+
+// newUpstreamRequest creates the rewritten request proxied upstream, with the safe headers of the client request.
+// The returned function must be called once the request completes, see queryContext.
+func (c *apiContext) newUpstreamRequest(method string, reqURL url.URL, body io.Reader) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel, err := c.queryContext()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newReq, err := http.NewRequestWithContext(ctx, method, reqURL.String(), body)
+	if err != nil {
+		cancel()
+		return nil, nil, errors.Wrap(err, errInternal)
+	}
+
+	for _, name := range safeHeaders {
+		if values := c.request.Header[name]; len(values) != 0 {
+			newReq.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	return newReq, cancel, nil
+}
+
+// partialQuery is a rewritten query sent through a remote API, whose result is merged with the other ones.
+type partialQuery struct {
+	remoteAPI promapiv1.API
+	query     string
+}
+
+// partialQueries returns how to merge the partial queries sent to the upstreams of the accessible namespaces,
+// or to the shards of them, or a nil plan when the query is sent upstream at once.
+func (c *apiContext) partialQueries(expr parser.Expr, rawValue string) (*prom.ShardPlan, []partialQuery, error) {
+	if len(c.partitions) > 1 {
+		return c.routeQueries(expr, rawValue)
+	}
+
+	plan := c.shardPlan(expr)
+	if plan == nil {
+		return nil, nil, nil
+	}
+
+	queries, err := c.shardQueries(rawValue)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plan, queries, nil
+}
+
+// shardPlan returns how to merge the shards of the query over disjoint sets of the accessible namespaces,
+// or nil when the query is sent upstream at once.
+func (c *apiContext) shardPlan(expr parser.Expr) *prom.ShardPlan {
+	if c.queryShards < 2 || len(c.namespaceSet) < c.queryShardMinNamespaces || len(c.request.FormValue("stats")) != 0 {
+		return nil
+	}
+
+	plan, ok := prom.NewShardPlan(expr)
+	if !ok {
+		return nil
+	}
+
+	return plan
+}
+
+// shardQueries rewrites the raw query for each shard of the accessible namespaces.
+func (c *apiContext) shardQueries(rawValue string) ([]partialQuery, error) {
+	shards := prom.SplitNamespaces(c.namespaceSet.Values(), c.queryShards)
+
+	queries := make([]partialQuery, 0, len(shards))
+	for idx, shard := range shards {
+		hjkValue, empty, err := c.expressions.Rewrite(rawValue, data.NewSet(shard...), c.namespaceUniverse)
+		if err != nil {
+			return nil, errors.Wrap(err, badRequestErr)
+		}
+		if empty {
+			// the shard selects none of its namespaces
+			continue
+		}
+		log.Debugf("hjk query[%s - shard %d] => %s", c.tag, idx, hjkValue)
+		queries = append(queries, partialQuery{remoteAPI: c.remoteAPI, query: hjkValue})
+	}
+
+	return queries, nil
+}
+
+// routeQueries rewrites the raw query for the namespaces of each upstream,
+// the queries selecting no series are answered by the default upstream at once.
+func (c *apiContext) routeQueries(expr parser.Expr, rawValue string) (*prom.ShardPlan, []partialQuery, error) {
+	if len(cardinality.Selectors(expr)) == 0 {
+		return nil, nil, nil
+	}
+
+	plan, ok := prom.NewRoutePlan(expr)
+	if !ok {
+		return nil, nil, errors.Wrap(errors.Errorf("query over the namespaces of %d upstreams cannot be merged", len(c.partitions)), badRequestErr)
+	}
+
+	queries := make([]partialQuery, 0, len(c.partitions))
+	for _, partition := range c.partitions {
+		hjkValue, empty, err := c.expressions.Rewrite(rawValue, partition.Namespaces, c.namespaceUniverse)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, badRequestErr)
+		}
+		if empty {
+			continue
+		}
+		log.Debugf("hjk query[%s - %s] => %s", c.tag, partition.Upstream.Name, hjkValue)
+		queries = append(queries, partialQuery{remoteAPI: partition.Upstream.API, query: hjkValue})
+	}
+
+	return plan, queries, nil
+}
+
 type apiContextHandler func(*apiContext) error
 
 func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -142,7 +413,10 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	apiCtx := r.Context().Value(apiContextKey).(*apiContext)
 
-	err := f(apiCtx)
+	err := apiCtx.rateLimit()
+	if err == nil {
+		err = f(apiCtx)
+	}
 	if err == nil {
 		return
 	}
@@ -157,6 +431,7 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		causeErrMsg = err.Error()
 	}
+	apiCtx.auditEvent.SetError(causeErrMsg)
 
 	responseErrType := ""
 	responseCode := http.StatusInternalServerError
@@ -166,6 +441,13 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if errors.IsNotProvisioned(err) {
 		responseCode = http.StatusUnprocessableEntity
 		responseErrType = "execution"
+	} else if errors.IsQuotaLimitExceeded(err) {
+		responseCode = http.StatusTooManyRequests
+		responseErrType = "too_many_requests"
+		if len(w.Header().Get(retryAfterHeader)) == 0 {
+			// the queued upstream requests may be retried shortly
+			w.Header().Set(retryAfterHeader, "1")
+		}
 	}
 
 	acceptHeaderValue := r.Header.Get(acceptHeader)
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rancher/prometheus-auth/pkg/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerLockoutHandlers serves the lockouts on the local profiler address only,
+// "GET /debug/lockouts" lists them and "DELETE /debug/lockouts?key=..." clears one or all of them.
+func registerLockoutHandlers(mux *http.ServeMux, throttle *auth.Throttle) {
+	mux.HandleFunc("/debug/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		var resp interface{}
+		switch r.Method {
+		case http.MethodGet:
+			resp = throttle.Lockouts()
+		case http.MethodDelete:
+			key := r.URL.Query().Get("key")
+			cleared := throttle.Clear(key)
+			log.WithFields(log.Fields{
+				"audit":   "lockout-cleared",
+				"key":     key,
+				"cleared": cleared,
+			}).Infof("cleared %d lockouts", cleared)
+
+			resp = map[string]int{"cleared": cleared}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set(contentTypeHeader, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.WithError(err).Error("failed to write lockouts")
+		}
+	})
+}
@@ -2,24 +2,32 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/gorilla/mux"
 	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	prommodel "github.com/prometheus/common/model"
 	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/prometheus/prometheus/util/stats"
+	"github.com/rancher/prometheus-auth/pkg/cardinality"
 	"github.com/rancher/prometheus-auth/pkg/data"
 	"github.com/rancher/prometheus-auth/pkg/prom"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 func hijackFederate(apiCtx *apiContext) error {
@@ -30,11 +38,21 @@ func hijackFederate(apiCtx *apiContext) error {
 	}
 
 	matchFormValues := queries["match[]"]
+	selectors := make([][]*promlb.Matcher, 0, len(matchFormValues))
 	for _, rawValue := range matchFormValues {
-		_, err := parser.ParseMetricSelector(rawValue)
+		matchers, err := parser.ParseMetricSelector(rawValue)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
+
+		if !apiCtx.allowUnboundedSelectors && !prom.HasConcreteMetricName(matchers) {
+			return errors.Wrap(errors.Errorf("series selector %s has no concrete metric name", rawValue), badRequestErr)
+		}
+		selectors = append(selectors, matchers)
+	}
+
+	if err := apiCtx.limits.CheckSelectors(matchFormValues); err != nil {
+		return errors.Wrap(err, badRequestErr)
 	}
 
 	// quick response
@@ -42,19 +60,34 @@ func hijackFederate(apiCtx *apiContext) error {
 		return apiCtx.responseMetrics(nil)
 	}
 
+	if err := apiCtx.admit(selectors); err != nil {
+		return err
+	}
+
 	// hijack
 	queries.Del("match[]")
 	for idx, rawValue := range matchFormValues {
-		expr, err := parser.ParseExpr(rawValue)
+		log.Debugf("raw federate[%s - %d] => %s", apiCtx.tag, idx, rawValue)
+		hjkValue, empty, err := apiCtx.expressions.Rewrite(rawValue, apiCtx.namespaceSet, apiCtx.namespaceUniverse)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
-
-		log.Debugf("raw federate[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := prom.ModifyExpression(expr, apiCtx.namespaceSet)
 		log.Debugf("hjk federate[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.auditEvent.AddQuery(rawValue, hjkValue)
 
-		queries.Add("match[]", hjkValue)
+		if !empty {
+			queries.Add("match[]", hjkValue)
+		}
+	}
+
+	// quick response, the selected namespaces are not accessible
+	if len(queries["match[]"]) == 0 {
+		return apiCtx.responseMetrics(nil)
+	}
+
+	// route
+	if len(apiCtx.partitions) != 0 {
+		return routedFederate(apiCtx, matchFormValues)
 	}
 
 	// inject
@@ -62,10 +95,11 @@ func hijackFederate(apiCtx *apiContext) error {
 	reqURL.RawQuery = queries.Encode()
 
 	// proxy
-	newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	newReq, cancel, err := apiCtx.newUpstreamRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
-		return errors.Wrap(err, errInternal)
+		return err
 	}
+	defer cancel()
 
 	return apiCtx.proxyWith(newReq)
 }
@@ -87,58 +121,84 @@ func hijackQuery(apiCtx *apiContext) error {
 	}
 
 	rawValue := queryFormValue
-	queryExpr, err := parser.ParseExpr(rawValue)
+	queryExpr, err := apiCtx.expressions.Parse(rawValue)
 	if err != nil {
 		return errors.Wrap(err, badRequestErr)
 	}
 
-	// quick response
-	if len(apiCtx.namespaceSet) == 0 {
-		var qs *stats.QueryStats
-		if len(req.FormValue("stats")) != 0 {
-			qs = stats.NewQueryStats(stats.NewQueryTimers())
-		}
+	if err := apiCtx.limits.CheckQuery(rawValue, queryExpr); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
 
-		if queryExpr.Type() != parser.ValueTypeScalar {
-			var val parser.Value
-			switch queryExpr.Type() {
-			case parser.ValueTypeVector:
-				val = make(promql.Vector, 0, 0)
-			case parser.ValueTypeMatrix:
-				val = promql.Matrix{}
-			default:
-				return errors.Wrap(errors.Errorf("unexpected expression type %q", queryExpr.Type()), badRequestErr)
-			}
+	if !apiCtx.allowUnboundedSelectors {
+		if err := prom.CheckMetricNames(queryExpr); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
 
-			emptyRespData := struct {
-				ResultType parser.ValueType  `json:"resultType"`
-				Result     parser.Value      `json:"result"`
-				Stats      *stats.QueryStats `json:"stats,omitempty"`
-			}{
-				ResultType: val.Type(),
-				Result:     val,
-				Stats:      qs,
-			}
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 && queryExpr.Type() != parser.ValueTypeScalar {
+		return responseEmptyQuery(apiCtx, queryExpr.Type(), false)
+	}
 
-			return apiCtx.responseJSON(emptyRespData)
-		}
+	if err := apiCtx.admit(cardinality.Selectors(queryExpr)); err != nil {
+		return err
 	}
 
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := prom.ModifyExpression(queryExpr, apiCtx.namespaceSet)
+	hjkValue, empty, err := apiCtx.expressions.Rewrite(rawValue, apiCtx.namespaceSet, apiCtx.namespaceUniverse)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
+	apiCtx.auditEvent.AddQuery(rawValue, hjkValue)
 	req.Form.Set("query", hjkValue)
 
+	// quick response, the selected namespaces are not accessible
+	if empty {
+		return responseEmptyQuery(apiCtx, queryExpr.Type(), false)
+	}
+
+	// shard, route or deduplicate
+	shardPlan, partialQueries, err := apiCtx.partialQueries(queryExpr, rawValue)
+	if err != nil {
+		return err
+	}
+	if shardPlan != nil || apiCtx.deduplicated {
+		ts := time.Now()
+		if t := req.FormValue("time"); len(t) != 0 {
+			if ts, err = parseTime(t); err != nil {
+				return errors.Wrap(err, badRequestErr)
+			}
+		}
+
+		if shardPlan == nil {
+			return deduplicatedQuery(apiCtx, hjkValue, ts)
+		}
+		return shardedQuery(apiCtx, shardPlan, partialQueries, ts)
+	}
+
 	// inject
 	reqURL := *req.URL
-	reqURL.RawQuery = req.Form.Encode()
+	var body io.Reader
+	if req.Method == http.MethodPost {
+		// the long rewritten queries may not fit in the URL
+		reqURL.RawQuery = ""
+		body = strings.NewReader(req.Form.Encode())
+	} else {
+		reqURL.RawQuery = req.Form.Encode()
+	}
 
 	// proxy
-	newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	newReq, cancel, err := apiCtx.newUpstreamRequest(req.Method, reqURL, body)
 	if err != nil {
-		return errors.Wrap(err, errInternal)
+		return err
+	}
+	defer cancel()
+	if body != nil {
+		newReq.Header.Set(contentTypeHeader, formContentType)
 	}
 
 	return apiCtx.proxyWith(newReq)
@@ -182,69 +242,308 @@ func hijackQueryRange(apiCtx *apiContext) error {
 		return errors.Wrap(errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"), badRequestErr)
 	}
 
+	if err := apiCtx.limits.CheckRange(start, end, step); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
 	queryFormValue := req.FormValue("query")
 	if len(queryFormValue) == 0 {
 		return errors.Wrap(errors.New("unable to get 'query' value from request"), badRequestErr)
 	}
 
 	rawValue := queryFormValue
-	queryExpr, err := parser.ParseExpr(rawValue)
+	queryExpr, err := apiCtx.expressions.Parse(rawValue)
 	if err != nil {
 		return errors.Wrap(err, badRequestErr)
 	}
 
-	// quick response
-	if len(apiCtx.namespaceSet) == 0 {
-		var qs *stats.QueryStats
-		if len(req.FormValue("stats")) != 0 {
-			qs = stats.NewQueryStats(stats.NewQueryTimers())
-		}
+	if err := apiCtx.limits.CheckQuery(rawValue, queryExpr); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
 
-		if queryExpr.Type() != parser.ValueTypeScalar {
-			var val parser.Value
-			switch queryExpr.Type() {
-			case parser.ValueTypeVector:
-				val = promql.Matrix{}
-			case parser.ValueTypeMatrix:
-				val = promql.Matrix{}
-			default:
-				return errors.Wrap(errors.Errorf("unexpected expression type %q", queryExpr.Type()), badRequestErr)
-			}
+	if !apiCtx.allowUnboundedSelectors {
+		if err := prom.CheckMetricNames(queryExpr); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
 
-			emptyRespData := struct {
-				ResultType parser.ValueType  `json:"resultType"`
-				Result     parser.Value      `json:"result"`
-				Stats      *stats.QueryStats `json:"stats,omitempty"`
-			}{
-				ResultType: val.Type(),
-				Result:     val,
-				Stats:      qs,
-			}
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 && queryExpr.Type() != parser.ValueTypeScalar {
+		return responseEmptyQuery(apiCtx, queryExpr.Type(), true)
+	}
 
-			return apiCtx.responseJSON(emptyRespData)
-		}
+	if err := apiCtx.admit(cardinality.Selectors(queryExpr)); err != nil {
+		return err
 	}
 
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := prom.ModifyExpression(queryExpr, apiCtx.namespaceSet)
+	hjkValue, empty, err := apiCtx.expressions.Rewrite(rawValue, apiCtx.namespaceSet, apiCtx.namespaceUniverse)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
+	apiCtx.auditEvent.AddQuery(rawValue, hjkValue)
 	req.Form.Set("query", hjkValue)
 
+	// quick response, the selected namespaces are not accessible
+	if empty {
+		return responseEmptyQuery(apiCtx, queryExpr.Type(), true)
+	}
+
+	// cache, shard or route
+	shardPlan, partialQueries, err := apiCtx.partialQueries(queryExpr, rawValue)
+	if err != nil {
+		return err
+	}
+	if (apiCtx.resultCache.Cacheable(start, step) && len(req.FormValue("stats")) == 0) || shardPlan != nil || apiCtx.deduplicated {
+		return fetchedQueryRange(apiCtx, shardPlan, partialQueries, hjkValue, promapiv1.Range{Start: start, End: end, Step: step})
+	}
+
 	// inject
 	reqURL := *req.URL
-	reqURL.RawQuery = req.Form.Encode()
+	var body io.Reader
+	if req.Method == http.MethodPost {
+		// the long rewritten queries may not fit in the URL
+		reqURL.RawQuery = ""
+		body = strings.NewReader(req.Form.Encode())
+	} else {
+		reqURL.RawQuery = req.Form.Encode()
+	}
 
 	// proxy
-	newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	newReq, cancel, err := apiCtx.newUpstreamRequest(req.Method, reqURL, body)
 	if err != nil {
-		return errors.Wrap(err, errInternal)
+		return err
+	}
+	defer cancel()
+	if body != nil {
+		newReq.Header.Set(contentTypeHeader, formContentType)
 	}
 
 	return apiCtx.proxyWith(newReq)
 }
 
+// responseEmptyQuery answers the query without result, a range query always answers a matrix.
+func responseEmptyQuery(apiCtx *apiContext, valueType parser.ValueType, rangeQuery bool) error {
+	var qs *stats.QueryStats
+	if len(apiCtx.request.FormValue("stats")) != 0 {
+		qs = stats.NewQueryStats(stats.NewQueryTimers())
+	}
+
+	var val parser.Value
+	switch valueType {
+	case parser.ValueTypeVector:
+		if rangeQuery {
+			val = promql.Matrix{}
+		} else {
+			val = make(promql.Vector, 0, 0)
+		}
+	case parser.ValueTypeMatrix:
+		val = promql.Matrix{}
+	default:
+		return errors.Wrap(errors.Errorf("unexpected expression type %q", valueType), badRequestErr)
+	}
+
+	emptyRespData := struct {
+		ResultType parser.ValueType  `json:"resultType"`
+		Result     parser.Value      `json:"result"`
+		Stats      *stats.QueryStats `json:"stats,omitempty"`
+	}{
+		ResultType: val.Type(),
+		Result:     val,
+		Stats:      qs,
+	}
+
+	return apiCtx.responseJSON(emptyRespData)
+}
+
+// fetchedQueryRange answers the rewritten range query through the remote API, from the results cache when it is cacheable,
+// only the missing time buckets are queried upstream, and in partial queries when it is planned.
+func fetchedQueryRange(apiCtx *apiContext, shardPlan *prom.ShardPlan, partialQueries []partialQuery, query string, r promapiv1.Range) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	fetch := func(ctx context.Context, r promapiv1.Range) (prommodel.Matrix, promapiv1.Warnings, error) {
+		return upstreamQueryRange(ctx, apiCtx, apiCtx.remoteAPI, query, r)
+	}
+	if shardPlan != nil {
+		fetch = func(ctx context.Context, r promapiv1.Range) (prommodel.Matrix, promapiv1.Warnings, error) {
+			return shardedQueryRange(ctx, apiCtx, shardPlan, partialQueries, r)
+		}
+	}
+
+	var matrix prommodel.Matrix
+	var warnings promapiv1.Warnings
+	if apiCtx.resultCache.Cacheable(r.Start, r.Step) && len(apiCtx.request.FormValue("stats")) == 0 {
+		matrix, warnings, err = apiCtx.resultCache.QueryRange(ctx, query, r, fetch)
+	} else {
+		matrix, warnings, err = fetch(ctx, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	respData := struct {
+		ResultType prommodel.ValueType `json:"resultType"`
+		Result     prommodel.Matrix    `json:"result"`
+	}{
+		ResultType: prommodel.ValMatrix,
+		Result:     matrix,
+	}
+
+	return apiCtx.responseJSONWithWarnings(respData, warnings)
+}
+
+// shardedQuery answers the instant query from the merged results of its partial queries.
+func shardedQuery(apiCtx *apiContext, shardPlan *prom.ShardPlan, queries []partialQuery, ts time.Time) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	parts := make([]prommodel.Vector, len(queries))
+	partWarnings := make([]promapiv1.Warnings, len(queries))
+	g, gctx := errgroup.WithContext(ctx)
+	for idx := range queries {
+		idx := idx
+		g.Go(func() (err error) {
+			parts[idx], partWarnings[idx], err = upstreamQuery(gctx, apiCtx, queries[idx].remoteAPI, queries[idx].query, ts)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	respData := struct {
+		ResultType prommodel.ValueType `json:"resultType"`
+		Result     prommodel.Vector    `json:"result"`
+	}{
+		ResultType: prommodel.ValVector,
+		Result:     shardPlan.MergeVector(parts),
+	}
+
+	return apiCtx.responseJSONWithWarnings(respData, mergeWarnings(partWarnings))
+}
+
+// deduplicatedQuery answers the rewritten instant query through the remote API, which merges the replicas of the upstream.
+func deduplicatedQuery(apiCtx *apiContext, query string, ts time.Time) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	release, err := apiCtx.wait(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	val, warnings, err := apiCtx.remoteAPI.Query(ctx, query, ts)
+	if err != nil {
+		return upstreamErr(err)
+	}
+
+	respData := struct {
+		ResultType prommodel.ValueType `json:"resultType"`
+		Result     prommodel.Value     `json:"result"`
+	}{
+		ResultType: val.Type(),
+		Result:     val,
+	}
+
+	return apiCtx.responseJSONWithWarnings(respData, warnings)
+}
+
+// shardedQueryRange fetches the range query from the merged results of its partial queries.
+func shardedQueryRange(ctx context.Context, apiCtx *apiContext, shardPlan *prom.ShardPlan, queries []partialQuery, r promapiv1.Range) (prommodel.Matrix, promapiv1.Warnings, error) {
+	parts := make([]prommodel.Matrix, len(queries))
+	partWarnings := make([]promapiv1.Warnings, len(queries))
+	g, gctx := errgroup.WithContext(ctx)
+	for idx := range queries {
+		idx := idx
+		g.Go(func() (err error) {
+			parts[idx], partWarnings[idx], err = upstreamQueryRange(gctx, apiCtx, queries[idx].remoteAPI, queries[idx].query, r)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	return shardPlan.MergeMatrix(parts), mergeWarnings(partWarnings), nil
+}
+
+func upstreamQuery(ctx context.Context, apiCtx *apiContext, remoteAPI promapiv1.API, query string, ts time.Time) (prommodel.Vector, promapiv1.Warnings, error) {
+	release, err := apiCtx.wait(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	val, warnings, err := remoteAPI.Query(ctx, query, ts)
+	if err != nil {
+		return nil, nil, upstreamErr(err)
+	}
+
+	vector, ok := val.(prommodel.Vector)
+	if !ok {
+		return nil, nil, errors.Wrap(errors.Errorf("unexpected result type %q", val.Type()), notProvisionedErr)
+	}
+
+	return vector, warnings, nil
+}
+
+func upstreamQueryRange(ctx context.Context, apiCtx *apiContext, remoteAPI promapiv1.API, query string, r promapiv1.Range) (prommodel.Matrix, promapiv1.Warnings, error) {
+	release, err := apiCtx.wait(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	val, warnings, err := remoteAPI.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, nil, upstreamErr(err)
+	}
+
+	matrix, ok := val.(prommodel.Matrix)
+	if !ok {
+		return nil, nil, errors.Wrap(errors.Errorf("unexpected result type %q", val.Type()), notProvisionedErr)
+	}
+
+	return matrix, warnings, nil
+}
+
+func upstreamErr(err error) error {
+	if apiErr, ok := err.(*promapiv1.Error); ok && apiErr.Type == promapiv1.ErrBadData {
+		return errors.Wrap(err, badRequestErr)
+	}
+
+	return errors.Wrap(err, notProvisionedErr)
+}
+
+func mergeWarnings(partWarnings []promapiv1.Warnings) promapiv1.Warnings {
+	var ret promapiv1.Warnings
+	seen := data.NewSet()
+	for _, warnings := range partWarnings {
+		for _, warning := range warnings {
+			if _, exist := seen[warning]; !exist {
+				seen[warning] = struct{}{}
+				ret = append(ret, warning)
+			}
+		}
+	}
+
+	return ret
+}
+
 func hijackSeries(apiCtx *apiContext) error {
 	apiCtx.response.Header().Set(contentTypeHeader, jsonContentType)
 
@@ -254,14 +553,15 @@ func hijackSeries(apiCtx *apiContext) error {
 		return errors.Wrap(err, badRequestErr)
 	}
 
+	start, end := minTime, maxTime
 	if t := queries.Get("start"); t != "" {
-		if _, err := parseTime(t); err != nil {
+		if start, err = parseTime(t); err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
 	}
 
 	if t := queries.Get("end"); t != "" {
-		if _, err := parseTime(t); err != nil {
+		if end, err = parseTime(t); err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
 	}
@@ -271,11 +571,21 @@ func hijackSeries(apiCtx *apiContext) error {
 		return errors.Wrap(errors.New("no match[] parameter provided"), badRequestErr)
 	}
 
+	selectors := make([][]*promlb.Matcher, 0, len(matchFormValues))
 	for _, rawValue := range matchFormValues {
-		_, err := parser.ParseMetricSelector(rawValue)
+		matchers, err := parser.ParseMetricSelector(rawValue)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
+
+		if !apiCtx.allowUnboundedSelectors && !prom.HasConcreteMetricName(matchers) {
+			return errors.Wrap(errors.Errorf("series selector %s has no concrete metric name", rawValue), badRequestErr)
+		}
+		selectors = append(selectors, matchers)
+	}
+
+	if err := apiCtx.limits.CheckSelectors(matchFormValues); err != nil {
+		return errors.Wrap(err, badRequestErr)
 	}
 
 	// quick response
@@ -285,19 +595,34 @@ func hijackSeries(apiCtx *apiContext) error {
 		return apiCtx.responseJSON(emptyRespData)
 	}
 
+	if err := apiCtx.admit(selectors); err != nil {
+		return err
+	}
+
 	// hijack
 	queries.Del("match[]")
 	for idx, rawValue := range matchFormValues {
-		expr, err := parser.ParseExpr(rawValue)
+		log.Debugf("raw series[%s - %d] => %s", apiCtx.tag, idx, rawValue)
+		hjkValue, empty, err := apiCtx.expressions.Rewrite(rawValue, apiCtx.namespaceSet, apiCtx.namespaceUniverse)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
-
-		log.Debugf("raw series[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := prom.ModifyExpression(expr, apiCtx.namespaceSet)
 		log.Debugf("hjk series[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.auditEvent.AddQuery(rawValue, hjkValue)
+
+		if !empty {
+			queries.Add("match[]", hjkValue)
+		}
+	}
+
+	// quick response, the selected namespaces are not accessible
+	if len(queries["match[]"]) == 0 {
+		return apiCtx.responseJSON(make([]promlb.Labels, 0, 0))
+	}
 
-		queries.Add("match[]", hjkValue)
+	// route
+	if len(apiCtx.partitions) != 0 {
+		return routedSeries(apiCtx, matchFormValues, start, end)
 	}
 
 	// inject
@@ -305,10 +630,11 @@ func hijackSeries(apiCtx *apiContext) error {
 	reqURL.RawQuery = queries.Encode()
 
 	// proxy
-	newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	newReq, cancel, err := apiCtx.newUpstreamRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
-		return errors.Wrap(err, errInternal)
+		return err
 	}
+	defer cancel()
 
 	return apiCtx.proxyWith(newReq)
 }
@@ -323,6 +649,18 @@ func hijackRead(apiCtx *apiContext) error {
 	}
 
 	rawQueries := pbreq.Queries
+	for _, rawQuery := range rawQueries {
+		start, end := timestamp.Time(rawQuery.StartTimestampMs), timestamp.Time(rawQuery.EndTimestampMs)
+		if err := apiCtx.limits.CheckRange(start, end, 0); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+
+		if !apiCtx.allowUnboundedSelectors {
+			if err := prom.CheckLabelMatcherNames(rawQuery.Matchers); err != nil {
+				return errors.Wrap(err, badRequestErr)
+			}
+		}
+	}
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
@@ -340,12 +678,19 @@ func hijackRead(apiCtx *apiContext) error {
 		return apiCtx.responseProto(emptyRespData)
 	}
 
+	// route
+	if len(apiCtx.partitions) != 0 {
+		return routedRead(apiCtx, pbreq)
+	}
+
 	// hijack
 	hjkQueries := make([]*prompb.Query, 0, len(rawQueries))
 	for idx, rawValue := range rawQueries {
 		log.Debugf("raw read[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyQuery(rawValue, apiCtx.namespaceSet, apiCtx.filterReaderLabelSet)
+		originalValue := rawValue.String()
+		hjkValue := modifyQuery(rawValue, apiCtx.namespaceSet, apiCtx.namespaceUniverse, apiCtx.filterReaderLabelSet)
 		log.Debugf("hjk read[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.auditEvent.AddQuery(originalValue, hjkValue.String())
 
 		hjkQueries = append(hjkQueries, hjkValue)
 	}
@@ -359,10 +704,13 @@ func hijackRead(apiCtx *apiContext) error {
 	compressedData := snappy.Encode(nil, marshaledData)
 
 	// proxy
-	newReq, err := http.NewRequest(http.MethodPost, req.URL.String(), bytes.NewBuffer(compressedData))
+	newReq, cancel, err := apiCtx.newUpstreamRequest(http.MethodPost, *req.URL, bytes.NewBuffer(compressedData))
 	if err != nil {
-		return errors.Wrap(err, errInternal)
+		return err
 	}
+	defer cancel()
+	newReq.Header.Set(contentTypeHeader, req.Header.Get(contentTypeHeader))
+	newReq.Header.Set(contentEncodingHeader, req.Header.Get(contentEncodingHeader))
 
 	return apiCtx.proxyWith(newReq)
 }
@@ -385,7 +733,7 @@ func hijackLabelNamespaces(apiCtx *apiContext) error {
 	return apiCtx.responseJSON(hjkValue)
 }
 
-func hijackLabelName(apiCtx *apiContext) error {
+func hijackLabelName(apiCtx *apiContext) (err error) {
 	apiCtx.response.Header().Set(contentTypeHeader, jsonContentType)
 
 	// quick response
@@ -395,27 +743,56 @@ func hijackLabelName(apiCtx *apiContext) error {
 		return apiCtx.responseJSON(emptyRespData)
 	}
 
+	// pre check
+	var start, end time.Time
+	if t := apiCtx.request.FormValue("start"); len(t) != 0 {
+		if start, err = parseTime(t); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+	if t := apiCtx.request.FormValue("end"); len(t) != 0 {
+		if end, err = parseTime(t); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	// route
+	if len(apiCtx.partitions) != 0 {
+		return routedLabelName(apiCtx, start, end)
+	}
+
 	// hijack
-	expr := prom.NewExprForCountAllLabels(apiCtx.namespaceSet.Values())
-	vals, _, err := apiCtx.remoteAPI.Query(apiCtx.request.Context(), expr, time.Time{})
+	ctx := apiCtx.request.Context()
+	release, err := apiCtx.wait(ctx)
 	if err != nil {
-		return errors.Wrap(err, notProvisionedErr)
+		return err
 	}
+	defer release()
 
-	vectorVals, ok := vals.(prommodel.Vector)
-	if !ok {
+	names, err := apiCtx.metricNames.Names(ctx, apiCtx.namespaceSet.Values(), start, end)
+	if err != nil {
 		return errors.Wrap(err, notProvisionedErr)
 	}
 
-	hjkValues := make(prommodel.LabelValues, 0, len(vectorVals))
-	for _, vectorVal := range vectorVals {
-		valLabelSet := prommodel.LabelSet(vectorVal.Metric)
-		hjkValues = append(hjkValues, valLabelSet["__name__"])
+	hjkValues := make(prommodel.LabelValues, 0, len(names))
+	for _, name := range names {
+		hjkValues = append(hjkValues, prommodel.LabelValue(name))
 	}
 
 	return apiCtx.responseJSON(hjkValues)
 }
 
+// hijackLabelValues proxies to the upstream of the accessible namespaces, or merges the label values of their upstreams.
+func hijackLabelValues(apiCtx *apiContext) error {
+	if len(apiCtx.partitions) == 0 {
+		return apiCtx.proxy()
+	}
+
+	apiCtx.response.Header().Set(contentTypeHeader, jsonContentType)
+
+	return routedLabelValues(apiCtx, mux.Vars(apiCtx.request)["name"])
+}
+
 func parseTime(s string) (time.Time, error) {
 	if t, err := strconv.ParseFloat(s, 64); err == nil {
 		s, ns := math.Modf(t)
@@ -442,7 +819,7 @@ func parseDuration(s string) (time.Duration, error) {
 	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
 }
 
-func modifyQuery(originalQuery *prompb.Query, namespaceSet, filterReaderLabelSet data.Set) (modifiedQuery *prompb.Query) {
+func modifyQuery(originalQuery *prompb.Query, namespaceSet, namespaceUniverse, filterReaderLabelSet data.Set) (modifiedQuery *prompb.Query) {
 	rawMatchers := originalQuery.GetMatchers()
 	filteredMatchers := make([]*prompb.LabelMatcher, 0, len(rawMatchers))
 	for _, rawMatcher := range rawMatchers {
@@ -451,6 +828,6 @@ func modifyQuery(originalQuery *prompb.Query, namespaceSet, filterReaderLabelSet
 		}
 	}
 
-	originalQuery.Matchers = prom.FilterLabelMatchers(namespaceSet, filteredMatchers)
+	originalQuery.Matchers = prom.FilterLabelMatchersWithin(namespaceSet, namespaceUniverse, filteredMatchers)
 	return originalQuery
 }
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+	promgo "github.com/prometheus/client_model/go"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/upstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	// minTime and maxTime bound the series requests without start or end, like Prometheus does.
+	minTime = time.Unix(math.MinInt64/1000+62135596801, 0).UTC()
+	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999).UTC()
+)
+
+// routedFederate federates the series from the upstreams of the accessible namespaces, merged by metric family.
+func routedFederate(apiCtx *apiContext, matchFormValues []string) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	matches, err := apiCtx.routeSelectors("federate", matchFormValues)
+	if err != nil {
+		return err
+	}
+
+	parts := make([][]*promgo.MetricFamily, len(apiCtx.partitions))
+	err = apiCtx.eachPartition(ctx, func(ctx context.Context, idx int, partition upstream.Partition) (err error) {
+		if len(matches[idx]) == 0 {
+			return nil
+		}
+
+		parts[idx], err = partition.Upstream.Federate(ctx, matches[idx])
+		if err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return apiCtx.responseMetrics(upstream.MergeMetricFamilies(parts))
+}
+
+// routedSeries lists the series from the upstreams of the accessible namespaces.
+func routedSeries(apiCtx *apiContext, matchFormValues []string, start, end time.Time) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	matches, err := apiCtx.routeSelectors("series", matchFormValues)
+	if err != nil {
+		return err
+	}
+
+	parts := make([][]prommodel.LabelSet, len(apiCtx.partitions))
+	err = apiCtx.eachPartition(ctx, func(ctx context.Context, idx int, partition upstream.Partition) (err error) {
+		if len(matches[idx]) == 0 {
+			return nil
+		}
+
+		parts[idx], _, err = partition.Upstream.API.Series(ctx, matches[idx], start, end)
+		if err != nil {
+			return upstreamErr(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the upstreams have no namespace in common
+	series := make([]prommodel.LabelSet, 0)
+	for _, part := range parts {
+		series = append(series, part...)
+	}
+
+	return apiCtx.responseJSON(series)
+}
+
+// routedRead reads the series from the upstreams of the accessible namespaces, merged query by query.
+func routedRead(apiCtx *apiContext, pbreq *prompb.ReadRequest) error {
+	ctx, cancel, err := apiCtx.queryContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	readReqs := make([]*prompb.ReadRequest, 0, len(apiCtx.partitions))
+	for _, partition := range apiCtx.partitions {
+		hjkQueries := make([]*prompb.Query, 0, len(pbreq.Queries))
+		for idx, rawValue := range pbreq.Queries {
+			originalValue := rawValue.String()
+			hjkValue := modifyQuery(copyQuery(rawValue), partition.Namespaces, apiCtx.namespaceUniverse, apiCtx.filterReaderLabelSet)
+			log.Debugf("hjk read[%s - %s %d] => %s", apiCtx.tag, partition.Upstream.Name, idx, hjkValue)
+			apiCtx.auditEvent.AddQuery(originalValue, hjkValue.String())
+
+			hjkQueries = append(hjkQueries, hjkValue)
+		}
+
+		readReqs = append(readReqs, &prompb.ReadRequest{Queries: hjkQueries})
+	}
+
+	parts := make([]*prompb.ReadResponse, len(apiCtx.partitions))
+	err = apiCtx.eachPartition(ctx, func(ctx context.Context, idx int, partition upstream.Partition) (err error) {
+		parts[idx], err = partition.Upstream.Read(ctx, readReqs[idx])
+		if err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return apiCtx.responseProto(upstream.MergeReadResponses(parts, len(pbreq.Queries)))
+}
+
+// routedLabelName lists the metric names of the accessible namespaces from their upstreams.
+func routedLabelName(apiCtx *apiContext, start, end time.Time) error {
+	ctx := apiCtx.request.Context()
+
+	parts := make([][]string, len(apiCtx.partitions))
+	err := apiCtx.eachPartition(ctx, func(ctx context.Context, idx int, partition upstream.Partition) (err error) {
+		parts[idx], err = partition.Upstream.MetricNames.Names(ctx, partition.Namespaces.Values(), start, end)
+		if err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := data.NewSet()
+	for _, part := range parts {
+		for _, name := range part {
+			names[name] = struct{}{}
+		}
+	}
+
+	hjkValues := make(prommodel.LabelValues, 0, len(names))
+	for _, name := range names.Values() {
+		hjkValues = append(hjkValues, prommodel.LabelValue(name))
+	}
+
+	return apiCtx.responseJSON(hjkValues)
+}
+
+// routedLabelValues lists the values of the label from the upstreams of the accessible namespaces.
+func routedLabelValues(apiCtx *apiContext, name string) error {
+	ctx := apiCtx.request.Context()
+
+	parts := make([]prommodel.LabelValues, len(apiCtx.partitions))
+	err := apiCtx.eachPartition(ctx, func(ctx context.Context, idx int, partition upstream.Partition) (err error) {
+		parts[idx], _, err = partition.Upstream.API.LabelValues(ctx, name)
+		if err != nil {
+			return upstreamErr(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	values := data.NewSet()
+	for _, part := range parts {
+		for _, value := range part {
+			values[string(value)] = struct{}{}
+		}
+	}
+
+	hjkValues := make(prommodel.LabelValues, 0, len(values))
+	for _, value := range values.Values() {
+		hjkValues = append(hjkValues, prommodel.LabelValue(value))
+	}
+
+	return apiCtx.responseJSON(hjkValues)
+}
+
+// routeSelectors rewrites the raw selectors for the namespaces of each upstream, without the provably empty ones.
+func (c *apiContext) routeSelectors(kind string, rawValues []string) ([][]string, error) {
+	ret := make([][]string, 0, len(c.partitions))
+	for _, partition := range c.partitions {
+		matches := make([]string, 0, len(rawValues))
+		for idx, rawValue := range rawValues {
+			hjkValue, empty, err := c.expressions.Rewrite(rawValue, partition.Namespaces, c.namespaceUniverse)
+			if err != nil {
+				return nil, errors.Wrap(err, badRequestErr)
+			}
+			log.Debugf("hjk %s[%s - %s %d] => %s", kind, c.tag, partition.Upstream.Name, idx, hjkValue)
+
+			if !empty {
+				matches = append(matches, hjkValue)
+			}
+		}
+		ret = append(ret, matches)
+	}
+
+	return ret, nil
+}
+
+// eachPartition calls the function concurrently for the upstream of each partition of the accessible namespaces,
+// once the upstream request is scheduled, and fails with the first error.
+func (c *apiContext) eachPartition(ctx context.Context, fn func(ctx context.Context, idx int, partition upstream.Partition) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	for idx, partition := range c.partitions {
+		idx, partition := idx, partition
+		g.Go(func() error {
+			release, err := c.wait(gctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			return fn(gctx, idx, partition)
+		})
+	}
+
+	return g.Wait()
+}
+
+// copyQuery copies the remote read query, whose matchers are modified in place by the rewrite.
+func copyQuery(query *prompb.Query) *prompb.Query {
+	matchers := make([]*prompb.LabelMatcher, 0, len(query.Matchers))
+	for _, m := range query.Matchers {
+		matchers = append(matchers, &prompb.LabelMatcher{Type: m.Type, Name: m.Name, Value: m.Value})
+	}
+
+	return &prompb.Query{
+		StartTimestampMs: query.StartTimestampMs,
+		EndTimestampMs:   query.EndTimestampMs,
+		Matchers:         matchers,
+		Hints:            query.Hints,
+	}
+}
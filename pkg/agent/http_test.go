@@ -17,6 +17,7 @@ import (
 	"unsafe"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/juju/errors"
 	promapi "github.com/prometheus/client_golang/api"
 	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
@@ -31,8 +32,11 @@ import (
 	"github.com/prometheus/prometheus/util/testutil"
 	promweb "github.com/prometheus/prometheus/web"
 	"github.com/rancher/prometheus-auth/pkg/agent/samples"
+	"github.com/rancher/prometheus-auth/pkg/auth"
 	"github.com/rancher/prometheus-auth/pkg/data"
 	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/rancher/prometheus-auth/pkg/metricnames"
+	"github.com/rancher/prometheus-auth/pkg/upstream"
 	k8scorev1 "k8s.io/api/core/v1"
 	"k8s.io/apiserver/pkg/authentication/user"
 )
@@ -126,7 +130,7 @@ func Test_accessControl(t *testing.T) {
 			for name, tokenScenario := range tokenScenarios {
 				println("testing", token, name)
 				req := httptest.NewRequest("GET", "http://example.org/federate?"+tokenScenario.Queries.Encode(), nil)
-				req.Header.Set(rancherUserHeaderKey, token)
+				req.Header.Set(auth.RancherUserHeaderKey, token)
 
 				res := httptest.NewRecorder()
 				httpBackend.ServeHTTP(res, req)
@@ -155,7 +159,7 @@ func Test_accessControl(t *testing.T) {
 			for name, tokenScenario := range tokenScenarios {
 				println("testing", token, name)
 				req := httptest.NewRequest("GET", "http://example.org/api/v1/label/"+tokenScenario.Params["name"]+"/values", nil)
-				req.Header.Set(rancherUserHeaderKey, token)
+				req.Header.Set(auth.RancherUserHeaderKey, token)
 				res := httptest.NewRecorder()
 				httpBackend.ServeHTTP(res, req)
 				if got, want := res.Code, tokenScenario.RespCode; got != want {
@@ -186,7 +190,7 @@ func Test_accessControl(t *testing.T) {
 				// GET
 				func(tokenScenario *samples.Scenario, token string, name string) {
 					req := httptest.NewRequest("GET", "http://example.org/api/v1"+tokenScenario.Endpoint+"?"+tokenScenario.Queries.Encode(), nil)
-					req.Header.Set(rancherUserHeaderKey, token)
+					req.Header.Set(auth.RancherUserHeaderKey, token)
 					res := httptest.NewRecorder()
 					httpBackend.ServeHTTP(res, req)
 					if got, want := res.Code, tokenScenario.RespCode; got != want {
@@ -201,7 +205,7 @@ func Test_accessControl(t *testing.T) {
 				func(tokenScenario *samples.Scenario, token string, name string) {
 					req := httptest.NewRequest("POST", "http://example.org/api/v1"+tokenScenario.Endpoint, strings.NewReader(tokenScenario.Queries.Encode()))
 					req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
-					req.Header.Set(rancherUserHeaderKey, token)
+					req.Header.Set(auth.RancherUserHeaderKey, token)
 					res := httptest.NewRecorder()
 					httpBackend.ServeHTTP(res, req)
 					if got, want := res.Code, tokenScenario.RespCode; got != want {
@@ -239,7 +243,7 @@ func Test_accessControl(t *testing.T) {
 	// 			compressedProtoReqData := snappy.Encode(nil, protoReqData)
 
 	// 			req := httptest.NewRequest("POST", "http://example.org/api/v1/read", bytes.NewBuffer(compressedProtoReqData))
-	// 			req.Header.Set(rancherUserHeaderKey, token)
+	// 			req.Header.Set(auth.RancherUserHeaderKey, token)
 	// 			res := httptest.NewRecorder()
 	// 			httpBackend.ServeHTTP(res, req)
 
@@ -285,7 +289,7 @@ func Test_accessControl(t *testing.T) {
 			for name, tokenScenario := range tokenScenarios {
 				println("testing", token, name)
 				req := httptest.NewRequest("GET", "http://example.org/api/v1/series?"+tokenScenario.Queries.Encode(), nil)
-				req.Header.Set(rancherUserHeaderKey, token)
+				req.Header.Set(auth.RancherUserHeaderKey, token)
 				res := httptest.NewRecorder()
 				httpBackend.ServeHTTP(res, req)
 				if got, want := res.Code, tokenScenario.RespCode; got != want {
@@ -303,6 +307,231 @@ func Test_accessControl(t *testing.T) {
 	}()
 }
 
+func Test_upstreamRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	body := url.Values{"query": []string{"up"}, "timeout": []string{"5s"}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("User-Agent", "Grafana/7.3")
+
+	var upstream *http.Request
+	var upstreamBody string
+	var upstreamCanceled bool
+	apiCtx := &apiContext{
+		response: httptest.NewRecorder(),
+		request:  req,
+		proxyHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstream = r
+			buf := &bytes.Buffer{}
+			buf.ReadFrom(r.Body)
+			upstreamBody = buf.String()
+
+			// the client disconnects
+			cancel()
+			upstreamCanceled = r.Context().Err() != nil
+		}),
+		namespaceSet:            data.NewSet("ns-a"),
+		allowUnboundedSelectors: true,
+	}
+
+	if err := hijackQuery(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream.Method != http.MethodPost || upstream.URL.RawQuery != "" {
+		t.Errorf("expected a POST request with the form in its body, got %s %s", upstream.Method, upstream.URL)
+	}
+	if form, _ := url.ParseQuery(upstreamBody); form.Get("query") != `up{namespace="ns-a"}` || form.Get("timeout") != "5s" {
+		t.Errorf("unexpected upstream form %s", upstreamBody)
+	}
+	if upstream.Header.Get("Content-Type") != "application/x-www-form-urlencoded" || upstream.Header.Get("User-Agent") != "Grafana/7.3" {
+		t.Errorf("expected the safe headers to be copied, got %v", upstream.Header)
+	}
+	if upstream.Header.Get("Authorization") != "" {
+		t.Error("expected the credentials not to be copied")
+	}
+	if deadline, ok := upstream.Context().Deadline(); !ok || time.Until(deadline) > 5*time.Second+upstreamTimeoutGrace {
+		t.Errorf("expected the upstream deadline of the timeout, got %v", deadline)
+	}
+	if !upstreamCanceled {
+		t.Error("expected the upstream request to be canceled with the client request")
+	}
+}
+
+func Test_routedRequests(t *testing.T) {
+	newUpstream := func(name, namespace string) *upstream.Upstream {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			for _, value := range append(r.Form["query"], r.Form["match[]"]...) {
+				if !strings.Contains(value, namespace) {
+					http.Error(w, fmt.Sprintf("%s is not routed to %s", value, name), http.StatusBadRequest)
+					return
+				}
+			}
+
+			switch r.URL.Path {
+			case "/api/v1/query":
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[0,"2"]}]}}`)
+			case "/api/v1/series":
+				fmt.Fprintf(w, `{"status":"success","data":[{"__name__":"up","namespace":%q}]}`, namespace)
+			case "/federate":
+				fmt.Fprintf(w, "# TYPE up untyped\nup{namespace=%q} 1 1000\n", namespace)
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		u, _ := url.Parse(server.URL)
+		ret, err := upstream.New(context.Background(), name, []*url.URL{u}, upstream.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ret
+	}
+
+	router, err := upstream.NewRouter(context.Background(), upstream.Config{Upstreams: []upstream.Route{
+		{Name: "a", URL: newUpstream("a", "ns-a").URL.String(), Namespaces: []string{"ns-a"}},
+	}}, newUpstream(upstream.DefaultName, "ns-b"), upstream.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitions := router.Partition(data.NewSet("ns-a", "ns-b"))
+
+	newAPIContext := func(req *http.Request) (*apiContext, *httptest.ResponseRecorder) {
+		res := httptest.NewRecorder()
+		return &apiContext{
+			response:                res,
+			request:                 req,
+			namespaceSet:            data.NewSet("ns-a", "ns-b"),
+			partitions:              partitions,
+			allowUnboundedSelectors: true,
+		}, res
+	}
+
+	apiCtx, res := newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/query?query=sum(up)", nil))
+	if err := hijackQuery(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Body.String(), `"value":[0,"4"]`) {
+		t.Errorf("expected the merged sum, got %s", res.Body)
+	}
+
+	apiCtx, _ = newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/query?query=avg(up)", nil))
+	if err := hijackQuery(apiCtx); err == nil || !errors.IsBadRequest(err) {
+		t.Errorf("expected the query not to be merged, got %v", err)
+	}
+
+	apiCtx, res = newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up", nil))
+	if err := hijackSeries(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if body := res.Body.String(); !strings.Contains(body, `"ns-a"`) || !strings.Contains(body, `"ns-b"`) {
+		t.Errorf("expected the series of both upstreams, got %s", body)
+	}
+
+	apiCtx, res = newAPIContext(httptest.NewRequest(http.MethodGet, "/federate?match[]=up", nil))
+	if err := hijackFederate(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if body := res.Body.String(); strings.Count(body, "# TYPE up") != 1 || strings.Count(body, "up{") != 2 {
+		t.Errorf("expected the series of both upstreams in a single metric family, got %s", body)
+	}
+
+	// the administrators are proxied to the default upstream, but for the series of the other upstreams
+	agt := &agent{myToken: "agent-token", router: router}
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for path, expectedStatus := range map[string]int{
+		"/api/v1/query?query=up":         http.StatusBadRequest,
+		"/api/v1/label/namespace/values": http.StatusBadRequest,
+		"/federate?match[]=up":           http.StatusBadRequest,
+		"/api/v1/rules":                  http.StatusNoContent,
+		"/api/v1/status/runtimeinfo":     http.StatusNoContent,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer agent-token")
+		res := httptest.NewRecorder()
+		accessControl(agt, proxied).ServeHTTP(res, req)
+		if res.Code != expectedStatus {
+			t.Errorf("%s: expected %d for the administrators, got %d", path, expectedStatus, res.Code)
+		}
+	}
+}
+
+func Test_replicatedRequests(t *testing.T) {
+	newReplica := func(name string) *url.URL {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name == "down" {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/api/v1/query":
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`)
+			case "/api/v1/query_range":
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"namespace":"ns-a","prometheus_replica":%q},"values":[[0,"1"]]}]}}`, name)
+			case "/api/v1/series":
+				fmt.Fprintf(w, `{"status":"success","data":[{"__name__":"up","namespace":"ns-a","prometheus_replica":%q}]}`, name)
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+
+	replicated, err := upstream.New(context.Background(), upstream.DefaultName, []*url.URL{newReplica("down"), newReplica("b")}, upstream.Options{ReplicaLabel: "prometheus_replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := upstream.NewRouter(context.Background(), upstream.Config{}, replicated, upstream.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAPIContext := func(req *http.Request) (*apiContext, *httptest.ResponseRecorder) {
+		res := httptest.NewRecorder()
+		return &apiContext{
+			response:                res,
+			request:                 req,
+			namespaceSet:            data.NewSet("ns-a"),
+			remoteAPI:               replicated.API,
+			partitions:              router.Partition(data.NewSet("ns-a")),
+			deduplicated:            true,
+			allowUnboundedSelectors: true,
+		}, res
+	}
+
+	apiCtx, res := newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/query?query=scalar(up)", nil))
+	if err := hijackQuery(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Body.String(), `"resultType":"scalar"`) {
+		t.Errorf("expected the scalar of the available replica, got %s", res.Body)
+	}
+
+	apiCtx, res = newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=0&end=60&step=15", nil))
+	if err := hijackQueryRange(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if body := res.Body.String(); !strings.Contains(body, `"ns-a"`) || strings.Contains(body, "prometheus_replica") {
+		t.Errorf("expected the series without the replica label, got %s", body)
+	}
+
+	apiCtx, res = newAPIContext(httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up", nil))
+	if err := hijackSeries(apiCtx); err != nil {
+		t.Fatal(err)
+	}
+	if body := res.Body.String(); !strings.Contains(body, `"ns-a"`) || strings.Contains(body, "prometheus_replica") {
+		t.Errorf("expected the series without the replica label, got %s", body)
+	}
+}
+
 func startPrometheusWebHandler(t *testing.T, webHandler *promweb.Handler) {
 	go func() {
 		err := webHandler.Run(context.Background())
@@ -395,11 +624,24 @@ func mockAgent(t *testing.T) *agent {
 		t.Error(err)
 	}
 
+	authenticator, err := auth.NewChain(auth.FirstMatch, auth.NewRancherHeaders(nil))
+	if err != nil {
+		t.Error(err)
+	}
+
+	defaultUpstream, err := upstream.New(agtCfg.ctx, upstream.DefaultName, []*url.URL{proxyURL}, upstream.Options{})
+	if err != nil {
+		t.Error(err)
+	}
+
 	return &agent{
-		cfg:        agtCfg,
-		nodes:      mockNodes(),
-		namespaces: mockOwnedNamespaces(),
-		remoteAPI:  promapiv1.NewAPI(promClient),
+		cfg:             agtCfg,
+		authenticator:   authenticator,
+		nodes:           mockNodes(),
+		namespaces:      mockOwnedNamespaces(),
+		remoteAPI:       promapiv1.NewAPI(promClient),
+		defaultUpstream: defaultUpstream,
+		metricNames:     metricnames.NewLister(agtCfg.ctx, promClient, 0),
 	}
 }
 
@@ -1,26 +1,133 @@
 package agent
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
 
 	"github.com/cockroachdb/cmux"
+	"github.com/juju/errors"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 )
 
-/* PANDARIA: Fix get request head X-RANCHER-GROUP is nil.
-we need to be aware that keys are canonicalized header["X-Rancher-Group"] will be work, but header["X-RANCHER-GROUP"] will not return any value.
-Details view https://github.com/golang/go/issues/34799
-*/
 const (
-	rancherUserHeaderKey   = "X-Rancher-User"
-	rancherGroupHeaderKey  = "X-Rancher-Group"
-	authorizationHeaderKey = "Authorization"
+	tlsConnKey contextKey = "_tlsConn_"
 )
 
+func createTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to load TLS key pair")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// prefer HTTP/1.1, only the gRPC clients negotiate HTTP/2 over TLS
+		NextProtos: []string{"http/1.1", "h2"},
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		caBytes, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to read client CA bundle")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.Errorf("no valid certificates in client CA bundle %s", clientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// withTLSConn remembers the TLS connection underneath cmux,
+// the http.Server can't populate http.Request.TLS through the cmux.MuxConn.
+func withTLSConn(ctx context.Context, conn net.Conn) context.Context {
+	if muxConn, ok := conn.(*cmux.MuxConn); ok {
+		conn = muxConn.Conn
+	}
+	if settingsConn, ok := conn.(*http2SettingsConn); ok {
+		conn = settingsConn.Conn
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return context.WithValue(ctx, tlsConnKey, tlsConn)
+	}
+
+	return ctx
+}
+
+func tlsConnectionState(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+
+	tlsConn, ok := r.Context().Value(tlsConnKey).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+func createListenerMux(listener net.Listener) cmux.CMux {
+	return cmux.New(http2SettingsListener{listener})
+}
+
+// http2SettingsListener accepts the connections sending an empty HTTP/2 SETTINGS frame after the client preface,
+// the gRPC clients wait for the settings of the server before sending the headers matched by cmux.
+type http2SettingsListener struct {
+	net.Listener
+}
+
+func (l http2SettingsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http2SettingsConn{Conn: conn}, nil
+}
+
+type http2SettingsConn struct {
+	net.Conn
+	preface []byte
+	sniffed bool
+}
+
+func (c *http2SettingsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.sniffed {
+		return n, err
+	}
+
+	c.preface = append(c.preface, p[:n]...)
+	if !strings.HasPrefix(http2.ClientPreface, string(c.preface)) && !strings.HasPrefix(string(c.preface), http2.ClientPreface) {
+		c.sniffed, c.preface = true, nil
+		return n, err
+	}
+	if len(c.preface) >= len(http2.ClientPreface) {
+		c.sniffed, c.preface = true, nil
+		if werr := http2.NewFramer(c.Conn, nil).WriteSettings(); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
 func createHTTPListener(mux cmux.CMux) net.Listener {
 	return mux.Match(
 		cmux.HTTP1Fast(),
@@ -51,13 +158,14 @@ func http2HeaderFieldEqual(nameValuePairs map[string]string) cmux.Matcher {
 		}
 
 		framer := http2.NewFramer(ioutil.Discard, r)
+		found := make(map[string]struct{}, len(nameValuePairs))
 		hdec := hpack.NewDecoder(uint32(4<<10), func(hf hpack.HeaderField) {
 			for name, value := range nameValuePairs {
-				matched = strings.EqualFold(hf.Name, name) && hf.Value == value
-				if !matched {
-					break
+				if strings.EqualFold(hf.Name, name) && hf.Value == value {
+					found[name] = struct{}{}
 				}
 			}
+			matched = len(found) == len(nameValuePairs)
 		})
 		for {
 			f, err := framer.ReadFrame()
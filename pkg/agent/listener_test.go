@@ -0,0 +1,244 @@
+// +build test
+
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pem  []byte
+	kpem []byte
+}
+
+func newTestCert(t *testing.T, subject pkix.Name, parent *testCert, isCA bool) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func Test_tlsListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, pkix.Name{CommonName: "test-ca"}, nil, true)
+	server := newTestCert(t, pkix.Name{CommonName: "prometheus-auth"}, ca, false)
+	client := newTestCert(t, pkix.Name{CommonName: "federator", Organization: []string{"team-a", "team-b"}}, ca, false)
+	strangerCA := newTestCert(t, pkix.Name{CommonName: "stranger-ca"}, nil, true)
+	stranger := newTestCert(t, pkix.Name{CommonName: "stranger"}, strangerCA, false)
+
+	files := map[string][]byte{
+		"ca.crt":     ca.pem,
+		"server.crt": server.pem,
+		"server.key": server.kpem,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tlsConfig, err := createTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenerMux := createListenerMux(tls.NewListener(listener, tlsConfig))
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.TLS = tlsConnectionState(r)
+			info, ok := auth.UserFromClientCertificate(r)
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(info.Name + "/" + info.Groups[0] + "," + info.Groups[1]))
+		}),
+		ConnContext: withTLSConn,
+	}
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go httpServer.Serve(createHTTPListener(listenerMux))
+	go grpcServer.Serve(createGRPCListener(listenerMux))
+	go listenerMux.Serve()
+	defer listener.Close()
+	defer grpcServer.Stop()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+
+	cases := []struct {
+		name         string
+		certificates []tls.Certificate
+		expectCode   int
+		expectBody   string
+	}{
+		{
+			name:       "without client certificate",
+			expectCode: http.StatusUnauthorized,
+		},
+		{
+			name: "with client certificate",
+			certificates: []tls.Certificate{{
+				Certificate: [][]byte{client.cert.Raw},
+				PrivateKey:  client.key,
+			}},
+			expectCode: http.StatusOK,
+			expectBody: "federator/team-a,team-b",
+		},
+	}
+
+	for _, c := range cases {
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      rootCAs,
+					Certificates: c.certificates,
+				},
+				ForceAttemptHTTP2: true,
+			},
+		}
+
+		resp, err := httpClient.Get("https://" + listener.Addr().String() + "/api/v1/query")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.expectCode {
+			t.Errorf("%s: got code %d, want %d", c.name, resp.StatusCode, c.expectCode)
+		}
+		if c.expectBody != "" && string(body) != c.expectBody {
+			t.Errorf("%s: got body %q, want %q", c.name, body, c.expectBody)
+		}
+	}
+
+	// the gRPC requests share the TLS listener, the client certificate is optional but verified
+	grpcCases := []struct {
+		name         string
+		certificates []tls.Certificate
+		expectErr    bool
+	}{
+		{
+			name: "gRPC without client certificate",
+		},
+		{
+			name: "gRPC with client certificate",
+			certificates: []tls.Certificate{{
+				Certificate: [][]byte{client.cert.Raw},
+				PrivateKey:  client.key,
+			}},
+		},
+		{
+			name: "gRPC with untrusted client certificate",
+			certificates: []tls.Certificate{{
+				Certificate: [][]byte{stranger.cert.Raw},
+				PrivateKey:  stranger.key,
+			}},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range grpcCases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		certificates := c.certificates
+		conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs: rootCAs,
+			// send the certificate even when it is not signed by the CAs of the server
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certificates) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certificates[0], nil
+			},
+		})))
+		if err != nil {
+			cancel()
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		conn.Close()
+		cancel()
+
+		if c.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("%s: got status %s", c.name, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// RequestIDHeader carries the request ID given by the client or a front proxy.
+	RequestIDHeader = "X-Request-Id"
+	// AuditIDHeader returns the ID of the audit event to the client.
+	AuditIDHeader = "Audit-Id"
+)
+
+type Config struct {
+	// Path of the log file, "-" writes to the stdout.
+	Path string
+	// MaxSize in megabytes of the log file before it gets rotated.
+	MaxSize int
+	// MaxBackups is the maximum number of rotated log files to retain.
+	MaxBackups int
+	// MaxAge in days to retain the rotated log files.
+	MaxAge int
+	// Level is used for the events no policy rule matches.
+	Level Level
+	// PolicyFile holds the rules choosing the level of the events.
+	PolicyFile string
+}
+
+type UserInfo struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type Query struct {
+	Original  string `json:"original"`
+	Rewritten string `json:"rewritten,omitempty"`
+}
+
+// Lockout records a key locked out after failed authentications.
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// Event records an access decision and its outcome.
+type Event struct {
+	Level                    Level     `json:"level"`
+	AuditID                  string    `json:"auditID"`
+	RequestReceivedTimestamp time.Time `json:"requestReceivedTimestamp"`
+	Method                   string    `json:"method"`
+	RequestURI               string    `json:"requestURI"`
+	SourceIP                 string    `json:"sourceIP,omitempty"`
+	User                     *UserInfo `json:"user,omitempty"`
+	Authenticator            string    `json:"authenticator,omitempty"`
+	AdminBypass              bool      `json:"adminBypass"`
+	Namespaces               []string  `json:"namespaces,omitempty"`
+	Queries                  []Query   `json:"queries,omitempty"`
+	Error                    string    `json:"error,omitempty"`
+	Lockouts                 []Lockout `json:"lockouts,omitempty"`
+	ResponseStatus           int       `json:"responseStatus"`
+	UpstreamStatus           int       `json:"upstreamStatus,omitempty"`
+	ResponseBytes            int64     `json:"responseBytes"`
+	LatencySeconds           float64   `json:"latencySeconds"`
+
+	path     string
+	response *responseRecorder
+	proxied  bool
+}
+
+// SetUser records the authenticated identity.
+func (e *Event) SetUser(info user.Info, authenticator string) {
+	if e == nil {
+		return
+	}
+
+	e.User = &UserInfo{
+		Username: info.GetName(),
+		UID:      info.GetUID(),
+		Groups:   info.GetGroups(),
+	}
+	e.Authenticator = authenticator
+}
+
+// SetSourceIP records the client IP.
+func (e *Event) SetSourceIP(ip string) {
+	if e == nil {
+		return
+	}
+
+	e.SourceIP = ip
+}
+
+// SetAdminBypass marks the request as not restricted to any namespace.
+func (e *Event) SetAdminBypass() {
+	if e == nil {
+		return
+	}
+
+	e.AdminBypass = true
+}
+
+// SetNamespaces records the namespaces the request is restricted to.
+func (e *Event) SetNamespaces(namespaces []string) {
+	if e == nil {
+		return
+	}
+
+	e.Namespaces = namespaces
+}
+
+// AddQuery records an original query and its rewritten form.
+func (e *Event) AddQuery(original, rewritten string) {
+	if e == nil {
+		return
+	}
+
+	e.Queries = append(e.Queries, Query{Original: original, Rewritten: rewritten})
+}
+
+// SetError records the error answered to the client.
+func (e *Event) SetError(message string) {
+	if e == nil {
+		return
+	}
+
+	e.Error = message
+}
+
+// AddLockout records a key locked out by the failed authentication of the request,
+// the events with lockouts are always logged.
+func (e *Event) AddLockout(key string, failures int, lockedUntil time.Time) {
+	if e == nil {
+		return
+	}
+
+	e.Lockouts = append(e.Lockouts, Lockout{Key: key, Failures: failures, LockedUntil: lockedUntil})
+}
+
+// Proxied marks the response as coming from the upstream.
+func (e *Event) Proxied() {
+	if e == nil {
+		return
+	}
+
+	e.proxied = true
+}
+
+// Logger writes the audit events as JSON lines.
+type Logger struct {
+	policy *Policy
+
+	mu  sync.Mutex
+	out io.Writer
+	enc *json.Encoder
+}
+
+func NewLogger(cfg Config) (*Logger, error) {
+	policy, err := LoadPolicy(cfg.PolicyFile, cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer
+	switch cfg.Path {
+	case "":
+		return nil, errors.New("audit log path is blank")
+	case "-":
+		out = os.Stdout
+	default:
+		out = &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+		}
+	}
+
+	return &Logger{
+		policy: policy,
+		out:    out,
+		enc:    json.NewEncoder(out),
+	}, nil
+}
+
+// NewEvent starts the event of a request, the returned writer records the response.
+func (l *Logger) NewEvent(w http.ResponseWriter, r *http.Request) (*Event, http.ResponseWriter) {
+	if l == nil {
+		return nil, w
+	}
+
+	auditID := r.Header.Get(RequestIDHeader)
+	if auditID == "" {
+		auditID = newAuditID()
+	}
+	w.Header().Set(AuditIDHeader, auditID)
+
+	ev := &Event{
+		AuditID:                  auditID,
+		RequestReceivedTimestamp: time.Now(),
+		Method:                   r.Method,
+		RequestURI:               r.RequestURI,
+		path:                     r.URL.Path,
+		response:                 &responseRecorder{ResponseWriter: w},
+	}
+
+	return ev, ev.response
+}
+
+// Log completes the event with the response and writes it at the level chosen by the policy.
+func (l *Logger) Log(ev *Event) {
+	if l == nil || ev == nil {
+		return
+	}
+
+	ev.Level = l.policy.LevelFor(ev.User, ev.path)
+	if ev.Level == LevelNone && len(ev.Lockouts) != 0 {
+		ev.Level = LevelMetadata
+	}
+	if ev.Level == LevelNone {
+		return
+	}
+	if ev.Level.Less(LevelRequest) {
+		ev.Queries = nil
+	}
+
+	ev.ResponseStatus = ev.response.status()
+	ev.ResponseBytes = ev.response.written
+	if ev.proxied {
+		ev.UpstreamStatus = ev.ResponseStatus
+	}
+	ev.LatencySeconds = time.Since(ev.RequestReceivedTimestamp).Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(ev); err != nil {
+		log.WithError(err).Error("failed to write audit event")
+	}
+}
+
+func newAuditID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return r.statusCode
+}
@@ -0,0 +1,126 @@
+// +build test
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const testPolicy = `
+rules:
+- level: None
+  paths: ["/-/*"]
+- level: Request
+  userGroups: [auditors]
+- level: Metadata
+  users: [alice]
+`
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logFile := filepath.Join(dir, "audit.log")
+	logger, err := NewLogger(Config{Path: logFile, MaxSize: 1, Level: LevelRequest, PolicyFile: policyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path string, info user.Info, proxied bool) {
+		req := httptest.NewRequest("GET", "http://example.org"+path, nil)
+		req.Header.Set(RequestIDHeader, path)
+		ev, w := logger.NewEvent(httptest.NewRecorder(), req)
+
+		if info != nil {
+			ev.SetUser(info, "test")
+			ev.SetNamespaces([]string{"ns-a"})
+			ev.AddQuery("up", `up{namespace=~"ns-a"}`)
+		}
+		if proxied {
+			ev.Proxied()
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			w.Write([]byte("{}"))
+		}
+
+		logger.Log(ev)
+	}
+
+	serve("/-/healthy", nil, true)
+	serve("/api/v1/query", &user.DefaultInfo{Name: "alice", Groups: []string{"team-a"}}, true)
+	serve("/api/v1/series", &user.DefaultInfo{Name: "bob", Groups: []string{"auditors"}}, false)
+	serve("/federate", nil, false)
+
+	// the lockouts are logged whatever the policy
+	ev, _ := logger.NewEvent(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.org/-/ready", nil))
+	ev.AddLockout("ip:10.0.0.1", 3, time.Unix(1600000000, 0))
+	logger.Log(ev)
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+
+	alice, bob, anonymous, lockout := events[0], events[1], events[2], events[3]
+	if alice.AuditID != "/api/v1/query" || alice.Level != LevelMetadata || alice.User.Username != "alice" ||
+		len(alice.Queries) != 0 || alice.UpstreamStatus != http.StatusBadGateway || alice.ResponseStatus != http.StatusBadGateway {
+		t.Errorf("unexpected event %+v", alice)
+	}
+	if bob.Level != LevelRequest || len(bob.Queries) != 1 || bob.Queries[0].Rewritten != `up{namespace=~"ns-a"}` ||
+		bob.UpstreamStatus != 0 || bob.ResponseStatus != http.StatusOK || bob.ResponseBytes != 2 {
+		t.Errorf("unexpected event %+v", bob)
+	}
+	if anonymous.Level != LevelRequest || anonymous.User != nil || anonymous.Authenticator != "" {
+		t.Errorf("unexpected event %+v", anonymous)
+	}
+	if lockout.Level != LevelMetadata || len(lockout.Lockouts) != 1 || lockout.Lockouts[0].Key != "ip:10.0.0.1" || lockout.Lockouts[0].Failures != 3 {
+		t.Errorf("unexpected event %+v", lockout)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	if _, err := LoadPolicy("", Level("Everything")); err == nil {
+		t.Error("expected error for invalid level")
+	}
+
+	policy, err := LoadPolicy("", LevelMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := policy.LevelFor(nil, "/api/v1/query"); level != LevelMetadata {
+		t.Errorf("expected default level, got %s", level)
+	}
+}
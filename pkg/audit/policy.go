@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Level of the audit events like the Kubernetes audit levels.
+type Level string
+
+const (
+	// LevelNone doesn't log the events.
+	LevelNone Level = "None"
+	// LevelMetadata logs the identity, the namespaces and the response of the requests.
+	LevelMetadata Level = "Metadata"
+	// LevelRequest also logs the original and the rewritten queries.
+	LevelRequest Level = "Request"
+)
+
+var levelOrder = map[Level]int{
+	LevelNone:     0,
+	LevelMetadata: 1,
+	LevelRequest:  2,
+}
+
+func (l Level) Less(other Level) bool {
+	return levelOrder[l] < levelOrder[other]
+}
+
+func (l Level) valid() bool {
+	_, exist := levelOrder[l]
+	return exist
+}
+
+// PolicyRule chooses the level of the events matching all of its conditions,
+// an empty condition matches any event.
+type PolicyRule struct {
+	Level Level `json:"level"`
+	// Users are the matched user names.
+	Users []string `json:"users,omitempty"`
+	// UserGroups matches the users belonging to any of these groups.
+	UserGroups []string `json:"userGroups,omitempty"`
+	// Paths are the matched request paths, a trailing "*" matches a prefix.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// Policy picks the level of the first matching rule, or the default level.
+type Policy struct {
+	Rules        []PolicyRule `json:"rules"`
+	DefaultLevel Level        `json:"-"`
+}
+
+func LoadPolicy(path string, defaultLevel Level) (*Policy, error) {
+	policy := &Policy{}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read audit policy %s", path)
+		}
+
+		if err := yaml.UnmarshalStrict(content, policy); err != nil {
+			return nil, errors.Annotatef(err, "unable to parse audit policy %s", path)
+		}
+	}
+	policy.DefaultLevel = defaultLevel
+
+	if !policy.DefaultLevel.valid() {
+		return nil, errors.Errorf("invalid audit level %q", policy.DefaultLevel)
+	}
+	for idx, rule := range policy.Rules {
+		if !rule.Level.valid() {
+			return nil, errors.Errorf("invalid audit level %q of the audit policy rule %d", rule.Level, idx)
+		}
+	}
+
+	return policy, nil
+}
+
+func (p *Policy) LevelFor(u *UserInfo, path string) Level {
+	for _, rule := range p.Rules {
+		if rule.matches(u, path) {
+			return rule.Level
+		}
+	}
+
+	return p.DefaultLevel
+}
+
+func (r *PolicyRule) matches(u *UserInfo, path string) bool {
+	if len(r.Users) != 0 && (u == nil || !contains(r.Users, u.Username)) {
+		return false
+	}
+
+	if len(r.UserGroups) != 0 {
+		if u == nil {
+			return false
+		}
+
+		matched := false
+		for _, group := range u.Groups {
+			if contains(r.UserGroups, group) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Paths) != 0 {
+		matched := false
+		for _, p := range r.Paths {
+			if p == path || (strings.HasSuffix(p, "*") && strings.HasPrefix(path, strings.TrimSuffix(p, "*"))) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type ChainMode string
+
+const (
+	// the first authenticator accepting the credentials decides the user
+	FirstMatch ChainMode = "first-match"
+	// all authenticators finding credentials must accept them with the same user and groups
+	AllMustAgree ChainMode = "all-must-agree"
+)
+
+var (
+	authenticationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "prometheus_auth",
+		Name:      "authentications_total",
+		Help:      "Total number of authentication attempts, by authenticator and result.",
+	}, []string{"authenticator", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(authenticationsTotal)
+}
+
+// Authenticator resolves the user of a request.
+type Authenticator interface {
+	Name() string
+	// AuthenticateRequest returns false if the request doesn't carry the credentials of this authenticator,
+	// and an error if the credentials are invalid.
+	AuthenticateRequest(r *http.Request) (user.Info, bool, error)
+}
+
+type Result struct {
+	User user.Info
+	// name of the authenticator(s) accepting the credentials
+	Authenticator string
+}
+
+// Chain asks the authenticators in order.
+type Chain struct {
+	mode           ChainMode
+	authenticators []Authenticator
+}
+
+func NewChain(mode ChainMode, authenticators ...Authenticator) (*Chain, error) {
+	switch mode {
+	case FirstMatch, AllMustAgree:
+	default:
+		return nil, errors.Errorf("unknown authenticator chain mode %q", mode)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, errors.New("no authenticator in the chain")
+	}
+
+	return &Chain{
+		mode:           mode,
+		authenticators: authenticators,
+	}, nil
+}
+
+func (c *Chain) Names() []string {
+	ret := make([]string, 0, len(c.authenticators))
+	for _, a := range c.authenticators {
+		ret = append(ret, a.Name())
+	}
+
+	return ret
+}
+
+// AuthenticateRequest returns false if no authenticator finds credentials in the request,
+// and an error if the credentials are rejected.
+func (c *Chain) AuthenticateRequest(r *http.Request) (*Result, bool, error) {
+	var (
+		result  *Result
+		matched []string
+		lastErr error
+	)
+
+	for _, a := range c.authenticators {
+		info, ok, err := a.AuthenticateRequest(r)
+		if !ok {
+			continue
+		}
+
+		if err != nil {
+			authenticationsTotal.WithLabelValues(a.Name(), "failure").Inc()
+			lastErr = errors.Annotatef(err, "rejected by %s", a.Name())
+
+			if c.mode == AllMustAgree {
+				return nil, true, lastErr
+			}
+			continue
+		}
+
+		authenticationsTotal.WithLabelValues(a.Name(), "success").Inc()
+		if c.mode == FirstMatch {
+			return &Result{User: info, Authenticator: a.Name()}, true, nil
+		}
+
+		if result != nil && result.User.GetName() != info.GetName() {
+			return nil, true, errors.Errorf("%s authenticates %q but %s authenticates %q",
+				strings.Join(matched, ","), result.User.GetName(), a.Name(), info.GetName())
+		}
+		if result != nil && !sameGroups(result.User.GetGroups(), info.GetGroups()) {
+			return nil, true, errors.Errorf("%s authenticates %q in groups %v but %s in groups %v",
+				strings.Join(matched, ","), info.GetName(), result.User.GetGroups(), a.Name(), info.GetGroups())
+		}
+		if result == nil {
+			result = &Result{User: info}
+		}
+		matched = append(matched, a.Name())
+	}
+
+	if result != nil {
+		result.Authenticator = strings.Join(matched, ",")
+		return result, true, nil
+	}
+
+	return nil, lastErr != nil, lastErr
+}
+
+// sameGroups compares the groups regardless of their order.
+func sameGroups(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA, sortedB := append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DefaultInfo converts the authenticated user for the RBAC lookups.
+func DefaultInfo(info user.Info) *user.DefaultInfo {
+	if defaultInfo, ok := info.(*user.DefaultInfo); ok {
+		return defaultInfo
+	}
+
+	return &user.DefaultInfo{
+		Name:   info.GetName(),
+		UID:    info.GetUID(),
+		Groups: info.GetGroups(),
+		Extra:  info.GetExtra(),
+	}
+}
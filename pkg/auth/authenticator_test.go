@@ -0,0 +1,168 @@
+// +build test
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/juju/errors"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type fakeAuthenticator struct {
+	name   string
+	user   string
+	groups []string
+	ok     bool
+	err    error
+}
+
+func (f *fakeAuthenticator) Name() string {
+	return f.name
+}
+
+func (f *fakeAuthenticator) AuthenticateRequest(r *http.Request) (user.Info, bool, error) {
+	if !f.ok || f.err != nil {
+		return nil, f.ok, f.err
+	}
+
+	return &user.DefaultInfo{Name: f.user, Groups: f.groups}, true, nil
+}
+
+func TestChain(t *testing.T) {
+	absent := &fakeAuthenticator{name: "absent"}
+	rejecting := &fakeAuthenticator{name: "rejecting", ok: true, err: errors.New("invalid")}
+	alice := &fakeAuthenticator{name: "alice", user: "alice", groups: []string{"team-a", "team-b"}, ok: true}
+	otherAlice := &fakeAuthenticator{name: "other-alice", user: "alice", groups: []string{"team-b", "team-a"}, ok: true}
+	adminAlice := &fakeAuthenticator{name: "admin-alice", user: "alice", groups: []string{"team-a", "admins"}, ok: true}
+	bob := &fakeAuthenticator{name: "bob", user: "bob", ok: true}
+
+	cases := []struct {
+		name           string
+		mode           ChainMode
+		authenticators []Authenticator
+		expectOK       bool
+		expectErr      bool
+		expectUser     string
+		expectMatched  string
+	}{
+		{
+			name:           "first match without credentials",
+			mode:           FirstMatch,
+			authenticators: []Authenticator{absent},
+		},
+		{
+			name:           "first match wins",
+			mode:           FirstMatch,
+			authenticators: []Authenticator{absent, alice, bob},
+			expectOK:       true,
+			expectUser:     "alice",
+			expectMatched:  "alice",
+		},
+		{
+			name:           "first match falls through rejection",
+			mode:           FirstMatch,
+			authenticators: []Authenticator{rejecting, bob},
+			expectOK:       true,
+			expectUser:     "bob",
+			expectMatched:  "bob",
+		},
+		{
+			name:           "first match rejected",
+			mode:           FirstMatch,
+			authenticators: []Authenticator{absent, rejecting},
+			expectOK:       true,
+			expectErr:      true,
+		},
+		{
+			name:           "all agree",
+			mode:           AllMustAgree,
+			authenticators: []Authenticator{alice, absent, otherAlice},
+			expectOK:       true,
+			expectUser:     "alice",
+			expectMatched:  "alice,other-alice",
+		},
+		{
+			name:           "all must agree on the user",
+			mode:           AllMustAgree,
+			authenticators: []Authenticator{alice, bob},
+			expectOK:       true,
+			expectErr:      true,
+		},
+		{
+			name:           "all must agree on the groups",
+			mode:           AllMustAgree,
+			authenticators: []Authenticator{alice, adminAlice},
+			expectOK:       true,
+			expectErr:      true,
+		},
+		{
+			name:           "all must accept",
+			mode:           AllMustAgree,
+			authenticators: []Authenticator{alice, rejecting},
+			expectOK:       true,
+			expectErr:      true,
+		},
+	}
+
+	for _, c := range cases {
+		chain, err := NewChain(c.mode, c.authenticators...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, ok, err := chain.AuthenticateRequest(httptest.NewRequest("GET", "http://example.org/api/v1/query", nil))
+		if ok != c.expectOK || (err != nil) != c.expectErr {
+			t.Errorf("%s: got ok %v and error %v", c.name, ok, err)
+			continue
+		}
+		if c.expectUser == "" {
+			continue
+		}
+		if result.User.GetName() != c.expectUser || result.Authenticator != c.expectMatched {
+			t.Errorf("%s: got user %q by %q, want %q by %q", c.name, result.User.GetName(), result.Authenticator, c.expectUser, c.expectMatched)
+		}
+	}
+
+	if _, err := NewChain("any-match", alice); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestRancherHeaders(t *testing.T) {
+	reject, err := NewHeaderTrust(HeaderTrustConfig{CIDRs: []string{"10.42.0.0/16"}, UntrustedAction: UntrustedHeadersReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strip, err := NewHeaderTrust(HeaderTrustConfig{CIDRs: []string{"10.42.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.org/api/v1/query", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(RancherUserHeaderKey, "u-admin")
+		req.Header.Add(RancherGroupHeaderKey, "g-a")
+		return req
+	}
+
+	info, ok, err := NewRancherHeaders(reject).AuthenticateRequest(newRequest("10.42.0.1:1234"))
+	if !ok || err != nil || info.GetName() != "u-admin" || len(info.GetGroups()) != 1 {
+		t.Errorf("trusted headers: got %+v, %v, %v", info, ok, err)
+	}
+
+	if _, ok, err := NewRancherHeaders(reject).AuthenticateRequest(newRequest("10.43.0.1:1234")); !ok || err == nil {
+		t.Errorf("untrusted headers should be rejected, got %v, %v", ok, err)
+	}
+
+	req := newRequest("10.43.0.1:1234")
+	if _, ok, err := NewRancherHeaders(strip).AuthenticateRequest(req); ok || err != nil {
+		t.Errorf("untrusted headers should be stripped, got %v, %v", ok, err)
+	}
+	if req.Header.Get(RancherUserHeaderKey) != "" || len(req.Header[RancherGroupHeaderKey]) != 0 {
+		t.Error("untrusted headers are not stripped")
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	k8scorev1 "k8s.io/api/core/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	RancherHeadersAuthenticator      = "rancher-headers"
+	ServiceAccountTokenAuthenticator = "service-account-token"
+	StandaloneTokenAuthenticator     = "standalone-token"
+	StandaloneBasicAuthenticator     = "standalone-basic"
+	OIDCAuthenticator                = "oidc"
+	ClientCertificateAuthenticator   = "client-certificate"
+)
+
+/* PANDARIA: Fix get request head X-RANCHER-GROUP is nil.
+we need to be aware that keys are canonicalized header["X-Rancher-Group"] will be work, but header["X-RANCHER-GROUP"] will not return any value.
+Details view https://github.com/golang/go/issues/34799
+*/
+const (
+	RancherUserHeaderKey   = "X-Rancher-User"
+	RancherGroupHeaderKey  = "X-Rancher-Group"
+	AuthorizationHeaderKey = "Authorization"
+)
+
+var errUntrustedHeaders = errors.New("untrusted identity headers")
+
+// BearerToken extracts the token of the Authorization header,
+// it's blank for the basic authentication.
+func BearerToken(r *http.Request) string {
+	if _, _, ok := r.BasicAuth(); ok {
+		return ""
+	}
+
+	return strings.TrimPrefix(r.Header.Get(AuthorizationHeaderKey), "Bearer ")
+}
+
+type rancherHeaders struct {
+	trust *HeaderTrust
+}
+
+// NewRancherHeaders authenticates the X-Rancher-User and X-Rancher-Group headers,
+// the untrusted headers are stripped or rejected as the trust policy says.
+func NewRancherHeaders(trust *HeaderTrust) Authenticator {
+	return &rancherHeaders{
+		trust: trust,
+	}
+}
+
+func (a *rancherHeaders) Name() string {
+	return RancherHeadersAuthenticator
+}
+
+func (a *rancherHeaders) AuthenticateRequest(r *http.Request) (user.Info, bool, error) {
+	rancherUser := r.Header.Get(RancherUserHeaderKey)
+	rancherGroup := r.Header[RancherGroupHeaderKey]
+	if rancherUser == "" && len(rancherGroup) == 0 {
+		return nil, false, nil
+	}
+
+	if a.trust != nil && !a.trust.Trusted(r, rancherUser, rancherGroup) {
+		log.Warnf("%s - %s - untrusted identity headers from %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+		if a.trust.RejectUntrusted() {
+			return nil, true, errUntrustedHeaders
+		}
+
+		r.Header.Del(RancherUserHeaderKey)
+		r.Header.Del(RancherGroupHeaderKey)
+		return nil, false, nil
+	}
+
+	return &user.DefaultInfo{
+		Name:   rancherUser,
+		UID:    rancherUser,
+		Groups: rancherGroup,
+	}, true, nil
+}
+
+type TokenFunc func(token string) (user.Info, error)
+
+type bearerToken struct {
+	name   string
+	lookup TokenFunc
+}
+
+// NewBearerToken authenticates the bearer token of the Authorization header.
+func NewBearerToken(name string, lookup TokenFunc) Authenticator {
+	return &bearerToken{
+		name:   name,
+		lookup: lookup,
+	}
+}
+
+func (a *bearerToken) Name() string {
+	return a.name
+}
+
+func (a *bearerToken) AuthenticateRequest(r *http.Request) (user.Info, bool, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, false, nil
+	}
+
+	info, err := a.lookup(token)
+	return info, true, err
+}
+
+type ServiceAccountLookup interface {
+	GetSA(token string) (*k8scorev1.ServiceAccount, error)
+}
+
+// NewServiceAccountToken authenticates the service account tokens.
+func NewServiceAccountToken(secrets ServiceAccountLookup) Authenticator {
+	return NewBearerToken(ServiceAccountTokenAuthenticator, func(token string) (user.Info, error) {
+		sa, err := secrets.GetSA(token)
+		if err != nil {
+			return nil, err
+		}
+
+		return &user.DefaultInfo{
+			Name: fmt.Sprintf("system:serviceaccount:%s:%s", sa.Namespace, sa.Name),
+		}, nil
+	})
+}
+
+// NewOIDC authenticates the OIDC/JWT bearer tokens.
+func NewOIDC(jwtAuthenticator *JWTAuthenticator) Authenticator {
+	return NewBearerToken(OIDCAuthenticator, func(token string) (user.Info, error) {
+		return jwtAuthenticator.AuthenticateToken(token)
+	})
+}
+
+type BasicFunc func(name, password string) (user.Info, error)
+
+type basicAuth struct {
+	name   string
+	lookup BasicFunc
+}
+
+// NewBasicAuth authenticates the basic authentication of the Authorization header.
+func NewBasicAuth(name string, lookup BasicFunc) Authenticator {
+	return &basicAuth{
+		name:   name,
+		lookup: lookup,
+	}
+}
+
+func (a *basicAuth) Name() string {
+	return a.name
+}
+
+func (a *basicAuth) AuthenticateRequest(r *http.Request) (user.Info, bool, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false, nil
+	}
+
+	info, err := a.lookup(name, password)
+	return info, true, err
+}
+
+type clientCertificate struct{}
+
+// NewClientCertificate authenticates the verified client certificates.
+func NewClientCertificate() Authenticator {
+	return &clientCertificate{}
+}
+
+func (a *clientCertificate) Name() string {
+	return ClientCertificateAuthenticator
+}
+
+func (a *clientCertificate) AuthenticateRequest(r *http.Request) (user.Info, bool, error) {
+	info, ok := UserFromClientCertificate(r)
+	if !ok {
+		return nil, false, nil
+	}
+
+	return info, true, nil
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RancherAuthTimestampHeaderKey = "X-Rancher-Auth-Timestamp"
+	RancherAuthSignatureHeaderKey = "X-Rancher-Auth-Signature"
+
+	UntrustedHeadersStrip  = "strip"
+	UntrustedHeadersReject = "reject"
+
+	defaultSignatureMaxSkew = 5 * time.Minute
+)
+
+type HeaderTrustConfig struct {
+	// source CIDRs allowed to send the identity headers
+	CIDRs []string
+	// CNs of the verified client certificates allowed to send the identity headers
+	ClientCNs []string
+	// sign the identity headers with the HMAC-SHA256 of this key
+	HMACKey func() ([]byte, error)
+	// action for the untrusted identity headers, "strip" or "reject"
+	UntrustedAction string
+}
+
+// HeaderTrust decides whether the Rancher identity headers of a request can be honored,
+// they are trusted when any of the configured conditions holds.
+type HeaderTrust struct {
+	cidrs           []*net.IPNet
+	clientCNs       data.Set
+	hmacKey         func() ([]byte, error)
+	untrustedAction string
+	now             func() time.Time
+}
+
+func NewHeaderTrust(cfg HeaderTrustConfig) (*HeaderTrust, error) {
+	t := &HeaderTrust{
+		clientCNs:       data.NewSet(cfg.ClientCNs...),
+		hmacKey:         cfg.HMACKey,
+		untrustedAction: cfg.UntrustedAction,
+		now:             time.Now,
+	}
+
+	for _, cidr := range cfg.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid trusted CIDR %q", cidr)
+		}
+		t.cidrs = append(t.cidrs, ipNet)
+	}
+
+	switch t.untrustedAction {
+	case "":
+		t.untrustedAction = UntrustedHeadersStrip
+	case UntrustedHeadersStrip, UntrustedHeadersReject:
+	default:
+		return nil, errors.Errorf("unknown untrusted headers action %q", cfg.UntrustedAction)
+	}
+
+	return t, nil
+}
+
+func (t *HeaderTrust) Enabled() bool {
+	return len(t.cidrs) != 0 || len(t.clientCNs) != 0 || t.hmacKey != nil
+}
+
+func (t *HeaderTrust) RejectUntrusted() bool {
+	return t.untrustedAction == UntrustedHeadersReject
+}
+
+func (t *HeaderTrust) Trusted(r *http.Request, userName string, groups []string) bool {
+	if !t.Enabled() {
+		return true
+	}
+
+	return t.TrustedSource(r) || t.trustedClient(r) || t.validSignature(r, userName, groups)
+}
+
+func (t *HeaderTrust) TrustedSource(r *http.Request) bool {
+	if len(t.cidrs) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return t.trustedIP(net.ParseIP(host))
+}
+
+func (t *HeaderTrust) trustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range t.cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *HeaderTrust) trustedClient(r *http.Request) bool {
+	if len(t.clientCNs) == 0 {
+		return false
+	}
+
+	info, ok := UserFromClientCertificate(r)
+	if !ok {
+		return false
+	}
+
+	_, exist := t.clientCNs[info.Name]
+	return exist
+}
+
+func (t *HeaderTrust) validSignature(r *http.Request, userName string, groups []string) bool {
+	if t.hmacKey == nil {
+		return false
+	}
+
+	timestamp := r.Header.Get(RancherAuthTimestampHeaderKey)
+	signature, err := hex.DecodeString(r.Header.Get(RancherAuthSignatureHeaderKey))
+	if timestamp == "" || err != nil || len(signature) == 0 {
+		return false
+	}
+
+	unixSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := t.now().Sub(time.Unix(unixSeconds, 0))
+	if skew > defaultSignatureMaxSkew || skew < -defaultSignatureMaxSkew {
+		return false
+	}
+
+	key, err := t.hmacKey()
+	if err != nil {
+		log.WithError(err).Warn("failed to load the HMAC key of the identity headers")
+		return false
+	}
+
+	return hmac.Equal(signature, SignIdentityHeaders(key, userName, groups, timestamp))
+}
+
+// SignIdentityHeaders returns the HMAC-SHA256 of the identity headers,
+// the signer sends it hex encoded in the X-Rancher-Auth-Signature header.
+// The user, the number of groups, each group and the timestamp are signed in this order,
+// every string prefixed by its length as a big endian uint64, so no two identities sign the same.
+func SignIdentityHeaders(key []byte, userName string, groups []string, timestamp string) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	var length [8]byte
+	writeField := func(field string) {
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		mac.Write(length[:])
+		mac.Write([]byte(field))
+	}
+
+	writeField(userName)
+	binary.BigEndian.PutUint64(length[:], uint64(len(groups)))
+	mac.Write(length[:])
+	for _, group := range groups {
+		writeField(group)
+	}
+	writeField(timestamp)
+
+	return mac.Sum(nil)
+}
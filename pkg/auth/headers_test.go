@@ -0,0 +1,134 @@
+// +build test
+
+package auth
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeaderTrust(t *testing.T) {
+	key := []byte("shared-key")
+	now := time.Unix(1600000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	newTrust := func(cfg HeaderTrustConfig) *HeaderTrust {
+		trust, err := NewHeaderTrust(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trust.now = func() time.Time { return now }
+		return trust
+	}
+
+	cases := []struct {
+		name       string
+		cfg        HeaderTrustConfig
+		remoteAddr string
+		signature  []byte
+		timestamp  string
+		expect     bool
+	}{
+		{
+			name:       "without policy",
+			remoteAddr: "10.0.0.1:12345",
+			expect:     true,
+		},
+		{
+			name:       "trusted CIDR",
+			cfg:        HeaderTrustConfig{CIDRs: []string{"10.42.0.0/16"}},
+			remoteAddr: "10.42.3.4:12345",
+			expect:     true,
+		},
+		{
+			name:       "untrusted CIDR",
+			cfg:        HeaderTrustConfig{CIDRs: []string{"10.42.0.0/16"}},
+			remoteAddr: "10.43.3.4:12345",
+			expect:     false,
+		},
+		{
+			name:       "without client certificate",
+			cfg:        HeaderTrustConfig{ClientCNs: []string{"rancher"}},
+			remoteAddr: "10.42.3.4:12345",
+			expect:     false,
+		},
+		{
+			name:       "valid signature",
+			cfg:        HeaderTrustConfig{HMACKey: func() ([]byte, error) { return key, nil }},
+			remoteAddr: "10.43.3.4:12345",
+			signature:  SignIdentityHeaders(key, "u-admin", []string{"g-a", "g-b"}, timestamp),
+			timestamp:  timestamp,
+			expect:     true,
+		},
+		{
+			name:       "signature of other groups",
+			cfg:        HeaderTrustConfig{HMACKey: func() ([]byte, error) { return key, nil }},
+			remoteAddr: "10.43.3.4:12345",
+			signature:  SignIdentityHeaders(key, "u-admin", []string{"g-a"}, timestamp),
+			timestamp:  timestamp,
+			expect:     false,
+		},
+		{
+			name:       "signature by other key",
+			cfg:        HeaderTrustConfig{HMACKey: func() ([]byte, error) { return key, nil }},
+			remoteAddr: "10.43.3.4:12345",
+			signature:  SignIdentityHeaders([]byte("guess"), "u-admin", []string{"g-a", "g-b"}, timestamp),
+			timestamp:  timestamp,
+			expect:     false,
+		},
+		{
+			name:       "stale signature",
+			cfg:        HeaderTrustConfig{HMACKey: func() ([]byte, error) { return key, nil }},
+			remoteAddr: "10.43.3.4:12345",
+			signature:  SignIdentityHeaders(key, "u-admin", []string{"g-a", "g-b"}, "1500000000"),
+			timestamp:  "1500000000",
+			expect:     false,
+		},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.org/api/v1/query", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.signature != nil {
+			req.Header.Set(RancherAuthSignatureHeaderKey, hex.EncodeToString(c.signature))
+			req.Header.Set(RancherAuthTimestampHeaderKey, c.timestamp)
+		}
+
+		if got := newTrust(c.cfg).Trusted(req, "u-admin", []string{"g-a", "g-b"}); got != c.expect {
+			t.Errorf("%s: got trusted %v, want %v", c.name, got, c.expect)
+		}
+	}
+
+	if _, err := NewHeaderTrust(HeaderTrustConfig{UntrustedAction: "ignore"}); err == nil {
+		t.Error("expected error for unknown untrusted action")
+	}
+}
+
+func TestSignIdentityHeaders(t *testing.T) {
+	key := []byte("shared-key")
+
+	identities := []struct {
+		userName string
+		groups   []string
+	}{
+		{userName: "u-admin", groups: []string{"a,b"}},
+		{userName: "u-admin", groups: []string{"a", "b"}},
+		{userName: "u-admin", groups: []string{"a", "", "b"}},
+		{userName: "u-admin\na", groups: []string{"b"}},
+		{userName: "u-admin", groups: []string{"a\nb"}},
+		{userName: "u-admin", groups: nil},
+		{userName: "u-admin", groups: []string{""}},
+	}
+
+	seen := map[string]int{}
+	for idx, identity := range identities {
+		signature := hex.EncodeToString(SignIdentityHeaders(key, identity.userName, identity.groups, "1600000000"))
+		if other, exist := seen[signature]; exist {
+			t.Errorf("%+v and %+v sign the same", identities[other], identity)
+		}
+		seen[signature] = idx
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// an unknown "kid" forces a reload, but not more often than this, even while the reloads fail
+	minKeySetReloadInterval = 10 * time.Second
+	keySetFetchTimeout      = 10 * time.Second
+)
+
+// keySet holds the JWKS used to verify token signatures,
+// it comes from a local file or a remote URL and is reloaded periodically.
+type keySet struct {
+	source string
+	client *http.Client
+	group  singleflight.Group
+
+	mu          sync.RWMutex
+	keys        *jose.JSONWebKeySet
+	attemptedAt time.Time
+}
+
+func newKeySet(ctx context.Context, source string, refreshInterval time.Duration) (*keySet, error) {
+	ks := &keySet{
+		source: source,
+		client: &http.Client{Timeout: keySetFetchTimeout},
+	}
+
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+
+	if refreshInterval > 0 {
+		go ks.run(ctx, refreshInterval)
+	}
+
+	return ks, nil
+}
+
+func (k *keySet) run(ctx context.Context, refreshInterval time.Duration) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reload(); err != nil {
+				log.WithError(err).Warnf("failed to refresh JWKS from %s", k.source)
+			}
+		}
+	}
+}
+
+func (k *keySet) isRemote() bool {
+	return strings.HasPrefix(k.source, "https://") || strings.HasPrefix(k.source, "http://")
+}
+
+func (k *keySet) fetch() ([]byte, error) {
+	if !k.isRemote() {
+		return ioutil.ReadFile(k.source)
+	}
+
+	resp, err := k.client.Get(k.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k *keySet) reload() error {
+	k.mu.Lock()
+	k.attemptedAt = time.Now()
+	k.mu.Unlock()
+
+	raw, err := k.fetch()
+	if err != nil {
+		return errors.Annotatef(err, "unable to load JWKS from %s", k.source)
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(raw, keys); err != nil {
+		return errors.Annotatef(err, "unable to parse JWKS from %s", k.source)
+	}
+
+	if len(keys.Keys) == 0 {
+		return errors.Errorf("JWKS from %s contains no keys", k.source)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+
+	return nil
+}
+
+func (k *keySet) lookup(kid string) ([]jose.JSONWebKey, time.Time) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" {
+		return k.keys.Keys, k.attemptedAt
+	}
+
+	return k.keys.Key(kid), k.attemptedAt
+}
+
+func (k *keySet) keysFor(kid string) []jose.JSONWebKey {
+	keys, attemptedAt := k.lookup(kid)
+	if len(keys) != 0 || time.Since(attemptedAt) < minKeySetReloadInterval {
+		return keys
+	}
+
+	// the issuer may have rotated its signing key, the concurrent requests share a single reload
+	_, err, _ := k.group.Do("reload", func() (interface{}, error) {
+		if _, attemptedAt := k.lookup(kid); time.Since(attemptedAt) < minKeySetReloadInterval {
+			return nil, nil
+		}
+		return nil, k.reload()
+	})
+	if err != nil {
+		log.WithError(err).Warnf("failed to reload JWKS from %s", k.source)
+		return nil
+	}
+
+	keys, _ = k.lookup(kid)
+	return keys
+}
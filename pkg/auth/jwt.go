@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type JWTConfig struct {
+	IssuerURL       string
+	Audiences       []string
+	JWKS            string
+	RefreshInterval time.Duration
+	UsernameClaim   string
+	GroupsClaim     string
+	// UsernamePrefix is prepended to the user names, the issuer URL followed by '#' unless the claim is 'email'
+	// if blank, and no prefix if '-', like the kube-apiserver.
+	UsernamePrefix string
+	// GroupsPrefix is prepended to the groups, none if blank.
+	GroupsPrefix string
+}
+
+const (
+	// noUsernamePrefix disables the default prefix of the user names.
+	noUsernamePrefix = "-"
+	// reservedPrefix is the namespace of the Kubernetes users and groups, such as system:masters,
+	// which the tokens can't claim.
+	reservedPrefix = "system:"
+)
+
+type JWTAuthenticator struct {
+	cfg  JWTConfig
+	keys *keySet
+	now  func() time.Time
+}
+
+func NewJWTAuthenticator(ctx context.Context, cfg JWTConfig) (*JWTAuthenticator, error) {
+	if cfg.JWKS == "" {
+		return nil, errors.New("JWKS source is blank")
+	}
+	if cfg.IssuerURL == "" {
+		return nil, errors.New("OIDC/JWT issuer URL is blank")
+	}
+	if len(cfg.Audiences) == 0 {
+		return nil, errors.New("OIDC/JWT audiences are not set")
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+	switch {
+	case cfg.UsernamePrefix == noUsernamePrefix:
+		cfg.UsernamePrefix = ""
+	case cfg.UsernamePrefix == "" && cfg.UsernameClaim != "email":
+		cfg.UsernamePrefix = cfg.IssuerURL + "#"
+	}
+
+	keys, err := newKeySet(ctx, cfg.JWKS, cfg.RefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTAuthenticator{
+		cfg:  cfg,
+		keys: keys,
+		now:  time.Now,
+	}, nil
+}
+
+func (a *JWTAuthenticator) AuthenticateToken(token string) (*user.DefaultInfo, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, errors.Annotate(err, "malformed token")
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+
+	var (
+		claims   jwt.Claims
+		extra    map[string]interface{}
+		verified bool
+	)
+	for _, key := range a.keys.keysFor(tok.Headers[0].KeyID) {
+		if err := tok.Claims(key, &claims, &extra); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("failed to verify token signature")
+	}
+
+	if claims.Expiry == 0 {
+		return nil, errors.New("token has no expiry")
+	}
+
+	err = claims.Validate(jwt.Expected{
+		Issuer: a.cfg.IssuerURL,
+		Time:   a.now(),
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid token claims")
+	}
+
+	if !a.audienceAccepted(claims.Audience) {
+		return nil, errors.New("token audience is not accepted")
+	}
+
+	username, ok := extra[a.cfg.UsernameClaim].(string)
+	if !ok || username == "" {
+		return nil, errors.Errorf("token has no %q claim", a.cfg.UsernameClaim)
+	}
+
+	groups, err := stringsClaim(extra, a.cfg.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	username = a.cfg.UsernamePrefix + username
+	if strings.HasPrefix(username, reservedPrefix) {
+		return nil, errors.Errorf("token user %q is reserved", username)
+	}
+	for idx := range groups {
+		groups[idx] = a.cfg.GroupsPrefix + groups[idx]
+		if strings.HasPrefix(groups[idx], reservedPrefix) {
+			return nil, errors.Errorf("token group %q is reserved", groups[idx])
+		}
+	}
+
+	return &user.DefaultInfo{
+		Name:   username,
+		UID:    claims.Subject,
+		Groups: groups,
+	}, nil
+}
+
+func (a *JWTAuthenticator) audienceAccepted(aud jwt.Audience) bool {
+	for _, expected := range a.cfg.Audiences {
+		if aud.Contains(expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringsClaim(claims map[string]interface{}, name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	switch v := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		ret := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.Errorf("token %q claim must be a list of strings", name)
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	default:
+		return nil, errors.Errorf("token %q claim must be a string or a list of strings", name)
+	}
+}
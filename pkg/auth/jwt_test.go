@@ -0,0 +1,319 @@
+// +build test
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type fakeIssuer struct {
+	key  *rsa.PrivateKey
+	kid  string
+	jwks []byte
+}
+
+func newFakeIssuer(t *testing.T, kid string) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &fakeIssuer{key: key, kid: kid, jwks: jwks}
+}
+
+func (f *fakeIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: f.key},
+		(&jose.SignerOptions{}).WithHeader("kid", f.kid),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	issuer := newFakeIssuer(t, "key-1")
+	stranger := newFakeIssuer(t, "key-1")
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, issuer.jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(issuer.jwks)
+	}))
+	defer jwksServer.Close()
+
+	now := time.Unix(1600000000, 0)
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://sso.example.com",
+			"aud":    []string{"grafana", "prometheus"},
+			"sub":    "1234",
+			"email":  "alice@example.com",
+			"groups": []string{"team-a", "team-b"},
+			"exp":    now.Add(time.Hour).Unix(),
+		}
+	}
+
+	cases := []struct {
+		name       string
+		token      func() string
+		expectErr  bool
+		expectName string
+		expectGrp  []string
+	}{
+		{
+			name:       "valid token",
+			token:      func() string { return issuer.sign(t, validClaims()) },
+			expectName: "alice@example.com",
+			expectGrp:  []string{"team-a", "team-b"},
+		},
+		{
+			name: "single group",
+			token: func() string {
+				c := validClaims()
+				c["groups"] = "team-a"
+				return issuer.sign(t, c)
+			},
+			expectName: "alice@example.com",
+			expectGrp:  []string{"team-a"},
+		},
+		{
+			name:      "signed by unknown key",
+			token:     func() string { return stranger.sign(t, validClaims()) },
+			expectErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				c := validClaims()
+				c["iss"] = "https://evil.example.com"
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				c := validClaims()
+				c["aud"] = "kibana"
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				c := validClaims()
+				c["exp"] = now.Add(-time.Hour).Unix()
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name: "without expiry",
+			token: func() string {
+				c := validClaims()
+				delete(c, "exp")
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name: "without username claim",
+			token: func() string {
+				c := validClaims()
+				delete(c, "email")
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name: "reserved group",
+			token: func() string {
+				c := validClaims()
+				c["groups"] = []string{"team-a", "system:masters"}
+				return issuer.sign(t, c)
+			},
+			expectErr: true,
+		},
+		{
+			name:      "malformed",
+			token:     func() string { return "not-a-jwt" },
+			expectErr: true,
+		},
+	}
+
+	for _, source := range []string{jwksFile, jwksServer.URL} {
+		authenticator, err := NewJWTAuthenticator(context.Background(), JWTConfig{
+			IssuerURL:     "https://sso.example.com",
+			Audiences:     []string{"prometheus"},
+			JWKS:          source,
+			UsernameClaim: "email",
+			GroupsClaim:   "groups",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticator.now = func() time.Time { return now }
+
+		for _, c := range cases {
+			info, err := authenticator.AuthenticateToken(c.token())
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("[%s] %s: expected error, got user %+v", source, c.name, info)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("[%s] %s: unexpected error %v", source, c.name, err)
+				continue
+			}
+			if info.Name != c.expectName || info.UID != "1234" || !reflect.DeepEqual(info.Groups, c.expectGrp) {
+				t.Errorf("[%s] %s: got user %+v", source, c.name, info)
+			}
+		}
+	}
+}
+
+func TestJWTAuthenticatorPrefixes(t *testing.T) {
+	issuer := newFakeIssuer(t, "key-1")
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(issuer.jwks)
+	}))
+	defer jwksServer.Close()
+
+	now := time.Unix(1600000000, 0)
+	token := issuer.sign(t, map[string]interface{}{
+		"iss":    "https://sso.example.com",
+		"aud":    "prometheus",
+		"sub":    "1234",
+		"groups": []string{"masters"},
+		"exp":    now.Add(time.Hour).Unix(),
+	})
+
+	cases := []struct {
+		cfg        JWTConfig
+		expectName string
+		expectGrp  []string
+		expectErr  bool
+	}{
+		{cfg: JWTConfig{}, expectName: "https://sso.example.com#1234", expectGrp: []string{"masters"}},
+		{cfg: JWTConfig{UsernamePrefix: "-", GroupsPrefix: "oidc:"}, expectName: "1234", expectGrp: []string{"oidc:masters"}},
+		{cfg: JWTConfig{UsernamePrefix: "sso:", GroupsPrefix: "system:"}, expectErr: true},
+	}
+	for _, c := range cases {
+		c.cfg.IssuerURL, c.cfg.Audiences, c.cfg.JWKS, c.cfg.GroupsClaim = "https://sso.example.com", []string{"prometheus"}, jwksServer.URL, "groups"
+		authenticator, err := NewJWTAuthenticator(context.Background(), c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticator.now = func() time.Time { return now }
+
+		info, err := authenticator.AuthenticateToken(token)
+		if c.expectErr {
+			if err == nil {
+				t.Errorf("%+v: expected error, got user %+v", c.cfg, info)
+			}
+			continue
+		}
+		if err != nil || info.Name != c.expectName || !reflect.DeepEqual(info.Groups, c.expectGrp) {
+			t.Errorf("%+v: got user %+v, %v", c.cfg, info, err)
+		}
+	}
+
+	for _, cfg := range []JWTConfig{
+		{Audiences: []string{"prometheus"}, JWKS: jwksServer.URL},
+		{IssuerURL: "https://sso.example.com", JWKS: jwksServer.URL},
+	} {
+		if _, err := NewJWTAuthenticator(context.Background(), cfg); err == nil {
+			t.Errorf("%+v: expected error without issuer or audience", cfg)
+		}
+	}
+}
+
+func TestKeySetReloadThrottle(t *testing.T) {
+	issuer := newFakeIssuer(t, "key-1")
+
+	var mu sync.Mutex
+	failing, fetches := false, 0
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(issuer.jwks)
+	}))
+	defer jwksServer.Close()
+
+	ks, err := newKeySet(context.Background(), jwksServer.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	failing, fetches = true, 0
+	mu.Unlock()
+	ks.mu.Lock()
+	ks.attemptedAt = time.Now().Add(-minKeySetReloadInterval)
+	ks.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ks.keysFor(fmt.Sprintf("unknown-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	ks.keysFor("unknown-again")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 1 {
+		t.Errorf("expected a single reload while the JWKS endpoint fails, got %d", fetches)
+	}
+}
@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	throttleKeyClientIP = "ip"
+	throttleKeyToken    = "token"
+
+	forwardedForHeaderKey = "X-Forwarded-For"
+	tokenFingerprintSize  = 12
+
+	defaultMaxTokenKeys = 10000
+	// defaultClientIPFailuresFactor multiplies the failures tolerated per client IP,
+	// as the clients behind a proxy share its IP.
+	defaultClientIPFailuresFactor = 10
+)
+
+var (
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "prometheus_auth",
+		Name:      "authentication_failures_total",
+		Help:      "Total number of failed authentications, by the kind of throttling key.",
+	}, []string{"key_type"})
+	authLockoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "prometheus_auth",
+		Name:      "authentication_lockouts_total",
+		Help:      "Total number of lockouts after failed authentications, by the kind of throttling key.",
+	}, []string{"key_type"})
+	authLockedRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus_auth",
+		Name:      "authentication_locked_requests_total",
+		Help:      "Total number of requests refused because of a lockout.",
+	})
+	authUntrackedFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus_auth",
+		Name:      "authentication_untracked_token_failures_total",
+		Help:      "Total number of failed authentications not tracked by token, as too many tokens are tracked already.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authFailuresTotal, authLockoutsTotal, authLockedRequestsTotal, authUntrackedFailuresTotal)
+}
+
+type ThrottleConfig struct {
+	// failures tolerated before locking out
+	MaxFailures int
+	// failures tolerated per client IP before locking out, defaultClientIPFailuresFactor times MaxFailures if zero
+	MaxClientIPFailures int
+	// first lockout, doubled by every further failure
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// failures older than this are forgotten
+	FailureWindow time.Duration
+	// token fingerprints tracked at most, the further failures only count against the client IP,
+	// defaultMaxTokenKeys if zero
+	MaxTokenKeys int
+}
+
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// Throttle counts the failed authentications per client IP and per token fingerprint,
+// it locks out a key with exponential backoff once the key fails too often.
+type Throttle struct {
+	cfg ThrottleConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*Lockout
+	tokenKeys int
+}
+
+func NewThrottle(ctx context.Context, cfg ThrottleConfig) (*Throttle, error) {
+	if cfg.MaxFailures <= 0 {
+		return nil, errors.New("the failure threshold must be positive")
+	}
+	if cfg.FailureWindow <= 0 {
+		return nil, errors.New("the failure window must be positive")
+	}
+	if cfg.BaseLockout <= 0 || cfg.MaxLockout < cfg.BaseLockout {
+		return nil, errors.New("the lockout must be positive and not exceed the maximum lockout")
+	}
+	if cfg.MaxClientIPFailures < 0 {
+		return nil, errors.New("the client IP failure threshold must not be negative")
+	}
+	if cfg.MaxClientIPFailures == 0 {
+		cfg.MaxClientIPFailures = defaultClientIPFailuresFactor * cfg.MaxFailures
+	}
+	if cfg.MaxTokenKeys < 0 {
+		return nil, errors.New("the maximum of token keys must not be negative")
+	}
+	if cfg.MaxTokenKeys == 0 {
+		cfg.MaxTokenKeys = defaultMaxTokenKeys
+	}
+
+	t := &Throttle{
+		cfg:     cfg,
+		now:     time.Now,
+		entries: map[string]*Lockout{},
+	}
+
+	go t.run(ctx)
+
+	return t, nil
+}
+
+func (t *Throttle) run(ctx context.Context) {
+	ticker := time.NewTicker(t.cfg.FailureWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.gc()
+		}
+	}
+}
+
+func (t *Throttle) gc() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(t.now())
+}
+
+func (t *Throttle) expire(now time.Time) {
+	for key, entry := range t.entries {
+		if now.After(entry.LockedUntil) && now.Sub(entry.LastFailure) > t.cfg.FailureWindow {
+			t.delete(key)
+		}
+	}
+}
+
+func (t *Throttle) delete(key string) {
+	if _, exist := t.entries[key]; !exist {
+		return
+	}
+
+	delete(t.entries, key)
+	if throttleKeyType(key) == throttleKeyToken {
+		t.tokenKeys--
+	}
+}
+
+// Locked returns the remaining lockout of the most restricted key.
+func (t *Throttle) Locked(keys ...string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var remaining time.Duration
+	for _, key := range keys {
+		if entry, exist := t.entries[key]; exist && entry.LockedUntil.After(now) {
+			if r := entry.LockedUntil.Sub(now); r > remaining {
+				remaining = r
+			}
+		}
+	}
+
+	if remaining > 0 {
+		authLockedRequestsTotal.Inc()
+		return remaining, true
+	}
+
+	return 0, false
+}
+
+// Failure counts a failed authentication of the keys, and returns the keys it locks out.
+func (t *Throttle) Failure(keys ...string) []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ret []Lockout
+	now := t.now()
+	for _, key := range keys {
+		keyType := throttleKeyType(key)
+		authFailuresTotal.WithLabelValues(keyType).Inc()
+
+		entry, exist := t.entries[key]
+		if !exist && keyType == throttleKeyToken && t.tokenKeys >= t.cfg.MaxTokenKeys {
+			t.expire(now)
+			if t.tokenKeys >= t.cfg.MaxTokenKeys {
+				// too many tokens fail, as when they are sprayed, only their client IPs are throttled
+				authUntrackedFailuresTotal.Inc()
+				continue
+			}
+		}
+		if !exist {
+			entry = &Lockout{Key: key}
+			t.entries[key] = entry
+			if keyType == throttleKeyToken {
+				t.tokenKeys++
+			}
+		} else if now.Sub(entry.LastFailure) > t.cfg.FailureWindow {
+			*entry = Lockout{Key: key}
+		}
+		entry.Failures++
+		entry.LastFailure = now
+
+		maxFailures := t.cfg.MaxFailures
+		if keyType == throttleKeyClientIP {
+			maxFailures = t.cfg.MaxClientIPFailures
+		}
+		excess := entry.Failures - maxFailures
+		if excess <= 0 {
+			continue
+		}
+
+		lockout := t.cfg.BaseLockout
+		for i := 1; i < excess && lockout < t.cfg.MaxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > t.cfg.MaxLockout {
+			lockout = t.cfg.MaxLockout
+		}
+		entry.LockedUntil = now.Add(lockout)
+
+		authLockoutsTotal.WithLabelValues(keyType).Inc()
+		log.WithFields(log.Fields{
+			"audit":       "lockout",
+			"key":         key,
+			"failures":    entry.Failures,
+			"lockedUntil": entry.LockedUntil,
+		}).Warnf("locked out %s for %v after %d failed authentications", key, lockout, entry.Failures)
+		ret = append(ret, *entry)
+	}
+
+	return ret
+}
+
+func (t *Throttle) Lockouts() []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	ret := make([]Lockout, 0, len(t.entries))
+	for _, entry := range t.entries {
+		if entry.LockedUntil.After(now) {
+			ret = append(ret, *entry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+
+	return ret
+}
+
+// Clear removes the given key, or all keys if blank, and returns how many were removed.
+func (t *Throttle) Clear(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if key == "" {
+		cleared := len(t.entries)
+		t.entries = map[string]*Lockout{}
+		t.tokenKeys = 0
+		return cleared
+	}
+
+	if _, exist := t.entries[key]; exist {
+		t.delete(key)
+		return 1
+	}
+
+	return 0
+}
+
+func ClientIPThrottleKey(ip string) string {
+	return throttleKeyClientIP + ":" + ip
+}
+
+// TokenThrottleKey identifies a token by a short fingerprint of its hash,
+// the raw tokens never stay in memory.
+func TokenThrottleKey(tokenHash string) string {
+	if len(tokenHash) > tokenFingerprintSize {
+		tokenHash = tokenHash[:tokenFingerprintSize]
+	}
+
+	return throttleKeyToken + ":" + tokenHash
+}
+
+func throttleKeyType(key string) string {
+	if idx := strings.Index(key, ":"); idx > 0 {
+		return key[:idx]
+	}
+
+	return "unknown"
+}
+
+// ClientIP returns the IP of the client, it follows the X-Forwarded-For header
+// through the proxies trusted by the given policy.
+func ClientIP(r *http.Request, trust *HeaderTrust) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if trust == nil || !trust.TrustedSource(r) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header[forwardedForHeaderKey], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		ip = hop
+		if !trust.trustedIP(net.ParseIP(hop)) {
+			break
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,209 @@
+// +build test
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Unix(1600000000, 0)
+	throttle, err := NewThrottle(ctx, ThrottleConfig{
+		MaxFailures:         2,
+		MaxClientIPFailures: 2,
+		BaseLockout:         time.Minute,
+		MaxLockout:          3 * time.Minute,
+		FailureWindow:       time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle.now = func() time.Time { return now }
+
+	ipKey, tokenKey := ClientIPThrottleKey("10.0.0.1"), TokenThrottleKey("0123456789abcdef0123")
+	if tokenKey != "token:0123456789ab" {
+		t.Errorf("unexpected token key %q", tokenKey)
+	}
+
+	expectLocked := func(step string, want time.Duration) {
+		remaining, locked := throttle.Locked(ipKey, tokenKey)
+		if locked != (want > 0) || remaining != want {
+			t.Errorf("%s: got lockout %v (%v), want %v", step, remaining, locked, want)
+		}
+	}
+
+	throttle.Failure(ipKey, tokenKey)
+	throttle.Failure(ipKey, tokenKey)
+	expectLocked("within threshold", 0)
+
+	if lockouts := throttle.Failure(ipKey, tokenKey); len(lockouts) != 2 || lockouts[0].Key != ipKey || lockouts[1].Key != tokenKey {
+		t.Errorf("expected both keys locked out, got %+v", lockouts)
+	}
+	expectLocked("first lockout", time.Minute)
+
+	throttle.Failure(ipKey)
+	expectLocked("second lockout", 2*time.Minute)
+
+	throttle.Failure(ipKey)
+	throttle.Failure(ipKey)
+	expectLocked("maximum lockout", 3*time.Minute)
+
+	if lockouts := throttle.Lockouts(); len(lockouts) != 2 || lockouts[0].Key != ipKey || lockouts[0].Failures != 6 {
+		t.Errorf("unexpected lockouts %+v", lockouts)
+	}
+
+	if cleared := throttle.Clear(ipKey); cleared != 1 {
+		t.Errorf("expected to clear 1 lockout, cleared %d", cleared)
+	}
+	expectLocked("token still locked", time.Minute)
+
+	now = now.Add(2 * time.Minute)
+	expectLocked("lockout expired", 0)
+
+	throttle.Clear("")
+	if lockouts := throttle.Lockouts(); len(lockouts) != 0 {
+		t.Errorf("expected no lockouts, got %+v", lockouts)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trust, err := NewHeaderTrust(HeaderTrustConfig{CIDRs: []string{"10.42.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		trust        *HeaderTrust
+		expect       string
+	}{
+		{
+			name:         "without trusted proxy",
+			remoteAddr:   "10.42.0.5:1234",
+			forwardedFor: "1.2.3.4",
+			expect:       "10.42.0.5",
+		},
+		{
+			name:         "untrusted proxy",
+			remoteAddr:   "10.43.0.5:1234",
+			forwardedFor: "1.2.3.4",
+			trust:        trust,
+			expect:       "10.43.0.5",
+		},
+		{
+			name:         "trusted proxy",
+			remoteAddr:   "10.42.0.5:1234",
+			forwardedFor: "1.2.3.4",
+			trust:        trust,
+			expect:       "1.2.3.4",
+		},
+		{
+			name:         "spoofed hop before trusted proxies",
+			remoteAddr:   "10.42.0.5:1234",
+			forwardedFor: "6.6.6.6, 1.2.3.4, 10.42.0.9",
+			trust:        trust,
+			expect:       "1.2.3.4",
+		},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.org/api/v1/query", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header.Set(forwardedForHeaderKey, c.forwardedFor)
+
+		if got := ClientIP(req, c.trust); got != c.expect {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.expect)
+		}
+	}
+}
+
+func TestThrottleConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	valid := ThrottleConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, FailureWindow: time.Hour}
+	invalid := []func(cfg *ThrottleConfig){
+		func(cfg *ThrottleConfig) { cfg.MaxFailures = 0 },
+		func(cfg *ThrottleConfig) { cfg.FailureWindow = 0 },
+		func(cfg *ThrottleConfig) { cfg.FailureWindow = -time.Minute },
+		func(cfg *ThrottleConfig) { cfg.BaseLockout = 0 },
+		func(cfg *ThrottleConfig) { cfg.MaxLockout = time.Second },
+		func(cfg *ThrottleConfig) { cfg.MaxTokenKeys = -1 },
+		func(cfg *ThrottleConfig) { cfg.MaxClientIPFailures = -1 },
+	}
+	for idx, modify := range invalid {
+		cfg := valid
+		modify(&cfg)
+		if _, err := NewThrottle(ctx, cfg); err == nil {
+			t.Errorf("%d: expected an error for %+v", idx, cfg)
+		}
+	}
+}
+
+func TestThrottleClientIPFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	throttle, err := NewThrottle(ctx, ThrottleConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, FailureWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the clients sharing the IP of a proxy fail with their own tokens
+	ipKey := ClientIPThrottleKey("10.0.0.1")
+	for i := 0; i < 20; i++ {
+		if lockouts := throttle.Failure(ipKey, TokenThrottleKey(fmt.Sprintf("%012x", i))); len(lockouts) != 0 {
+			t.Fatalf("%d: expected no lockout, got %+v", i, lockouts)
+		}
+	}
+	if lockouts := throttle.Failure(ipKey); len(lockouts) != 1 || lockouts[0].Key != ipKey {
+		t.Errorf("expected the client IP locked out past 10 times the failure threshold, got %+v", lockouts)
+	}
+}
+
+func TestThrottleMaxTokenKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Unix(1600000000, 0)
+	throttle, err := NewThrottle(ctx, ThrottleConfig{
+		MaxFailures:   2,
+		BaseLockout:   time.Minute,
+		MaxLockout:    time.Hour,
+		FailureWindow: time.Hour,
+		MaxTokenKeys:  3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle.now = func() time.Time { return now }
+
+	// a client sprays random tokens
+	ipKey := ClientIPThrottleKey("10.0.0.1")
+	for i := 0; i < 100; i++ {
+		throttle.Failure(ipKey, TokenThrottleKey(fmt.Sprintf("%012x", i)))
+	}
+	if got := len(throttle.entries); got != 4 {
+		t.Errorf("expected the client IP and 3 tokens tracked, got %d keys", got)
+	}
+	if _, locked := throttle.Locked(ipKey); !locked {
+		t.Error("expected the client IP locked out")
+	}
+
+	// the forgotten tokens make room for new ones
+	now = now.Add(2 * time.Hour)
+	newKey := TokenThrottleKey("new-token-fingerprint")
+	throttle.Failure(newKey)
+	if _, exist := throttle.entries[newKey]; !exist || throttle.tokenKeys != 1 {
+		t.Errorf("expected the new token tracked once the others expire, got %d token keys", throttle.tokenKeys)
+	}
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// UserFromClientCertificate maps the verified client certificate of the request
+// to an user the same way as Kubernetes, the CN is the user name and the Os are the groups.
+func UserFromClientCertificate(r *http.Request) (*user.DefaultInfo, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, false
+	}
+
+	return &user.DefaultInfo{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.Organization,
+	}, true
+}
@@ -0,0 +1,320 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Actions on the queries over their series budget.
+const (
+	// OverBudgetReject rejects the queries.
+	OverBudgetReject = "reject"
+	// OverBudgetDowngrade sends the queries to the low-priority level of the scheduler.
+	OverBudgetDowngrade = "downgrade"
+)
+
+// Decision of the admission.
+type Decision string
+
+const (
+	DecisionAdmit     Decision = "admit"
+	DecisionDowngrade Decision = "downgrade"
+	DecisionReject    Decision = "reject"
+)
+
+const (
+	namespaceLabel = "namespace"
+
+	// maxEntries caps the cached series counts, the selectors without metric name are counted per set of namespaces.
+	maxEntries = 10000
+)
+
+var (
+	admissions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "cardinality_admissions_total",
+			Help:      "Number of the queries with a series budget by admission decision (admit, downgrade or reject).",
+		},
+		[]string{"decision"},
+	)
+	estimations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "cardinality_estimations_total",
+			Help:      "Number of the series count lookups by result (hit, miss or error).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(admissions, estimations)
+}
+
+type entry struct {
+	counts  map[string]int
+	expires time.Time
+}
+
+// Partition is a set of the accessible namespaces whose series are counted through the API of an upstream.
+type Partition struct {
+	Upstream   string
+	API        promapiv1.API
+	Namespaces data.Set
+}
+
+// Wait schedules a series count upstream on behalf of the tenant, the returned function is called once it completes.
+type Wait func(ctx context.Context) (release func(), err error)
+
+// Admission estimates the series touched by the selectors of a query
+// from the upstream series counts per metric name and namespace.
+type Admission struct {
+	ttl        time.Duration
+	overBudget string
+
+	mu      sync.RWMutex
+	entries map[string]entry
+	group   singleflight.Group
+}
+
+func NewAdmission(ctx context.Context, ttl time.Duration, overBudget string) (*Admission, error) {
+	if overBudget != OverBudgetReject && overBudget != OverBudgetDowngrade {
+		return nil, errors.Errorf("unknown over budget action %q, expected %q or %q", overBudget, OverBudgetReject, OverBudgetDowngrade)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("series counts cache TTL must be positive")
+	}
+
+	a := &Admission{
+		ttl:        ttl,
+		overBudget: overBudget,
+		entries:    make(map[string]entry),
+	}
+
+	go a.gc(ctx)
+
+	return a, nil
+}
+
+// OverBudget returns the action on the queries over their series budget.
+func (a *Admission) OverBudget() string {
+	return a.overBudget
+}
+
+// Admit decides whether the selectors accessing the partitions fit in the series budget,
+// a budget of zero is unlimited. The series counts missing from the cache wait for the tenant to be scheduled if wait is set.
+// The estimation fails open when an upstream is unavailable.
+func (a *Admission) Admit(ctx context.Context, selectors [][]*labels.Matcher, partitions []Partition, budget int, wait Wait) (Decision, int) {
+	if a == nil || budget <= 0 {
+		return DecisionAdmit, 0
+	}
+
+	series, err := a.Estimate(ctx, selectors, partitions, wait)
+	if err != nil {
+		log.WithError(err).Warn("unable to estimate the series of the query, admitting it")
+		admissions.WithLabelValues(string(DecisionAdmit)).Inc()
+		return DecisionAdmit, 0
+	}
+
+	decision := DecisionAdmit
+	if series > budget {
+		decision = DecisionReject
+		if a.overBudget == OverBudgetDowngrade {
+			decision = DecisionDowngrade
+		}
+	}
+	admissions.WithLabelValues(string(decision)).Inc()
+
+	return decision, series
+}
+
+// Estimate sums the series of the metric names of the selectors in the namespaces of each partition,
+// the other label matchers only narrow the selection, so it is an upper bound.
+// The selectors without metric name matcher are counted by all their label matchers within the namespaces of each partition.
+func (a *Admission) Estimate(ctx context.Context, selectors [][]*labels.Matcher, partitions []Partition, wait Wait) (int, error) {
+	seen := make(map[string]struct{}, len(selectors)*len(partitions))
+
+	series := 0
+	for _, matchers := range selectors {
+		for _, partition := range partitions {
+			if len(partition.Namespaces) == 0 {
+				continue
+			}
+
+			selector, err := countedSelector(matchers, partition.Namespaces)
+			if err != nil {
+				return 0, err
+			}
+			key := partition.Upstream + "/" + selector
+			if _, exist := seen[key]; exist {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			counts, err := a.counts(ctx, partition, key, selector, wait)
+			if err != nil {
+				return 0, err
+			}
+
+			for ns := range partition.Namespaces {
+				series += counts[ns]
+			}
+		}
+	}
+
+	return series, nil
+}
+
+func (a *Admission) counts(ctx context.Context, partition Partition, key, selector string, wait Wait) (map[string]int, error) {
+	now := time.Now()
+
+	a.mu.RLock()
+	e, exist := a.entries[key]
+	a.mu.RUnlock()
+	if exist && now.Before(e.expires) {
+		estimations.WithLabelValues("hit").Inc()
+		return e.counts, nil
+	}
+
+	ret, err, _ := a.group.Do(key, func() (interface{}, error) {
+		if wait != nil {
+			release, err := wait(ctx)
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to schedule the series count of %s in upstream %q", selector, partition.Upstream)
+			}
+			defer release()
+		}
+
+		expr := fmt.Sprintf("count by (%s) ({%s})", namespaceLabel, selector)
+		val, _, err := partition.API.Query(ctx, expr, time.Time{})
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to count the series of %s in upstream %q", selector, partition.Upstream)
+		}
+
+		vector, ok := val.(model.Vector)
+		if !ok {
+			return nil, errors.Errorf("unexpected result type %q counting the series of %s in upstream %q", val.Type(), selector, partition.Upstream)
+		}
+
+		counts := make(map[string]int, len(vector))
+		for _, sample := range vector {
+			counts[string(sample.Metric[namespaceLabel])] = int(sample.Value)
+		}
+
+		a.store(key, counts)
+
+		return counts, nil
+	})
+	if err != nil {
+		estimations.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	estimations.WithLabelValues("miss").Inc()
+
+	return ret.(map[string]int), nil
+}
+
+// store caches the series counts, unless too many counts are cached until they expire.
+func (a *Admission) store(key string, counts map[string]int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.entries) >= maxEntries {
+		a.expire(now)
+	}
+	if len(a.entries) < maxEntries {
+		a.entries[key] = entry{counts: counts, expires: now.Add(a.ttl)}
+	}
+}
+
+func (a *Admission) expire(now time.Time) {
+	for key, e := range a.entries {
+		if !now.Before(e.expires) {
+			delete(a.entries, key)
+		}
+	}
+}
+
+func (a *Admission) gc(ctx context.Context) {
+	ticker := time.NewTicker(a.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			a.expire(now)
+			a.mu.Unlock()
+		}
+	}
+}
+
+// Selectors returns the label matchers of the series selectors of an expression.
+func Selectors(expr parser.Expr) [][]*labels.Matcher {
+	var selectors [][]*labels.Matcher
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			selectors = append(selectors, vs.LabelMatchers)
+		}
+		return nil
+	})
+
+	return selectors
+}
+
+// countedSelector returns the label matchers counting the series of a selector, the metric name matcher alone if any,
+// otherwise all the label matchers within the namespaces, as they may select the series of every namespace.
+func countedSelector(matchers []*labels.Matcher, namespaceSet data.Set) (string, error) {
+	if nameMatcher := metricNameMatcher(matchers); nameMatcher != nil {
+		return nameMatcher.String(), nil
+	}
+
+	namespaces := namespaceSet.Values()
+	sort.Strings(namespaces)
+	for idx, ns := range namespaces {
+		namespaces[idx] = regexp.QuoteMeta(ns)
+	}
+	namespaceMatcher, err := labels.NewMatcher(labels.MatchRegexp, namespaceLabel, strings.Join(namespaces, "|"))
+	if err != nil {
+		return "", errors.Annotate(err, "unable to match the namespaces")
+	}
+
+	parts := make([]string, 0, len(matchers)+1)
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	parts = append(parts, namespaceMatcher.String())
+
+	return strings.Join(parts, ","), nil
+}
+
+func metricNameMatcher(matchers []*labels.Matcher) *labels.Matcher {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && (m.Type == labels.MatchEqual || m.Type == labels.MatchRegexp) {
+			return m
+		}
+	}
+
+	return nil
+}
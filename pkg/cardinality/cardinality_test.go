@@ -0,0 +1,199 @@
+// +build test
+
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type fakeAPI struct {
+	promapiv1.API
+
+	mu      sync.Mutex
+	queries []string
+	counts  map[string]model.Vector
+	err     error
+}
+
+func (f *fakeAPI) Query(_ context.Context, query string, _ time.Time) (model.Value, promapiv1.Warnings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.queries = append(f.queries, query)
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+
+	return f.counts[query], nil, nil
+}
+
+func countsVector(counts map[string]float64) model.Vector {
+	vector := make(model.Vector, 0, len(counts))
+	for ns, count := range counts {
+		vector = append(vector, &model.Sample{
+			Metric: model.Metric{namespaceLabel: model.LabelValue(ns)},
+			Value:  model.SampleValue(count),
+		})
+	}
+
+	return vector
+}
+
+func partitionsOf(api promapiv1.API, namespaces ...string) []Partition {
+	return []Partition{{Upstream: "default", API: api, Namespaces: data.NewSet(namespaces...)}}
+}
+
+func TestAdmission(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api := &fakeAPI{
+		counts: map[string]model.Vector{
+			`count by (namespace) ({__name__="http_requests_total"})`:        countsVector(map[string]float64{"ns-a": 1500, "ns-b": 500, "ns-c": 2000000}),
+			`count by (namespace) ({__name__=~"node_.*"})`:                   countsVector(map[string]float64{"ns-a": 100}),
+			`count by (namespace) ({job="api",namespace=~"ns-a|ns-b"})`:      countsVector(map[string]float64{"ns-b": 300}),
+			`count by (namespace) ({__name__!="up",namespace=~"ns-a|ns-b"})`: countsVector(map[string]float64{"ns-a": 50, "ns-b": 50}),
+		},
+	}
+
+	admission, err := NewAdmission(ctx, time.Minute, OverBudgetReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expr, err := parser.ParseExpr(`rate(http_requests_total[5m]) / on(instance) group_left sum(http_requests_total) + count({__name__=~"node_.*"}) + count({job="api"})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectors := Selectors(expr)
+	if len(selectors) != 4 {
+		t.Fatalf("expected 4 selectors, got %d", len(selectors))
+	}
+
+	var waits int
+	wait := func(ctx context.Context) (func(), error) {
+		waits++
+		return func() {}, nil
+	}
+	series, err := admission.Estimate(ctx, selectors, partitionsOf(api, "ns-a", "ns-b"), wait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if series != 2400 {
+		t.Errorf("expected 2400 estimated series, got %d", series)
+	}
+	if waits != 3 {
+		t.Errorf("expected the 3 series counts scheduled, got %d", waits)
+	}
+
+	unnamed := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchNotEqual, labels.MetricName, "up")}}
+	if series, err := admission.Estimate(ctx, unnamed, partitionsOf(api, "ns-a", "ns-b"), nil); err != nil || series != 100 {
+		t.Errorf("expected 100 estimated series without metric name, got %d, %v", series, err)
+	}
+
+	if decision, _ := admission.Admit(ctx, selectors, partitionsOf(api, "ns-a", "ns-b"), 5000, nil); decision != DecisionAdmit {
+		t.Errorf("expected admission, got %s", decision)
+	}
+	if decision, series := admission.Admit(ctx, selectors, partitionsOf(api, "ns-c"), 5000, nil); decision != DecisionReject || series != 2000000 {
+		t.Errorf("expected rejection of 2000000 series, got %s of %d", decision, series)
+	}
+	if decision, _ := admission.Admit(ctx, selectors, partitionsOf(api, "ns-c"), 0, nil); decision != DecisionAdmit {
+		t.Errorf("expected admission without budget, got %s", decision)
+	}
+
+	if len(api.queries) != 5 {
+		t.Errorf("expected the series counts to be cached, got queries %v", api.queries)
+	}
+
+	other := &fakeAPI{
+		counts: map[string]model.Vector{
+			`count by (namespace) ({__name__="http_requests_total"})`: countsVector(map[string]float64{"ns-d": 700}),
+		},
+	}
+	partitions := []Partition{
+		{Upstream: "default", API: api, Namespaces: data.NewSet("ns-a")},
+		{Upstream: "other", API: other, Namespaces: data.NewSet("ns-d")},
+	}
+	expr, err = parser.ParseExpr(`sum(http_requests_total)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if series, err := admission.Estimate(ctx, Selectors(expr), partitions, nil); err != nil || series != 2200 {
+		t.Errorf("expected 2200 estimated series over the upstreams, got %d, %v", series, err)
+	}
+	if len(other.queries) != 1 {
+		t.Errorf("expected the series counted by the other upstream, got queries %v", other.queries)
+	}
+
+	var disabled *Admission
+	if decision, _ := disabled.Admit(ctx, selectors, partitionsOf(api, "ns-c"), 1, nil); decision != DecisionAdmit {
+		t.Errorf("expected admission when disabled, got %s", decision)
+	}
+}
+
+func TestAdmissionMaxEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admission, err := NewAdmission(ctx, time.Minute, OverBudgetReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= maxEntries; i++ {
+		admission.store(fmt.Sprintf("default/{job=\"%d\"}", i), nil)
+	}
+	if len(admission.entries) != maxEntries {
+		t.Errorf("expected at most %d cached series counts, got %d", maxEntries, len(admission.entries))
+	}
+}
+
+func TestAdmissionDowngradeAndFailOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api := &fakeAPI{
+		counts: map[string]model.Vector{
+			`count by (namespace) ({__name__="up"})`: countsVector(map[string]float64{"ns-a": 10}),
+		},
+	}
+
+	admission, err := NewAdmission(ctx, time.Minute, OverBudgetDowngrade)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expr, err := parser.ParseExpr(`up`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision, _ := admission.Admit(ctx, Selectors(expr), partitionsOf(api, "ns-a"), 5, nil); decision != DecisionDowngrade {
+		t.Errorf("expected downgrade, got %s", decision)
+	}
+
+	api.err = errors.New("upstream unavailable")
+	expr, err = parser.ParseExpr(`down`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision, _ := admission.Admit(ctx, Selectors(expr), partitionsOf(api, "ns-a"), 5, nil); decision != DecisionAdmit {
+		t.Errorf("expected admission when the estimation fails, got %s", decision)
+	}
+
+	if _, err := NewAdmission(ctx, time.Minute, "drop"); err == nil {
+		t.Error("expected error for unknown over budget action")
+	}
+}
@@ -0,0 +1,159 @@
+package coalesce
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	coalescedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "coalesced_requests_total",
+			Help:      "Number of the upstream requests by role, the leaders are sent upstream and the followers share their response.",
+		},
+		[]string{"role"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(coalescedRequests)
+}
+
+// Group deduplicates the identical upstream requests in flight,
+// the clients waiting for the same key share a single upstream response.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func NewGroup() *Group {
+	return &Group{
+		calls: make(map[string]*call),
+	}
+}
+
+// ServeHTTP sends the request upstream through the handler, unless an identical request is in flight.
+// The upstream request is canceled once all the clients waiting for it are gone, or at the deadline of the first one,
+// the identical requests have the same timeout.
+func (g *Group) ServeHTTP(key string, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	g.mu.Lock()
+	c, exist := g.calls[key]
+	if !exist {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if deadline, ok := r.Context().Deadline(); ok {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		c = &call{
+			done:   make(chan struct{}),
+			ctx:    ctx,
+			cancel: cancel,
+			header: make(http.Header),
+		}
+		g.calls[key] = c
+
+		go g.do(key, c, r, handler)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	if exist {
+		coalescedRequests.WithLabelValues("follower").Inc()
+	} else {
+		coalescedRequests.WithLabelValues("leader").Inc()
+	}
+
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	for name, values := range c.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body.Bytes())
+}
+
+func (g *Group) do(key string, c *call, r *http.Request, handler http.Handler) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				log.Errorf("panic serving the coalesced request %s: %v", r.URL.Path, err)
+			}
+			// the response is incomplete
+			c.status, c.header = 0, make(http.Header)
+			c.body.Reset()
+		}
+		if c.status == 0 {
+			c.status = http.StatusBadGateway
+		}
+
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	handler.ServeHTTP(&recorder{call: c}, r.WithContext(c.ctx))
+}
+
+// recorder buffers the upstream response of a call.
+type recorder struct {
+	call        *call
+	wroteHeader bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.call.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.call.status = status
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.call.body.Write(b)
+}
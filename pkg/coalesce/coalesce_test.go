@@ -0,0 +1,130 @@
+// +build test
+
+package coalesce
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitWaiters(t *testing.T, g *Group, key string, expected int) {
+	for i := 0; i < 1000; i++ {
+		g.mu.Lock()
+		waiters := 0
+		if c, exist := g.calls[key]; exist {
+			waiters = c.waiters
+		}
+		g.mu.Unlock()
+
+		if waiters == expected {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("expected %d waiters of %s", expected, key)
+}
+
+func TestGroupSharesResponse(t *testing.T) {
+	g := NewGroup()
+
+	var upstreamCalls int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		<-release
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"success"}`))
+	})
+
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	wg := sync.WaitGroup{}
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			g.ServeHTTP("key", w, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil), upstream)
+		}(recorders[i])
+	}
+
+	waitWaiters(t, g, "key", len(recorders))
+	close(release)
+	wg.Wait()
+
+	if upstreamCalls != 1 {
+		t.Errorf("expected a single upstream request, got %d", upstreamCalls)
+	}
+	for i, w := range recorders {
+		if w.Code != http.StatusAccepted || w.Body.String() != `{"status":"success"}` || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected response %d: %d %v %s", i, w.Code, w.Header(), w.Body)
+		}
+	}
+
+	// the completed calls are not shared
+	g.ServeHTTP("key", httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil), upstream)
+	if upstreamCalls != 2 {
+		t.Errorf("expected a new upstream request, got %d", upstreamCalls)
+	}
+}
+
+func TestGroupCancelsAbandonedCall(t *testing.T) {
+	g := NewGroup()
+
+	canceled := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil).WithContext(ctx)
+		g.ServeHTTP("key", httptest.NewRecorder(), req, upstream)
+	}()
+
+	waitWaiters(t, g, "key", 1)
+	cancel()
+	<-done
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the abandoned upstream request to be canceled")
+	}
+
+	// an upstream request without response is a bad gateway
+	w := httptest.NewRecorder()
+	g.ServeHTTP("key", w, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway without upstream response, got %d", w.Code)
+	}
+}
+
+func TestGroupKeepsDeadline(t *testing.T) {
+	g := NewGroup()
+
+	deadline := time.Now().Add(time.Minute)
+	var upstreamDeadline time.Time
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamDeadline, _ = r.Context().Deadline()
+	})
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	g.ServeHTTP("key", httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&timeout=1m", nil).WithContext(ctx), upstream)
+
+	if !upstreamDeadline.Equal(deadline) {
+		t.Errorf("expected the upstream request to keep the deadline %v, got %v", deadline, upstreamDeadline)
+	}
+}
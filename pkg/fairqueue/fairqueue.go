@@ -0,0 +1,361 @@
+package fairqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Priority levels isolating the concurrency of the requests.
+const (
+	// LevelTenants serves the requests restricted to namespaces.
+	LevelTenants = "tenants"
+	// LevelAdmin serves the requests bypassing the namespace restriction.
+	LevelAdmin = "admin"
+	// LevelLowPriority serves the tenant requests downgraded by the cardinality admission, it is optional.
+	LevelLowPriority = "low-priority"
+)
+
+// Tenant keys of the queues.
+const (
+	// TenantUser gives a queue to every user.
+	TenantUser = "user"
+	// TenantNamespaces shares a queue between the users accessing the same namespaces.
+	TenantNamespaces = "namespaces"
+)
+
+var (
+	// ErrQueueFull rejects a request when the queue of its tenant is full.
+	ErrQueueFull = errors.New("queue full")
+	// ErrQueueTimeout rejects a request waiting longer than the queue timeout.
+	ErrQueueTimeout = errors.New("queue timeout")
+
+	inFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prometheus_auth",
+			Name:      "scheduler_in_flight_requests",
+			Help:      "Number of the upstream requests in flight by priority level.",
+		},
+		[]string{"priority_level"},
+	)
+	waitingRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prometheus_auth",
+			Name:      "scheduler_waiting_requests",
+			Help:      "Number of the queued upstream requests by priority level.",
+		},
+		[]string{"priority_level"},
+	)
+	rejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "scheduler_rejected_requests_total",
+			Help:      "Number of the upstream requests rejected by priority level and reason (queue-full, timeout or canceled).",
+		},
+		[]string{"priority_level", "reason"},
+	)
+	waitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prometheus_auth",
+			Name:      "scheduler_wait_duration_seconds",
+			Help:      "Duration the upstream requests waited in the queues by priority level.",
+			Buckets:   []float64{0, 0.005, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 30},
+		},
+		[]string{"priority_level"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inFlightRequests, waitingRequests, rejectedRequests, waitDuration)
+}
+
+// Config is the YAML file of the scheduler.
+type Config struct {
+	// Tenant is "user" or "namespaces".
+	Tenant  string      `json:"tenant"`
+	Tenants LevelConfig `json:"tenants"`
+	Admin   LevelConfig `json:"admin"`
+	// LowPriority is configured when its maxInFlight is positive.
+	LowPriority LevelConfig `json:"lowPriority,omitempty"`
+}
+
+type LevelConfig struct {
+	// MaxInFlight is the maximum number of the upstream requests of the level.
+	MaxInFlight int `json:"maxInFlight"`
+	// MaxInFlightPerTenant is the maximum number of the upstream requests of a tenant.
+	MaxInFlightPerTenant int `json:"maxInFlightPerTenant"`
+	// QueueLength is the maximum number of the waiting requests of a tenant.
+	QueueLength int `json:"queueLength"`
+	// QueueTimeout is the maximum duration a request waits.
+	QueueTimeout metav1.Duration `json:"queueTimeout"`
+	// Weights of the tenants sharing the level, 1 by default.
+	Weights map[string]float64 `json:"weights,omitempty"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Annotatef(err, "unable to read scheduler config %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return cfg, errors.Annotatef(err, "unable to parse scheduler config %s", path)
+	}
+
+	return cfg, nil
+}
+
+// Scheduler caps the in-flight upstream requests per priority level and tenant,
+// the excess requests wait in a queue per tenant and the queues are served in a weighted fair order.
+type Scheduler struct {
+	tenant string
+	levels map[string]*priorityLevel
+}
+
+func NewScheduler(cfg Config) (*Scheduler, error) {
+	if cfg.Tenant != TenantUser && cfg.Tenant != TenantNamespaces {
+		return nil, errors.Errorf("unknown scheduler tenant %q, expected %q or %q", cfg.Tenant, TenantUser, TenantNamespaces)
+	}
+
+	s := &Scheduler{
+		tenant: cfg.Tenant,
+		levels: make(map[string]*priorityLevel, 3),
+	}
+
+	levelCfgs := map[string]LevelConfig{LevelTenants: cfg.Tenants, LevelAdmin: cfg.Admin}
+	if cfg.LowPriority.MaxInFlight > 0 {
+		levelCfgs[LevelLowPriority] = cfg.LowPriority
+	}
+
+	for name, levelCfg := range levelCfgs {
+		level, err := newPriorityLevel(name, levelCfg)
+		if err != nil {
+			return nil, err
+		}
+		s.levels[name] = level
+	}
+
+	return s, nil
+}
+
+// Tenant returns the key of the tenants, "user" or "namespaces".
+func (s *Scheduler) Tenant() string {
+	return s.tenant
+}
+
+// HasLevel tells whether the priority level is configured.
+func (s *Scheduler) HasLevel(level string) bool {
+	_, exist := s.levels[level]
+	return exist
+}
+
+// Wait blocks until the request of the tenant can be sent upstream,
+// the returned function must be called once the upstream request completes.
+func (s *Scheduler) Wait(ctx context.Context, level, tenant string) (func(), error) {
+	l, exist := s.levels[level]
+	if !exist {
+		return nil, errors.Errorf("unknown priority level %q", level)
+	}
+
+	return l.wait(ctx, tenant)
+}
+
+type waiter struct {
+	queue *tenantQueue
+	ready chan struct{}
+}
+
+type tenantQueue struct {
+	name        string
+	weight      float64
+	inFlight    int
+	waiting     []*waiter
+	virtualTime float64
+}
+
+type priorityLevel struct {
+	name string
+	cfg  LevelConfig
+
+	mu          sync.Mutex
+	inFlight    int
+	virtualTime float64
+	queues      map[string]*tenantQueue
+}
+
+func newPriorityLevel(name string, cfg LevelConfig) (*priorityLevel, error) {
+	if cfg.MaxInFlight <= 0 {
+		return nil, errors.Errorf("maxInFlight of the %s priority level must be positive", name)
+	}
+	if cfg.MaxInFlightPerTenant <= 0 || cfg.MaxInFlightPerTenant > cfg.MaxInFlight {
+		cfg.MaxInFlightPerTenant = cfg.MaxInFlight
+	}
+	if cfg.QueueLength < 0 {
+		return nil, errors.Errorf("queueLength of the %s priority level must not be negative", name)
+	}
+	for tenant, weight := range cfg.Weights {
+		if weight <= 0 {
+			return nil, errors.Errorf("weight of %q in the %s priority level must be positive", tenant, name)
+		}
+	}
+
+	return &priorityLevel{
+		name:   name,
+		cfg:    cfg,
+		queues: make(map[string]*tenantQueue),
+	}, nil
+}
+
+func (l *priorityLevel) wait(ctx context.Context, tenant string) (func(), error) {
+	l.mu.Lock()
+
+	queue := l.queueOf(tenant)
+	if l.inFlight < l.cfg.MaxInFlight && queue.inFlight < l.cfg.MaxInFlightPerTenant && len(queue.waiting) == 0 {
+		l.dispatch(queue)
+		l.mu.Unlock()
+		waitDuration.WithLabelValues(l.name).Observe(0)
+
+		return l.releaser(queue), nil
+	}
+
+	if len(queue.waiting) >= l.cfg.QueueLength {
+		l.forget(queue)
+		l.mu.Unlock()
+		rejectedRequests.WithLabelValues(l.name, "queue-full").Inc()
+
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{queue: queue, ready: make(chan struct{})}
+	queue.waiting = append(queue.waiting, w)
+	waitingRequests.WithLabelValues(l.name).Inc()
+	l.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if l.cfg.QueueTimeout.Duration > 0 {
+		timer := time.NewTimer(l.cfg.QueueTimeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		waitDuration.WithLabelValues(l.name).Observe(time.Since(start).Seconds())
+		return l.releaser(queue), nil
+	case <-timeout:
+		err = ErrQueueTimeout
+		rejectedRequests.WithLabelValues(l.name, "timeout").Inc()
+	case <-ctx.Done():
+		err = ctx.Err()
+		rejectedRequests.WithLabelValues(l.name, "canceled").Inc()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		// dispatched meanwhile, give the seat to the next request
+		l.release(queue)
+	default:
+		for idx, other := range queue.waiting {
+			if other == w {
+				queue.waiting = append(queue.waiting[:idx], queue.waiting[idx+1:]...)
+				break
+			}
+		}
+		waitingRequests.WithLabelValues(l.name).Dec()
+		l.forget(queue)
+	}
+
+	return nil, err
+}
+
+func (l *priorityLevel) releaser(queue *tenantQueue) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.release(queue)
+		})
+	}
+}
+
+// queueOf returns the queue of the tenant, a new queue starts at the current virtual time
+// so that idle tenants don't accumulate credit.
+func (l *priorityLevel) queueOf(tenant string) *tenantQueue {
+	queue, exist := l.queues[tenant]
+	if !exist {
+		weight, exist := l.cfg.Weights[tenant]
+		if !exist {
+			weight = 1
+		}
+
+		queue = &tenantQueue{name: tenant, weight: weight, virtualTime: l.virtualTime}
+		l.queues[tenant] = queue
+	}
+
+	return queue
+}
+
+func (l *priorityLevel) forget(queue *tenantQueue) {
+	if queue.inFlight == 0 && len(queue.waiting) == 0 {
+		delete(l.queues, queue.name)
+	}
+}
+
+func (l *priorityLevel) dispatch(queue *tenantQueue) {
+	if queue.virtualTime < l.virtualTime {
+		queue.virtualTime = l.virtualTime
+	}
+	l.virtualTime = queue.virtualTime
+	queue.virtualTime += 1 / queue.weight
+
+	l.inFlight++
+	queue.inFlight++
+	inFlightRequests.WithLabelValues(l.name).Inc()
+}
+
+func (l *priorityLevel) release(queue *tenantQueue) {
+	l.inFlight--
+	queue.inFlight--
+	inFlightRequests.WithLabelValues(l.name).Dec()
+
+	// serve the waiting queue with the smallest virtual time among the tenants under their cap
+	for l.inFlight < l.cfg.MaxInFlight {
+		var next *tenantQueue
+		for _, candidate := range l.queues {
+			if len(candidate.waiting) == 0 || candidate.inFlight >= l.cfg.MaxInFlightPerTenant {
+				continue
+			}
+			if next == nil || candidate.virtualTime < next.virtualTime ||
+				(candidate.virtualTime == next.virtualTime && candidate.name < next.name) {
+				next = candidate
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		w := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		waitingRequests.WithLabelValues(l.name).Dec()
+		l.dispatch(next)
+		close(w.ready)
+	}
+
+	l.forget(queue)
+}
@@ -0,0 +1,205 @@
+// +build test
+
+package fairqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestScheduler(t *testing.T, tenants LevelConfig) *Scheduler {
+	s, err := NewScheduler(Config{
+		Tenant:  TenantUser,
+		Tenants: tenants,
+		Admin:   LevelConfig{MaxInFlight: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func waitQueued(t *testing.T, s *Scheduler, tenant string, expected int) {
+	level := s.levels[LevelTenants]
+	for i := 0; i < 1000; i++ {
+		level.mu.Lock()
+		queued := 0
+		if queue, exist := level.queues[tenant]; exist {
+			queued = len(queue.waiting)
+		}
+		level.mu.Unlock()
+
+		if queued == expected {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("expected %d queued requests of %s", expected, tenant)
+}
+
+func TestSchedulerCaps(t *testing.T) {
+	ctx := context.Background()
+	s := newTestScheduler(t, LevelConfig{MaxInFlight: 2, MaxInFlightPerTenant: 1, QueueLength: 1})
+
+	releaseA, err := s.Wait(ctx, LevelTenants, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatched := make(chan struct{})
+	go func() {
+		release, err := s.Wait(ctx, LevelTenants, "a")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(dispatched)
+		release()
+	}()
+	waitQueued(t, s, "a", 1)
+
+	if _, err := s.Wait(ctx, LevelTenants, "a"); err != ErrQueueFull {
+		t.Fatalf("expected the queue of a to be full, got %v", err)
+	}
+
+	releaseB, err := s.Wait(ctx, LevelTenants, "b")
+	if err != nil {
+		t.Fatalf("expected b not to wait for a, got %v", err)
+	}
+
+	// the admin priority level is isolated from the tenants
+	releaseAdmin, err := s.Wait(ctx, LevelAdmin, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseAdmin()
+
+	releaseB()
+	select {
+	case <-dispatched:
+		t.Fatal("expected a to be capped at 1 in-flight request")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	releaseA()
+	releaseA()
+	<-dispatched
+}
+
+func TestSchedulerWeightedFairOrder(t *testing.T) {
+	ctx := context.Background()
+	s := newTestScheduler(t, LevelConfig{MaxInFlight: 1, QueueLength: 10, Weights: map[string]float64{"a": 2}})
+
+	releaseHolder, err := s.Wait(ctx, LevelTenants, "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 6)
+	wg := sync.WaitGroup{}
+	for _, tenant := range []string{"a", "b"} {
+		for i := 1; i <= 3; i++ {
+			name := tenant + string(rune('0'+i))
+			wg.Add(1)
+			go func(tenant string) {
+				defer wg.Done()
+
+				release, err := s.Wait(ctx, LevelTenants, tenant)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				order <- name
+				release()
+			}(tenant)
+			waitQueued(t, s, tenant, i)
+		}
+	}
+
+	releaseHolder()
+
+	expected := []string{"a1", "b1", "a2", "a3", "b2", "b3"}
+	for _, name := range expected {
+		if got := <-order; got != name {
+			t.Fatalf("expected %s to be dispatched, got %s", name, got)
+		}
+	}
+
+	wg.Wait()
+	if len(s.levels[LevelTenants].queues) != 0 {
+		t.Error("expected the idle queues to be forgotten")
+	}
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	s := newTestScheduler(t, LevelConfig{MaxInFlight: 1, QueueLength: 1, QueueTimeout: metav1.Duration{Duration: 10 * time.Millisecond}})
+
+	release, err := s.Wait(context.Background(), LevelTenants, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err := s.Wait(context.Background(), LevelTenants, "b"); err != ErrQueueTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Wait(ctx, LevelTenants, "b"); err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	if _, exist := s.levels[LevelTenants].queues["b"]; exist {
+		t.Error("expected the abandoned queue to be forgotten")
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	invalid := []Config{
+		{Tenant: "project", Tenants: LevelConfig{MaxInFlight: 1}, Admin: LevelConfig{MaxInFlight: 1}},
+		{Tenant: TenantUser, Tenants: LevelConfig{MaxInFlight: 1}},
+		{Tenant: TenantUser, Tenants: LevelConfig{MaxInFlight: 1, Weights: map[string]float64{"a": 0}}, Admin: LevelConfig{MaxInFlight: 1}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewScheduler(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestSchedulerLowPriority(t *testing.T) {
+	s := newTestScheduler(t, LevelConfig{MaxInFlight: 1})
+	if s.HasLevel(LevelLowPriority) {
+		t.Error("expected no low-priority level by default")
+	}
+
+	s, err := NewScheduler(Config{
+		Tenant:      TenantUser,
+		Tenants:     LevelConfig{MaxInFlight: 2},
+		Admin:       LevelConfig{MaxInFlight: 1},
+		LowPriority: LevelConfig{MaxInFlight: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasLevel(LevelLowPriority) {
+		t.Fatal("expected the low-priority level")
+	}
+
+	release, err := s.Wait(context.Background(), LevelLowPriority, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err := s.Wait(context.Background(), LevelLowPriority, "bob"); err != ErrQueueFull {
+		t.Errorf("expected the low-priority level to be full, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package kube
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	corev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	rbacv1 "github.com/rancher/wrangler-api/pkg/generated/controllers/rbac/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	k8scorev1 "k8s.io/api/core/v1"
+	k8srbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	accessCacheTTL = 24 * time.Hour
+)
+
+var (
+	accessCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "access_cache_requests_total",
+			Help:      "Number of the user access lookups by cache and result (hit or miss).",
+		},
+		[]string{"cache", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(accessCacheRequests)
+}
+
+// AccessSetKeyer hashes the roles of a user, as accesscontrol.AccessStore does.
+type AccessSetKeyer interface {
+	CacheKey(user user.Info) string
+}
+
+// AccessCache memorizes the namespaces and the nodes permission of the users.
+// The entries are keyed by the user, its groups and the hash of its roles,
+// and all of them are dropped when a namespace or an RBAC object changes.
+type AccessCache struct {
+	accessStore AccessSetKeyer
+	namespaces  *cache.LRUExpireCache
+	nodes       *cache.LRUExpireCache
+	generation  uint64
+}
+
+type accessCacheEntry struct {
+	generation uint64
+	value      interface{}
+}
+
+func NewAccessCache(accessStore AccessSetKeyer, size int) *AccessCache {
+	return &AccessCache{
+		accessStore: accessStore,
+		namespaces:  cache.NewLRUExpireCache(size),
+		nodes:       cache.NewLRUExpireCache(size),
+	}
+}
+
+// Register invalidates the cache on the changes of the namespaces, roles and bindings.
+func (c *AccessCache) Register(ctx context.Context, namespaces corev1.NamespaceController, rbac rbacv1.Interface) {
+	namespaces.OnChange(ctx, "access-cache-namespace", func(key string, obj *k8scorev1.Namespace) (*k8scorev1.Namespace, error) {
+		c.Invalidate()
+		return obj, nil
+	})
+	rbac.Role().OnChange(ctx, "access-cache-role", func(key string, obj *k8srbacv1.Role) (*k8srbacv1.Role, error) {
+		c.Invalidate()
+		return obj, nil
+	})
+	rbac.RoleBinding().OnChange(ctx, "access-cache-rolebinding", func(key string, obj *k8srbacv1.RoleBinding) (*k8srbacv1.RoleBinding, error) {
+		c.Invalidate()
+		return obj, nil
+	})
+	rbac.ClusterRole().OnChange(ctx, "access-cache-clusterrole", func(key string, obj *k8srbacv1.ClusterRole) (*k8srbacv1.ClusterRole, error) {
+		c.Invalidate()
+		return obj, nil
+	})
+	rbac.ClusterRoleBinding().OnChange(ctx, "access-cache-clusterrolebinding", func(key string, obj *k8srbacv1.ClusterRoleBinding) (*k8srbacv1.ClusterRoleBinding, error) {
+		c.Invalidate()
+		return obj, nil
+	})
+}
+
+// Invalidate drops all the cached entries.
+func (c *AccessCache) Invalidate() {
+	atomic.AddUint64(&c.generation, 1)
+}
+
+// Namespaces caches the namespaces resolved by the given resolver.
+func (c *AccessCache) Namespaces(resolver Namespaces) Namespaces {
+	return &cachedNamespaces{
+		AccessCache: c,
+		resolver:    resolver,
+	}
+}
+
+// Nodes caches the nodes permission checked by the given checker.
+func (c *AccessCache) Nodes(checker Nodes) Nodes {
+	return &cachedNodes{
+		AccessCache: c,
+		checker:     checker,
+	}
+}
+
+func (c *AccessCache) key(info *user.DefaultInfo) string {
+	groups := append([]string(nil), info.Groups...)
+	sort.Strings(groups)
+
+	return strings.Join([]string{info.Name, strings.Join(groups, ","), c.accessStore.CacheKey(info)}, "\x00")
+}
+
+func (c *AccessCache) get(lru *cache.LRUExpireCache, name, key string) (interface{}, uint64, bool) {
+	generation := atomic.LoadUint64(&c.generation)
+
+	if val, ok := lru.Get(key); ok {
+		if entry := val.(*accessCacheEntry); entry.generation == generation {
+			accessCacheRequests.WithLabelValues(name, "hit").Inc()
+			return entry.value, generation, true
+		}
+	}
+	accessCacheRequests.WithLabelValues(name, "miss").Inc()
+
+	return nil, generation, false
+}
+
+func (c *AccessCache) add(lru *cache.LRUExpireCache, key string, generation uint64, value interface{}) {
+	lru.Add(key, &accessCacheEntry{generation: generation, value: value}, accessCacheTTL)
+}
+
+type cachedNamespaces struct {
+	*AccessCache
+	resolver Namespaces
+}
+
+func (n *cachedNamespaces) QueryByUser(info *user.DefaultInfo) data.Set {
+	key := n.key(info)
+	val, generation, ok := n.get(n.namespaces, "namespaces", key)
+	if ok {
+		return val.(data.Set)
+	}
+
+	ret := n.resolver.QueryByUser(info)
+	n.add(n.namespaces, key, generation, ret)
+
+	return ret
+}
+
+type cachedNodes struct {
+	*AccessCache
+	checker Nodes
+}
+
+func (n *cachedNodes) CanList(info *user.DefaultInfo) bool {
+	key := n.key(info)
+	val, generation, ok := n.get(n.nodes, "nodes", key)
+	if ok {
+		return val.(bool)
+	}
+
+	ret := n.checker.CanList(info)
+	n.add(n.nodes, key, generation, ret)
+
+	return ret
+}
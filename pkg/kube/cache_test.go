@@ -0,0 +1,78 @@
+// +build test
+
+package kube
+
+import (
+	"testing"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type fakeAccessSetKeyer struct {
+	revision string
+}
+
+func (f *fakeAccessSetKeyer) CacheKey(user user.Info) string {
+	return f.revision
+}
+
+type countingResolver struct {
+	calls int
+}
+
+func (c *countingResolver) QueryByUser(info *user.DefaultInfo) data.Set {
+	c.calls++
+	return data.NewSet(info.Name)
+}
+
+func (c *countingResolver) CanList(info *user.DefaultInfo) bool {
+	c.calls++
+	return info.Name == "admin"
+}
+
+func TestAccessCache(t *testing.T) {
+	keyer := &fakeAccessSetKeyer{revision: "1"}
+	accessCache := NewAccessCache(keyer, 10)
+
+	resolver := &countingResolver{}
+	namespaces := accessCache.Namespaces(resolver)
+
+	alice := &user.DefaultInfo{Name: "alice", Groups: []string{"team-a", "team-b"}}
+	if got := namespaces.QueryByUser(alice); got.String() != "alice" {
+		t.Fatalf("unexpected namespaces %v", got)
+	}
+	namespaces.QueryByUser(&user.DefaultInfo{Name: "alice", Groups: []string{"team-b", "team-a"}})
+	if resolver.calls != 1 {
+		t.Errorf("expected a cache hit, got %d resolutions", resolver.calls)
+	}
+
+	namespaces.QueryByUser(&user.DefaultInfo{Name: "alice", Groups: []string{"team-a"}})
+	if resolver.calls != 2 {
+		t.Errorf("expected a cache miss for other groups, got %d resolutions", resolver.calls)
+	}
+
+	keyer.revision = "2"
+	namespaces.QueryByUser(alice)
+	if resolver.calls != 3 {
+		t.Errorf("expected a cache miss after a role change, got %d resolutions", resolver.calls)
+	}
+
+	accessCache.Invalidate()
+	namespaces.QueryByUser(alice)
+	namespaces.QueryByUser(alice)
+	if resolver.calls != 4 {
+		t.Errorf("expected a single cache miss after invalidation, got %d resolutions", resolver.calls)
+	}
+
+	checker := &countingResolver{}
+	nodes := accessCache.Nodes(checker)
+	admin := &user.DefaultInfo{Name: "admin"}
+	if !nodes.CanList(admin) || !nodes.CanList(admin) || nodes.CanList(alice) {
+		t.Error("unexpected nodes permission")
+	}
+	if checker.calls != 2 {
+		t.Errorf("expected a cache hit, got %d checks", checker.calls)
+	}
+}
@@ -0,0 +1,74 @@
+package kube
+
+import (
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"github.com/juju/errors"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	NamespacesUnion        = "union"
+	NamespacesIntersection = "intersection"
+)
+
+type unionNamespaces []Namespaces
+
+// NewUnionNamespaces allows the namespaces allowed by any of the resolvers.
+func NewUnionNamespaces(resolvers ...Namespaces) Namespaces {
+	return unionNamespaces(resolvers)
+}
+
+func (u unionNamespaces) QueryByUser(info *user.DefaultInfo) data.Set {
+	ret := data.Set{}
+	for _, resolver := range u {
+		for ns := range resolver.QueryByUser(info) {
+			ret[ns] = struct{}{}
+		}
+	}
+
+	return ret
+}
+
+type intersectionNamespaces []Namespaces
+
+// NewIntersectionNamespaces only allows the namespaces allowed by all of the resolvers.
+func NewIntersectionNamespaces(resolvers ...Namespaces) Namespaces {
+	return intersectionNamespaces(resolvers)
+}
+
+func (i intersectionNamespaces) QueryByUser(info *user.DefaultInfo) data.Set {
+	if len(i) == 0 {
+		return data.Set{}
+	}
+
+	ret := i[0].QueryByUser(info)
+	for _, resolver := range i[1:] {
+		if len(ret) == 0 {
+			break
+		}
+
+		allowed := resolver.QueryByUser(info)
+		narrowed := make(data.Set, len(ret))
+		for ns := range ret {
+			if _, exist := allowed[ns]; exist {
+				narrowed[ns] = struct{}{}
+			}
+		}
+		ret = narrowed
+	}
+
+	return ret
+}
+
+// ComposeNamespaces combines the resolvers as the union or the intersection of their namespaces.
+func ComposeNamespaces(mode string, resolvers ...Namespaces) (Namespaces, error) {
+	switch mode {
+	case "", NamespacesUnion:
+		return NewUnionNamespaces(resolvers...), nil
+	case NamespacesIntersection:
+		return NewIntersectionNamespaces(resolvers...), nil
+	default:
+		return nil, errors.Errorf("unknown namespaces composition %q, expected %q or %q", mode, NamespacesUnion, NamespacesIntersection)
+	}
+}
@@ -100,6 +100,19 @@ func getProjectID(ns *k8scorev1.Namespace) (string, bool) {
 	return "", false
 }
 
+// NewProjectLookup returns the Rancher project of a namespace, or "" if it belongs to none.
+func NewProjectLookup(namespaceCache corev1.NamespaceCache) func(namespace string) string {
+	return func(namespace string) string {
+		ns, err := namespaceCache.Get(namespace)
+		if err != nil {
+			return ""
+		}
+
+		projectID, _ := getProjectID(ns)
+		return projectID
+	}
+}
+
 func NamespaceByProjectID(obj interface{}) ([]string, error) {
 	projectID, exist := getProjectID(toNamespace(obj))
 	if exist {
@@ -2,6 +2,8 @@ package kube
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 
 	corev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
 
@@ -23,13 +25,13 @@ func NewSecrets(ctx context.Context, secretCache corev1.SecretCache) *Secrets {
 }
 
 func (n *Secrets) GetSA(token string) (*k8scorev1.ServiceAccount, error) {
-	secList, err := n.secretCache.GetByIndex(ByTokenIndex, token)
+	secList, err := n.secretCache.GetByIndex(ByTokenIndex, HashToken(token))
 	if err != nil {
 		return nil, errors.Annotatef(err, "unknown token")
 	}
 
 	if len(secList) != 1 {
-		return nil, errors.Annotatef(err, "can't find service account for token")
+		return nil, errors.New("can't find service account for token")
 	}
 
 	sec := secList[0]
@@ -45,13 +47,27 @@ func (n *Secrets) GetSA(token string) (*k8scorev1.ServiceAccount, error) {
 
 	saName := sec.Annotations[annServiceAccount]
 	if saName == "" {
-		return nil, errors.New("failed to get serviceAccount for token " + token)
+		return nil, errors.Errorf("failed to get serviceAccount for token secret %s/%s", sec.Namespace, sec.Name)
 	}
 
 	sa.Name = saName
 	return sa, nil
 }
 
+func (n *Secrets) GetData(namespace, name, key string) ([]byte, error) {
+	sec, err := n.secretCache.Get(namespace, name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to get secret %s/%s", namespace, name)
+	}
+
+	value := sec.Data[key]
+	if len(value) == 0 {
+		return nil, errors.Errorf("secret %s/%s has no %q key", namespace, name, key)
+	}
+
+	return value, nil
+}
+
 func toSecret(obj interface{}) *k8scorev1.Secret {
 	sec, ok := obj.(*k8scorev1.Secret)
 	if !ok {
@@ -61,12 +77,19 @@ func toSecret(obj interface{}) *k8scorev1.Secret {
 	return sec
 }
 
+// HashToken returns the index key of a service account token,
+// keeping the raw tokens out of the informer indices.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func SecretByToken(obj interface{}) ([]string, error) {
 	sec := toSecret(obj)
 	if sec.Type == k8scorev1.SecretTypeServiceAccountToken {
 		secretToken := sec.Data[k8scorev1.ServiceAccountTokenKey]
 		if len(secretToken) != 0 {
-			return []string{string(secretToken)}, nil
+			return []string{HashToken(string(secretToken))}, nil
 		}
 	}
 
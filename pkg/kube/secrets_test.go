@@ -0,0 +1,112 @@
+// +build test
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	corev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	k8scorev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type fakeSecretCache struct {
+	secrets []*k8scorev1.Secret
+}
+
+func (f *fakeSecretCache) Get(namespace, name string) (*k8scorev1.Secret, error) {
+	for _, sec := range f.secrets {
+		if sec.Namespace == namespace && sec.Name == name {
+			return sec, nil
+		}
+	}
+
+	return nil, errors.NotFoundf("secret %s/%s", namespace, name)
+}
+
+func (f *fakeSecretCache) List(namespace string, selector labels.Selector) ([]*k8scorev1.Secret, error) {
+	return f.secrets, nil
+}
+
+func (f *fakeSecretCache) AddIndexer(indexName string, indexer corev1.SecretIndexer) {}
+
+func (f *fakeSecretCache) GetByIndex(indexName, key string) ([]*k8scorev1.Secret, error) {
+	ret := make([]*k8scorev1.Secret, 0, 1)
+	for _, sec := range f.secrets {
+		keys, err := SecretByToken(sec)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if k == key {
+				ret = append(ret, sec)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func newTokenSecret(namespace, name, saName, token string) *k8scorev1.Secret {
+	return &k8scorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{annServiceAccount: saName},
+		},
+		Type: k8scorev1.SecretTypeServiceAccountToken,
+		Data: map[string][]byte{k8scorev1.ServiceAccountTokenKey: []byte(token)},
+	}
+}
+
+func TestSecretByToken(t *testing.T) {
+	keys, err := SecretByToken(newTokenSecret("ns-a", "sa-a-token", "sa-a", "raw-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != HashToken("raw-token") || strings.Contains(keys[0], "raw-token") {
+		t.Errorf("expected the hashed token as index key, got %v", keys)
+	}
+
+	keys, err = SecretByToken(&k8scorev1.Secret{Type: k8scorev1.SecretTypeOpaque})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no index key for opaque secret, got %v", keys)
+	}
+}
+
+func TestGetSA(t *testing.T) {
+	secrets := NewSecrets(context.Background(), &fakeSecretCache{
+		secrets: []*k8scorev1.Secret{
+			newTokenSecret("ns-a", "sa-a-token", "sa-a", "token-a"),
+			newTokenSecret("ns-b", "no-sa-token", "", "token-b"),
+		},
+	})
+
+	sa, err := secrets.GetSA("token-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Namespace != "ns-a" || sa.Name != "sa-a" {
+		t.Errorf("got service account %s/%s, want ns-a/sa-a", sa.Namespace, sa.Name)
+	}
+
+	if _, err := secrets.GetSA("unknown"); err == nil {
+		t.Error("expected error for unknown token")
+	}
+
+	_, err = secrets.GetSA("token-b")
+	if err == nil {
+		t.Fatal("expected error for token without service account")
+	}
+	if strings.Contains(err.Error(), "token-b") {
+		t.Errorf("error message leaks the token: %v", err)
+	}
+}
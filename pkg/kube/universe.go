@@ -0,0 +1,148 @@
+package kube
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	corev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+
+	log "github.com/sirupsen/logrus"
+	k8scorev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	universeRefreshInterval = time.Minute
+	// universeMaxAge disables the universe when the upstream label values cannot be refreshed.
+	universeMaxAge = 3 * universeRefreshInterval
+	// creationTimestampPrecision is the precision of the creation timestamps of the namespaces.
+	creationTimestampPrecision = time.Second
+)
+
+// NamespaceUniverse holds the namespace values the series may have: the namespaces of the cluster,
+// and the namespace label values of the upstream, which keep the deleted namespaces as long as their series are retained.
+// The label values are only known up to the last refresh, so the universe is withheld
+// while a namespace of the cluster is newer than the last refresh, until the next one.
+type NamespaceUniverse struct {
+	namespaceCache corev1.NamespaceCache
+	labelValues    func(ctx context.Context) ([]string, error)
+
+	mu        sync.RWMutex
+	values    data.Set
+	refreshed time.Time
+	// newest is the creation time of the newest namespace of the cluster
+	newest time.Time
+}
+
+// NewNamespaceUniverse adds the namespaces as soon as they are created,
+// and refreshes the upstream namespace label values periodically.
+func NewNamespaceUniverse(ctx context.Context, namespaces corev1.NamespaceController, labelValues func(ctx context.Context) ([]string, error)) *NamespaceUniverse {
+	u := &NamespaceUniverse{
+		namespaceCache: namespaces.Cache(),
+		labelValues:    labelValues,
+	}
+
+	namespaces.OnChange(ctx, "namespace-universe", func(key string, obj *k8scorev1.Namespace) (*k8scorev1.Namespace, error) {
+		if obj != nil {
+			u.add(obj.Name, obj.CreationTimestamp.Time)
+		}
+		return obj, nil
+	})
+
+	go u.run(ctx)
+
+	return u
+}
+
+// Namespaces returns the universe, or nil while the upstream namespace label values are unknown or outdated,
+// or older than the newest namespace of the cluster.
+// The returned set must not be modified.
+func (u *NamespaceUniverse) Namespaces() data.Set {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if u.values == nil || time.Since(u.refreshed) > universeMaxAge {
+		return nil
+	}
+	if !u.newest.Add(creationTimestampPrecision).Before(u.refreshed) {
+		return nil
+	}
+
+	return u.values
+}
+
+func (u *NamespaceUniverse) add(name string, created time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if created.After(u.newest) {
+		u.newest = created
+	}
+	if u.values == nil {
+		return
+	}
+	if _, exist := u.values[name]; exist {
+		return
+	}
+
+	// copy on write, the previous set may be in use
+	values := make(data.Set, len(u.values)+1)
+	for value := range u.values {
+		values[value] = struct{}{}
+	}
+	values[name] = struct{}{}
+	u.values = values
+}
+
+func (u *NamespaceUniverse) run(ctx context.Context) {
+	ticker := time.NewTicker(universeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		u.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *NamespaceUniverse) refresh(ctx context.Context) {
+	// the label values hold the series of the namespaces created before they are requested
+	requested := time.Now()
+	upstream, err := u.labelValues(ctx)
+	if err != nil {
+		log.WithError(err).Warn("unable to refresh the upstream namespace label values")
+		return
+	}
+	values := data.NewSet(upstream...)
+
+	// listing under the lock, the namespaces created meanwhile are added after
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	objs, err := u.namespaceCache.List(labels.Everything())
+	if err != nil {
+		log.WithError(err).Warn("unable to list the namespaces")
+		return
+	}
+	var newest time.Time
+	for _, obj := range objs {
+		values[obj.Name] = struct{}{}
+		if obj.CreationTimestamp.After(newest) {
+			newest = obj.CreationTimestamp.Time
+		}
+	}
+
+	u.values = values
+	u.refreshed = requested
+	u.newest = newest
+}
@@ -0,0 +1,108 @@
+// +build test
+
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+
+	"github.com/juju/errors"
+	k8scorev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type fakeNamespaceCache struct {
+	corev1.NamespaceCache
+
+	names   []string
+	created map[string]time.Time
+}
+
+func (f *fakeNamespaceCache) List(_ labels.Selector) ([]*k8scorev1.Namespace, error) {
+	ret := make([]*k8scorev1.Namespace, 0, len(f.names))
+	for _, name := range f.names {
+		ret = append(ret, &k8scorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(f.created[name])}})
+	}
+
+	return ret, nil
+}
+
+func TestNamespaceUniverse(t *testing.T) {
+	var labelValuesErr error
+	u := &NamespaceUniverse{
+		namespaceCache: &fakeNamespaceCache{names: []string{"ns-a", "ns-b"}},
+		labelValues: func(ctx context.Context) ([]string, error) {
+			// ns-deleted is gone from the cluster, but its series are retained
+			return []string{"ns-a", "ns-deleted"}, labelValuesErr
+		},
+	}
+
+	if got := u.Namespaces(); got != nil {
+		t.Errorf("expected no universe before the first refresh, got %v", got)
+	}
+	u.add("ns-c", time.Time{})
+	if got := u.Namespaces(); got != nil {
+		t.Errorf("expected no universe before the first refresh, got %v", got)
+	}
+
+	u.refresh(context.Background())
+	if got := u.Namespaces().String(); got != "ns-a,ns-b,ns-deleted" {
+		t.Errorf("expected the namespaces of the cluster and the upstream, got %s", got)
+	}
+
+	previous := u.Namespaces()
+	u.add("ns-c", time.Time{})
+	if got := u.Namespaces().String(); got != "ns-a,ns-b,ns-c,ns-deleted" {
+		t.Errorf("expected the created namespace added, got %s", got)
+	}
+	if got := previous.String(); got != "ns-a,ns-b,ns-deleted" {
+		t.Errorf("expected the previous universe unchanged, got %s", got)
+	}
+
+	labelValuesErr = errors.New("upstream unavailable")
+	u.refresh(context.Background())
+	if got := u.Namespaces().String(); got != "ns-a,ns-b,ns-c,ns-deleted" {
+		t.Errorf("expected the universe kept after a failed refresh, got %s", got)
+	}
+
+	u.mu.Lock()
+	u.refreshed = time.Now().Add(-universeMaxAge - time.Second)
+	u.mu.Unlock()
+	u.refresh(context.Background())
+	if got := u.Namespaces(); got != nil {
+		t.Errorf("expected no universe once the refresh fails past its max age, got %v", got)
+	}
+
+	labelValuesErr = nil
+	u.refresh(context.Background())
+	if got := u.Namespaces().String(); got != "ns-a,ns-b,ns-deleted" {
+		t.Errorf("expected the universe back after a successful refresh, got %s", got)
+	}
+
+	// the series of a namespace created since the refresh are not in the label values yet
+	u.add("ns-new", time.Now())
+	if got := u.Namespaces(); got != nil {
+		t.Errorf("expected no universe while a namespace is newer than the refresh, got %v", got)
+	}
+	cache := u.namespaceCache.(*fakeNamespaceCache)
+	cache.names = append(cache.names, "ns-new")
+	cache.created = map[string]time.Time{"ns-new": time.Now()}
+	u.refresh(context.Background())
+	if got := u.Namespaces(); got != nil {
+		t.Errorf("expected no universe while a namespace is as new as the refresh, got %v", got)
+	}
+	cache.created["ns-new"] = time.Now().Add(-time.Minute)
+	u.refresh(context.Background())
+	if got := u.Namespaces().String(); got != "ns-a,ns-b,ns-deleted,ns-new" {
+		t.Errorf("expected the universe back after a refresh newer than the namespaces, got %s", got)
+	}
+
+	var disabled *NamespaceUniverse
+	if got := disabled.Namespaces(); got != nil {
+		t.Errorf("expected no universe when disabled, got %v", got)
+	}
+}
@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	maxWebhookResponseBytes = 4 << 20
+)
+
+type WebhookConfig struct {
+	// URL receives the user as a JSON POST and answers the allowed namespaces.
+	URL string
+	// Timeout bounds every call, the user is allowed no namespace after it.
+	Timeout time.Duration
+	// CacheTTL is how long an answer is reused for the same user and groups.
+	CacheTTL time.Duration
+}
+
+type webhookRequest struct {
+	Name   string              `json:"name"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+type webhookResponse struct {
+	Namespaces []string `json:"namespaces"`
+}
+
+type webhookCacheEntry struct {
+	namespaces data.Set
+	expiresAt  time.Time
+}
+
+type webhookNamespaces struct {
+	cfg    WebhookConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]webhookCacheEntry
+}
+
+// NewWebhookNamespaces resolves the accessible namespaces of a user by an external HTTP endpoint,
+// it fails closed, the user is allowed no namespace if the endpoint can't answer.
+func NewWebhookNamespaces(ctx context.Context, cfg WebhookConfig) (Namespaces, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, errors.Errorf("invalid namespace webhook URL %q", cfg.URL)
+	}
+	if cfg.Timeout <= 0 {
+		return nil, errors.Errorf("invalid namespace webhook timeout %v, must be positive", cfg.Timeout)
+	}
+
+	n := &webhookNamespaces{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cache:  make(map[string]webhookCacheEntry),
+	}
+
+	if cfg.CacheTTL > 0 {
+		go n.gc(ctx)
+	}
+
+	return n, nil
+}
+
+func (n *webhookNamespaces) QueryByUser(info *user.DefaultInfo) data.Set {
+	key := webhookCacheKey(info)
+	now := time.Now()
+
+	n.mu.Lock()
+	entry, exist := n.cache[key]
+	n.mu.Unlock()
+	if exist && now.Before(entry.expiresAt) {
+		return entry.namespaces
+	}
+
+	ret, err := n.query(info)
+	if err != nil {
+		log.Warnln("failed to query Namespaces from webhook", errors.ErrorStack(err))
+		return data.Set{}
+	}
+
+	if n.cfg.CacheTTL > 0 {
+		n.mu.Lock()
+		n.cache[key] = webhookCacheEntry{namespaces: ret, expiresAt: now.Add(n.cfg.CacheTTL)}
+		n.mu.Unlock()
+	}
+
+	return ret
+}
+
+func (n *webhookNamespaces) query(info *user.DefaultInfo) (data.Set, error) {
+	body, err := json.Marshal(&webhookRequest{
+		Name:   info.Name,
+		UID:    info.UID,
+		Groups: info.Groups,
+		Extra:  info.Extra,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to call namespace webhook for %q", info.Name)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("namespace webhook answered %d for %q", resp.StatusCode, info.Name)
+	}
+
+	var answer webhookResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponseBytes)).Decode(&answer); err != nil {
+		return nil, errors.Annotatef(err, "unable to decode namespace webhook answer for %q", info.Name)
+	}
+
+	ret := make(data.Set, len(answer.Namespaces))
+	for _, ns := range answer.Namespaces {
+		if ns != "" {
+			ret[ns] = struct{}{}
+		}
+	}
+
+	return ret, nil
+}
+
+func (n *webhookNamespaces) gc(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.CacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			for key, entry := range n.cache {
+				if !now.Before(entry.expiresAt) {
+					delete(n.cache, key)
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func webhookCacheKey(info *user.DefaultInfo) string {
+	groups := append([]string(nil), info.Groups...)
+	sort.Strings(groups)
+
+	return info.Name + "\x00" + strings.Join(groups, "\x00")
+}
@@ -0,0 +1,113 @@
+// +build test
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type staticNamespaces data.Set
+
+func (s staticNamespaces) QueryByUser(info *user.DefaultInfo) data.Set {
+	return data.Set(s)
+}
+
+func TestWebhookNamespaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		var req webhookRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Name {
+		case "alice":
+			json.NewEncoder(w).Encode(&webhookResponse{Namespaces: append([]string{"ns-alice"}, req.Groups...)})
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			json.NewEncoder(w).Encode(&webhookResponse{Namespaces: []string{"ns-slow"}})
+		default:
+			http.Error(w, "unknown user", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := NewWebhookNamespaces(ctx, WebhookConfig{URL: server.URL, Timeout: 50 * time.Millisecond, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &user.DefaultInfo{Name: "alice", Groups: []string{"team-b", "team-a"}}
+	expected := data.NewSet("ns-alice", "team-a", "team-b")
+	for i := 0; i < 3; i++ {
+		if got := webhook.QueryByUser(alice); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+	if got := webhook.QueryByUser(&user.DefaultInfo{Name: "alice", Groups: []string{"team-a", "team-b"}}); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected a cached answer, got %d webhook calls", calls)
+	}
+
+	if got := webhook.QueryByUser(&user.DefaultInfo{Name: "slow"}); len(got) != 0 {
+		t.Errorf("expected no namespace after timeout, got %v", got)
+	}
+	if got := webhook.QueryByUser(&user.DefaultInfo{Name: "bob"}); len(got) != 0 {
+		t.Errorf("expected no namespace after failure, got %v", got)
+	}
+
+	if _, err := NewWebhookNamespaces(ctx, WebhookConfig{URL: "cmdb.local/namespaces"}); err == nil {
+		t.Error("expected error for invalid URL")
+	}
+	if _, err := NewWebhookNamespaces(ctx, WebhookConfig{URL: server.URL}); err == nil {
+		t.Error("expected error for no timeout")
+	}
+}
+
+func TestComposeNamespaces(t *testing.T) {
+	rbac := staticNamespaces(data.NewSet("a", "b", "c"))
+	webhook := staticNamespaces(data.NewSet("b", "c", "d"))
+	info := &user.DefaultInfo{Name: "alice"}
+
+	cases := []struct {
+		mode     string
+		expected data.Set
+	}{
+		{mode: NamespacesUnion, expected: data.NewSet("a", "b", "c", "d")},
+		{mode: NamespacesIntersection, expected: data.NewSet("b", "c")},
+	}
+
+	for _, c := range cases {
+		composed, err := ComposeNamespaces(c.mode, rbac, webhook)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := composed.QueryByUser(info); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.mode, c.expected, got)
+		}
+	}
+
+	if _, err := ComposeNamespaces("replace", rbac, webhook); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
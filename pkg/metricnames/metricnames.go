@@ -0,0 +1,316 @@
+package metricnames
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/prom"
+
+	"github.com/juju/errors"
+	promapi "github.com/prometheus/client_golang/api"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Strategies listing the metric names of the namespaces.
+const (
+	// StrategyLabelValues lists the values of __name__ matching the namespaces, since Prometheus 2.24.
+	StrategyLabelValues = "label-values"
+	// StrategySeries lists the series of the namespaces, reading the index only.
+	StrategySeries = "series"
+	// StrategyCount counts the series of the namespaces by metric name, reading their samples.
+	StrategyCount = "count"
+)
+
+const (
+	epBuildinfo   = "/api/v1/status/buildinfo"
+	epLabelValues = "/api/v1/label/__name__/values"
+	epSeries      = "/api/v1/series"
+
+	// detectInterval re-detects the strategy, as the upstream may be upgraded.
+	detectInterval = 10 * time.Minute
+)
+
+var (
+	listings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "metric_names_listings_total",
+			Help:      "Number of the metric names listings by strategy (label-values, series or count) and result (hit, miss or error).",
+		},
+		[]string{"strategy", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(listings)
+}
+
+type entry struct {
+	names   []string
+	expires time.Time
+}
+
+// Lister lists the metric names of the series in a set of namespaces,
+// through the cheapest endpoint the upstream supports.
+type Lister struct {
+	client    promapi.Client
+	remoteAPI promapiv1.API
+	ttl       time.Duration
+
+	mu       sync.RWMutex
+	strategy string
+	detected time.Time
+	entries  map[string]entry
+	group    singleflight.Group
+}
+
+// NewLister caches the listings for the TTL, a TTL of zero disables the caching.
+func NewLister(ctx context.Context, client promapi.Client, ttl time.Duration) *Lister {
+	l := &Lister{
+		client:    client,
+		remoteAPI: promapiv1.NewAPI(client),
+		ttl:       ttl,
+		entries:   make(map[string]entry),
+	}
+
+	if ttl > 0 {
+		go l.gc(ctx)
+	}
+
+	return l
+}
+
+// Names returns the sorted metric names of the series in the namespaces between start and end,
+// a zero start or end is unbounded. The bounds are widened to the TTL, so that the close listings share the cache.
+func (l *Lister) Names(ctx context.Context, namespaces []string, start, end time.Time) ([]string, error) {
+	if l.ttl > 0 {
+		if !start.IsZero() {
+			start = start.Truncate(l.ttl)
+		}
+		if !end.IsZero() && !end.Equal(end.Truncate(l.ttl)) {
+			end = end.Truncate(l.ttl).Add(l.ttl)
+		}
+	}
+
+	strategy := l.detect(ctx)
+	key := strings.Join([]string{strategy, strings.Join(namespaces, ","), timeKey(start), timeKey(end)}, "\x00")
+
+	l.mu.RLock()
+	e, exist := l.entries[key]
+	l.mu.RUnlock()
+	if exist && time.Now().Before(e.expires) {
+		listings.WithLabelValues(strategy, "hit").Inc()
+		return e.names, nil
+	}
+
+	ret, err, _ := l.group.Do(key, func() (interface{}, error) {
+		names, err := l.list(ctx, strategy, prom.NewInstantVectorSelectorsForNamespaces(namespaces), start, end)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+
+		if l.ttl > 0 {
+			l.mu.Lock()
+			l.entries[key] = entry{names: names, expires: time.Now().Add(l.ttl)}
+			l.mu.Unlock()
+		}
+
+		return names, nil
+	})
+	if err != nil {
+		listings.WithLabelValues(strategy, "error").Inc()
+		return nil, err
+	}
+	listings.WithLabelValues(strategy, "miss").Inc()
+
+	return ret.([]string), nil
+}
+
+func (l *Lister) list(ctx context.Context, strategy, selector string, start, end time.Time) ([]string, error) {
+	args := url.Values{"match[]": []string{selector}}
+	if !start.IsZero() {
+		args.Set("start", formatTime(start))
+	}
+	if !end.IsZero() {
+		args.Set("end", formatTime(end))
+	}
+
+	switch strategy {
+	case StrategyLabelValues:
+		var names []string
+		if err := l.get(ctx, epLabelValues, args, &names); err != nil {
+			return nil, errors.Annotate(err, "unable to list the metric name values")
+		}
+		return names, nil
+	case StrategySeries:
+		var series []model.LabelSet
+		if err := l.get(ctx, epSeries, args, &series); err != nil {
+			return nil, errors.Annotate(err, "unable to list the series")
+		}
+
+		seen := make(map[model.LabelValue]struct{})
+		names := make([]string, 0)
+		for _, labelSet := range series {
+			name := labelSet[model.MetricNameLabel]
+			if _, exist := seen[name]; !exist {
+				seen[name] = struct{}{}
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+
+	// the series present at the end only, the count cannot span a range
+	val, _, err := l.remoteAPI.Query(ctx, "count ("+selector+") by (__name__)", end)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to count the series by metric name")
+	}
+
+	vector, ok := val.(model.Vector)
+	if !ok {
+		return nil, errors.Errorf("unexpected result type %q counting the series by metric name", val.Type())
+	}
+
+	names := make([]string, 0, len(vector))
+	for _, sample := range vector {
+		names = append(names, string(sample.Metric[model.MetricNameLabel]))
+	}
+	return names, nil
+}
+
+// detect returns the strategy supported by the upstream version, from its build information.
+func (l *Lister) detect(ctx context.Context) string {
+	l.mu.RLock()
+	strategy, detected := l.strategy, l.detected
+	l.mu.RUnlock()
+	if strategy != "" && time.Since(detected) < detectInterval {
+		return strategy
+	}
+
+	ret, _, _ := l.group.Do(epBuildinfo, func() (interface{}, error) {
+		var buildinfo struct {
+			Version string `json:"version"`
+		}
+
+		err := l.get(ctx, epBuildinfo, nil, &buildinfo)
+		switch {
+		case err == nil:
+			strategy = strategyOf(buildinfo.Version)
+		case errors.IsNotFound(err):
+			// older than Prometheus 2.14
+			strategy = StrategyCount
+		default:
+			log.WithError(err).Warn("unable to detect the upstream version, counting the series by metric name")
+			return StrategyCount, nil
+		}
+
+		log.Debugf("listing the metric names by %s for the upstream version %q", strategy, buildinfo.Version)
+		l.mu.Lock()
+		l.strategy, l.detected = strategy, time.Now()
+		l.mu.Unlock()
+
+		return strategy, nil
+	})
+
+	return ret.(string)
+}
+
+// get decodes the data of a successful API response.
+func (l *Lister) get(ctx context.Context, ep string, args url.Values, data interface{}) error {
+	u := l.client.URL(ep, nil)
+	u.RawQuery = args.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, body, err := l.client.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.NotFoundf("%s", ep)
+	}
+
+	var result struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return errors.Annotatef(err, "unable to decode the response of %s with status %d", ep, resp.StatusCode)
+	}
+	if result.Status != "success" {
+		return errors.Errorf("%s failed with status %d: %s", ep, resp.StatusCode, result.Error)
+	}
+
+	return json.Unmarshal(result.Data, data)
+}
+
+func (l *Lister) gc(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, e := range l.entries {
+				if !now.Before(e.expires) {
+					delete(l.entries, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// strategyOf the version, an unknown version has the build information so it is at least Prometheus 2.14.
+func strategyOf(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return StrategySeries
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return StrategySeries
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return StrategySeries
+	}
+
+	if major > 2 || (major == 2 && minor >= 24) {
+		return StrategyLabelValues
+	}
+
+	return StrategySeries
+}
+
+func timeKey(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
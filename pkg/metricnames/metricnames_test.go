@@ -0,0 +1,114 @@
+// +build test
+
+package metricnames
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+)
+
+type fakeUpstream struct {
+	version  string
+	requests []*http.Request
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case epBuildinfo:
+		if f.version == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"version":"` + f.version + `"}}`))
+	case epLabelValues:
+		w.Write([]byte(`{"status":"success","data":["up","node_load1"]}`))
+	case epSeries:
+		w.Write([]byte(`{"status":"success","data":[{"__name__":"up","namespace":"ns-a"},{"__name__":"up","namespace":"ns-b"},{"__name__":"node_load1","namespace":"ns-a"}]}`))
+	case "/api/v1/query":
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"2"]}]}}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLister(t *testing.T) {
+	cases := []struct {
+		version  string
+		strategy string
+		expected []string
+	}{
+		{"2.26.0", StrategyLabelValues, []string{"node_load1", "up"}},
+		{"2.19.2", StrategySeries, []string{"node_load1", "up"}},
+		{"", StrategyCount, []string{"up"}},
+	}
+
+	for _, c := range cases {
+		upstream := &fakeUpstream{version: c.version}
+		server := httptest.NewServer(upstream)
+
+		client, err := promapi.NewClient(promapi.Config{Address: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := NewLister(context.Background(), client, time.Minute)
+
+		start, end := time.Unix(3630, 0), time.Unix(7170, 0)
+		for i := 0; i < 2; i++ {
+			names, err := l.Names(context.Background(), []string{"ns-a", "ns-b"}, start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, c.expected) {
+				t.Errorf("%q => expected %v, got %v", c.version, c.expected, names)
+			}
+		}
+		server.Close()
+
+		if l.strategy != c.strategy {
+			t.Errorf("%q => expected the strategy %s, got %s", c.version, c.strategy, l.strategy)
+		}
+		if len(upstream.requests) != 2 {
+			t.Fatalf("%q => expected the build information and a single cached listing, got %d requests", c.version, len(upstream.requests))
+		}
+
+		listing := upstream.requests[1]
+		if c.strategy == StrategyCount {
+			continue
+		}
+		if match := listing.URL.Query().Get("match[]"); match != `{namespace=~"ns-a|ns-b"}` {
+			t.Errorf("%q => unexpected selector %s", c.version, match)
+		}
+		// widened to the TTL
+		if listing.URL.Query().Get("start") != "3600" || listing.URL.Query().Get("end") != "7200" {
+			t.Errorf("%q => unexpected range %s", c.version, listing.URL.RawQuery)
+		}
+	}
+}
+
+func TestStrategyOf(t *testing.T) {
+	cases := map[string]string{
+		"2.24.0":          StrategyLabelValues,
+		"2.30.3":          StrategyLabelValues,
+		"3.0.0":           StrategyLabelValues,
+		"2.23.0":          StrategySeries,
+		"2.14.0":          StrategySeries,
+		"":                StrategySeries,
+		"2.x":             StrategySeries,
+		"2.25.0-rc.0+abc": StrategyLabelValues,
+	}
+
+	for version, expected := range cases {
+		if strategy := strategyOf(version); strategy != expected {
+			t.Errorf("%q => expected %s, got %s", version, expected, strategy)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package prom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+const (
+	// matcherCacheSize bounds the compiled namespace matchers and regular expressions.
+	matcherCacheSize = 1024
+)
+
+var (
+	matchers = newLRU(matcherCacheSize)
+)
+
+// ExpressionCache caches the parsed expressions, and their rewrites for the recent sets of namespaces.
+type ExpressionCache struct {
+	parsed    *lru
+	rewritten *lru
+
+	mu             sync.Mutex
+	universe       data.Set
+	universeDigest string
+}
+
+func NewExpressionCache(size int) *ExpressionCache {
+	return &ExpressionCache{
+		parsed:    newLRU(size),
+		rewritten: newLRU(size),
+	}
+}
+
+// Parse returns the parsed expression, which is shared and must not be modified.
+func (c *ExpressionCache) Parse(rawValue string) (parser.Expr, error) {
+	if c == nil {
+		return parser.ParseExpr(rawValue)
+	}
+
+	if expr, exist := c.parsed.get(rawValue); exist {
+		return expr.(parser.Expr), nil
+	}
+
+	expr, err := parser.ParseExpr(rawValue)
+	if err != nil {
+		return nil, err
+	}
+	c.parsed.add(rawValue, expr)
+
+	return expr, nil
+}
+
+type rewritten struct {
+	hjkValue string
+	empty    bool
+}
+
+// Rewrite returns the expression restricted to the namespaces, like ModifyExpressionWithin,
+// without its provably empty subexpressions, and tells whether the whole expression is provably empty, see Simplify.
+func (c *ExpressionCache) Rewrite(rawValue string, namespaceSet, universe data.Set) (string, bool, error) {
+	if c == nil {
+		return rewrite(rawValue, namespaceSet, universe)
+	}
+
+	key := rawValue + "\x00" + digest(namespaceSet) + "\x00" + c.digestUniverse(universe)
+	if ret, exist := c.rewritten.get(key); exist {
+		return ret.(rewritten).hjkValue, ret.(rewritten).empty, nil
+	}
+
+	hjkValue, empty, err := rewrite(rawValue, namespaceSet, universe)
+	if err != nil {
+		return "", false, err
+	}
+	c.rewritten.add(key, rewritten{hjkValue: hjkValue, empty: empty})
+
+	return hjkValue, empty, nil
+}
+
+// digestUniverse remembers the digest of the last universe, which is replaced on change and never modified.
+// The last universe is referenced, so that its address is not reused by another set.
+func (c *ExpressionCache) digestUniverse(universe data.Set) string {
+	if universe == nil {
+		return digest(nil)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reflect.ValueOf(c.universe).Pointer() != reflect.ValueOf(universe).Pointer() {
+		c.universe, c.universeDigest = universe, digest(universe)
+	}
+
+	return c.universeDigest
+}
+
+func rewrite(rawValue string, namespaceSet, universe data.Set) (string, bool, error) {
+	// the rewrite modifies the expression, it cannot be shared
+	expr, err := parser.ParseExpr(rawValue)
+	if err != nil {
+		return "", false, err
+	}
+	ModifyExpressionWithin(expr, namespaceSet, universe)
+
+	expr, empty := Simplify(expr)
+	return expr.String(), empty, nil
+}
+
+func digest(set data.Set) string {
+	if set == nil {
+		return "nil"
+	}
+
+	sum := sha256.Sum256([]byte(set.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// newMatcher shares the regular expressions compiled for the same namespace matcher.
+func newMatcher(mType promlb.MatchType, name, value string) (*promlb.Matcher, error) {
+	if mType != promlb.MatchRegexp && mType != promlb.MatchNotRegexp {
+		return promlb.NewMatcher(mType, name, value)
+	}
+
+	key := fmt.Sprintf("matcher\x00%d\x00%s\x00%s", mType, name, value)
+	if m, exist := matchers.get(key); exist {
+		return m.(*promlb.Matcher), nil
+	}
+
+	m, err := promlb.NewMatcher(mType, name, value)
+	if err != nil {
+		return nil, err
+	}
+	matchers.add(key, m)
+
+	return m, nil
+}
+
+// compileRegexp shares the anchored regular expressions compiled for the same remote read matcher value.
+func compileRegexp(value string) (*regexp.Regexp, error) {
+	key := "regexp\x00" + value
+	if re, exist := matchers.get(key); exist {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", value))
+	if err != nil {
+		return nil, err
+	}
+	matchers.add(key, re)
+
+	return re, nil
+}
@@ -0,0 +1,129 @@
+// +build test
+
+package prom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+const (
+	benchmarkQuery = `sum by (pod) (rate(container_cpu_usage_seconds_total{namespace=~"team-.*",container!=""}[5m])) / on (pod) group_left sum by (pod) (kube_pod_container_resource_requests_cpu_cores)`
+)
+
+func benchmarkNamespaces(n int) data.Set {
+	set := make(data.Set, n)
+	for i := 0; i < n; i++ {
+		set[fmt.Sprintf("team-%d-prod", i)] = struct{}{}
+	}
+
+	return set
+}
+
+func TestExpressionCache(t *testing.T) {
+	c := NewExpressionCache(2)
+
+	expr, err := c.Parse("up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := c.Parse("up"); cached != expr {
+		t.Error("expected the parsed expression to be shared")
+	}
+	if _, err := c.Parse("invalid][query"); err == nil {
+		t.Error("expected a parse error")
+	}
+
+	universe := data.NewSet("ns-a", "ns-b", "ns-c", "deleted")
+	cases := []struct {
+		namespaceSet data.Set
+		universe     data.Set
+	}{
+		{data.NewSet("ns-a", "ns-b"), nil},
+		{data.NewSet("ns-a"), nil},
+		{data.NewSet(), nil},
+		{data.NewSet("ns-a", "ns-b", "ns-c"), universe},
+		{data.NewSet("ns-a", "ns-b", "ns-c"), data.NewSet("ns-a", "ns-b", "ns-c")},
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, cs := range cases {
+			for _, rawValue := range []string{benchmarkQuery, `up{namespace!="ns-a"}`} {
+				hjkValue, empty, err := c.Rewrite(rawValue, cs.namespaceSet, cs.universe)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expr, _ := parser.ParseExpr(rawValue)
+				ModifyExpressionWithin(expr, cs.namespaceSet, cs.universe)
+				expr, expectedEmpty := Simplify(expr)
+				if expected := expr.String(); hjkValue != expected || empty != expectedEmpty {
+					t.Errorf("%s in %s => expected %s (empty %v), got %s (empty %v)", rawValue, cs.namespaceSet, expected, expectedEmpty, hjkValue, empty)
+				}
+			}
+		}
+	}
+
+	// the parsed expression is not modified by the rewrites
+	if expr.String() != "up" {
+		t.Errorf("expected the shared expression to be unchanged, got %s", expr)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", 1)
+	c.add("b", 2)
+	c.get("a")
+	c.add("c", 3)
+
+	if _, exist := c.get("b"); exist {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if v, exist := c.get("a"); !exist || v != 1 {
+		t.Error("expected the recently used entry to be kept")
+	}
+	if v, exist := c.get("c"); !exist || v != 3 {
+		t.Error("expected the added entry to be kept")
+	}
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	namespaceSet := benchmarkNamespaces(200)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		expr, err := parser.ParseExpr(benchmarkQuery)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ModifyExpressionWithin(expr, namespaceSet, nil)
+	}
+}
+
+func BenchmarkRewriteCached(b *testing.B) {
+	namespaceSet := benchmarkNamespaces(200)
+	c := NewExpressionCache(100)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Parse(benchmarkQuery); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := c.Rewrite(benchmarkQuery, namespaceSet, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNamespaceMatcher(b *testing.B) {
+	namespaces := benchmarkNamespaces(200).Values()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		createMatcher(namespaceMatchName, namespaces, nil)
+	}
+}
@@ -11,33 +11,45 @@ const (
 )
 
 func FilterMatchers(namespaceSet data.Set, srcMatchers []*promlb.Matcher) []*promlb.Matcher {
+	return FilterMatchersWithin(namespaceSet, nil, srcMatchers)
+}
+
+// FilterMatchersWithin restricts the matchers to the namespaces like FilterMatchers,
+// the namespace matcher may exclude the other namespaces of the universe when it is shorter.
+func FilterMatchersWithin(namespaceSet, universe data.Set, srcMatchers []*promlb.Matcher) []*promlb.Matcher {
 	for _, m := range srcMatchers {
 		name := m.Name
 
 		if name == namespaceMatchName {
-			translateMatcher(namespaceSet, m)
+			translateMatcher(namespaceSet, universe, m)
 			return srcMatchers
 		}
 	}
 
 	// append namespace match
-	srcMatchers = append(srcMatchers, createMatcher(namespaceMatchName, namespaceSet.Values()))
+	srcMatchers = append(srcMatchers, createMatcher(namespaceMatchName, namespaceSet.Values(), universe))
 
 	return srcMatchers
 }
 
 func FilterLabelMatchers(namespaceSet data.Set, srcMatchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
+	return FilterLabelMatchersWithin(namespaceSet, nil, srcMatchers)
+}
+
+// FilterLabelMatchersWithin restricts the remote read matchers to the namespaces like FilterLabelMatchers,
+// the namespace matcher may exclude the other namespaces of the universe when it is shorter.
+func FilterLabelMatchersWithin(namespaceSet, universe data.Set, srcMatchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
 	for _, m := range srcMatchers {
 		name := m.Name
 
 		if name == namespaceMatchName {
-			translateLabelMatcher(namespaceSet, m)
+			translateLabelMatcher(namespaceSet, universe, m)
 			return srcMatchers
 		}
 	}
 
 	// append namespace match
-	srcMatchers = append(srcMatchers, createLabelMatcher(namespaceMatchName, namespaceSet.Values()))
+	srcMatchers = append(srcMatchers, createLabelMatcher(namespaceMatchName, namespaceSet.Values(), universe))
 
 	return srcMatchers
 }
@@ -200,3 +200,124 @@ func walkExpr(name, input, expect string, change func([]*labels.Matcher) ([]*lab
 	fmt.Printf("[passed] %s => %v \n", input, output)
 	return nil
 }
+
+func TestFactor(t *testing.T) {
+	cases := []struct {
+		input  []string
+		expect string
+	}{
+		{[]string{"team-b", "team-a-prod", "team-a-dev"}, `team-(?:a-(?:dev|prod)|b)`},
+		{[]string{"a", "ab", "b"}, `a(?:|b)|b`},
+		{[]string{"", "x.y", "x.z"}, `|x\.(?:y|z)`},
+		{[]string{"ns-a", "ns-a"}, `ns-a`},
+		{[]string{"èxyz-1", "éxyz-1", "éxyz-2"}, `èxyz-1|éxyz-(?:1|2)`},
+		{[]string{"xè", "xé"}, `x(?:è|é)`},
+	}
+
+	for _, c := range cases {
+		if output := factor(c.input); output != c.expect {
+			t.Errorf("%v => %s, but get %s", c.input, c.expect, output)
+		}
+	}
+
+	// the namespaces sharing the first byte of a multi-byte rune are not factored within the rune
+	namespaces := data.NewSet("èxyz-aaaaaaa1", "éxyz-aaaaaaa1", "éxyz-aaaaaaa2")
+	expr, err := parser.ParseExpr("up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, expect := ModifyExpression(expr, namespaces), `up{namespace=~"èxyz-aaaaaaa1|éxyz-aaaaaaa(?:1|2)"}`; output != expect {
+		t.Errorf("%v => %s, but get %s", namespaces, expect, output)
+	}
+}
+
+func TestFilterMatchersWithin(t *testing.T) {
+	universe := data.NewSet("ns-a", "ns-b", "rx-c", "team-a-dev", "team-a-prod", "team-a-stage", "team-b-dev", "deleted")
+	namespaceSet := data.NewSet("ns-a", "ns-b", "rx-c", "team-a-dev", "team-a-prod", "team-a-stage", "team-b-dev")
+
+	cases := []struct {
+		name      string
+		input     string
+		expect    string
+		namespace data.Set
+		universe  data.Set
+	}{
+		{
+			"complement",
+			`a`,
+			`a{namespace!~"|deleted"}`,
+			namespaceSet,
+			universe,
+		},
+		{
+			"complement of regex",
+			`a{namespace=~"team-.*"}`,
+			`a{namespace!~"|deleted|ns-(?:a|b)|rx-c"}`,
+			namespaceSet,
+			universe,
+		},
+		{
+			"all namespaces",
+			`a`,
+			`a{namespace!=""}`,
+			universe,
+			universe,
+		},
+		{
+			"prefix factored without universe",
+			`a{namespace=~"team-.*"}`,
+			`a{namespace=~"team-(?:a-(?:dev|prod|stage)|b-dev)"}`,
+			namespaceSet,
+			nil,
+		},
+		{
+			"alternation",
+			`a{namespace!="ns-a"}`,
+			`a{namespace=~"ns-b|rx-c"}`,
+			data.NewSet("ns-a", "ns-b", "rx-c"),
+			universe,
+		},
+	}
+
+	errs := make([]error, 0, len(cases))
+	for _, c := range cases {
+		err := walkExpr(c.name, c.input, c.expect, func(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+			return FilterMatchersWithin(c.namespace, c.universe, matchers), nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		err = walkExpr(c.name, c.input, c.expect, func(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+			lm, err := toLabelMatchers(matchers)
+			if err != nil {
+				return nil, err
+			}
+
+			return fromLabelMatchers(FilterLabelMatchersWithin(c.namespace, c.universe, lm))
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		for _, err := range errs {
+			t.Log(err)
+		}
+
+		t.Fail()
+	}
+
+	// every form selects exactly the namespaces, never the ones out of the universe or the series without namespace
+	for _, namespaces := range [][]string{{"ns-a", "ns-b"}, namespaceSet.Values(), universe.Values()} {
+		matcher := createMatcher(namespaceMatchName, namespaces, universe)
+		selected := data.NewSet(namespaces...)
+
+		for _, ns := range append(universe.Values(), "") {
+			if _, expect := selected[ns]; matcher.Matches(ns) != expect {
+				t.Errorf("%s matches %q: %v", matcher, ns, !expect)
+			}
+		}
+	}
+}
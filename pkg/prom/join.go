@@ -1,7 +1,10 @@
 package prom
 
 import (
+	"regexp"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 func stringSliceIgnore(strSlice []string, ignore *string) []string {
@@ -24,3 +27,80 @@ func stringSliceFilter(strSlice []string, filter func(value *string) bool) []str
 func join(strSlice []string) string {
 	return strings.Join(strSlice, "|")
 }
+
+// factor joins the values into an alternation with their common prefixes factored out,
+// like "team-(?:a-(?:dev|prod)|b)" for "team-a-dev", "team-a-prod" and "team-b".
+func factor(strSlice []string) string {
+	values := make([]string, 0, len(strSlice))
+	values = append(values, strSlice...)
+	sort.Strings(values)
+
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+
+	return factorSorted(unique)
+}
+
+func factorSorted(values []string) string {
+	sb := &strings.Builder{}
+
+	for i := 0; i < len(values); {
+		if i > 0 {
+			sb.WriteString("|")
+		}
+
+		// the values sharing the first rune are consecutive
+		_, size := utf8.DecodeRuneInString(values[i])
+		j := i + 1
+		for size != 0 && j < len(values) && strings.HasPrefix(values[j], values[i][:size]) {
+			j++
+		}
+
+		if j-i == 1 {
+			sb.WriteString(regexp.QuoteMeta(values[i]))
+			i = j
+			continue
+		}
+
+		prefix := commonPrefix(values[i], values[j-1])
+		if len(prefix) < size {
+			// invalid UTF-8, the shared first byte is factored out
+			prefix = values[i][:size]
+		}
+		suffixes := make([]string, 0, j-i)
+		for _, value := range values[i:j] {
+			suffixes = append(suffixes, value[len(prefix):])
+		}
+
+		sb.WriteString(regexp.QuoteMeta(prefix))
+		sb.WriteString("(?:")
+		sb.WriteString(factorSorted(suffixes))
+		sb.WriteString(")")
+		i = j
+	}
+
+	return sb.String()
+}
+
+// commonPrefix of the first and the last of sorted values is the common prefix of all of them,
+// it never ends within a multi-byte rune, which would make the factored alternation invalid.
+func commonPrefix(first, last string) string {
+	size := len(first)
+	if len(last) < size {
+		size = len(last)
+	}
+
+	i := 0
+	for i < size && first[i] == last[i] {
+		i++
+	}
+	for i > 0 && i < len(first) && !utf8.RuneStart(first[i]) {
+		i--
+	}
+
+	return first[:i]
+}
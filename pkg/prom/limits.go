@@ -0,0 +1,133 @@
+package prom
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Limits bounds the cost of the queries of a tenant, a zero value means unlimited.
+type Limits struct {
+	// MaxRange is the maximum duration between the start and the end of a range query.
+	MaxRange time.Duration
+	// MaxLookback is the maximum duration a range selector looks back, including its enclosing subqueries.
+	MaxLookback time.Duration
+	// MinStep is the minimum resolution of a range query.
+	MinStep time.Duration
+	// MaxSelectors is the maximum number of series selectors in a query.
+	MaxSelectors int
+	// MaxDepth is the maximum depth of the syntax tree of a query.
+	MaxDepth int
+	// MaxQueryLength is the maximum length of a query.
+	MaxQueryLength int
+	// MaxSeries is the series budget of a query, estimated from the upstream series counts.
+	MaxSeries int
+}
+
+// CheckQuery verifies the length and the syntax tree of a query.
+func (l *Limits) CheckQuery(rawQuery string, expr parser.Expr) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.MaxQueryLength > 0 && len(rawQuery) > l.MaxQueryLength {
+		return errors.Errorf("query length of %d exceeds the maximum of %d", len(rawQuery), l.MaxQueryLength)
+	}
+
+	selectors, depth := 0, 0
+	err := parser.Walk(inspectFunc(func(node parser.Node, path []parser.Node) error {
+		if node == nil {
+			return nil
+		}
+
+		if len(path)+1 > depth {
+			depth = len(path) + 1
+		}
+
+		var lookback time.Duration
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			selectors++
+			return nil
+		case *parser.MatrixSelector:
+			lookback = n.Range
+		case *parser.SubqueryExpr:
+			lookback = n.Range
+		default:
+			return nil
+		}
+
+		for _, ancestor := range path {
+			if subquery, ok := ancestor.(*parser.SubqueryExpr); ok {
+				lookback += subquery.Range
+			}
+		}
+		if l.MaxLookback > 0 && lookback > l.MaxLookback {
+			return errors.Errorf("lookback of %s in %s exceeds the maximum of %s", model.Duration(lookback), node, model.Duration(l.MaxLookback))
+		}
+
+		return nil
+	}), expr, nil)
+	if err != nil {
+		return err
+	}
+
+	if l.MaxSelectors > 0 && selectors > l.MaxSelectors {
+		return errors.Errorf("%d series selectors exceed the maximum of %d", selectors, l.MaxSelectors)
+	}
+
+	if l.MaxDepth > 0 && depth > l.MaxDepth {
+		return errors.Errorf("query depth of %d exceeds the maximum of %d", depth, l.MaxDepth)
+	}
+
+	return nil
+}
+
+// CheckSelectors verifies the number and the length of the series selectors of the match[] parameters.
+func (l *Limits) CheckSelectors(rawSelectors []string) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.MaxSelectors > 0 && len(rawSelectors) > l.MaxSelectors {
+		return errors.Errorf("%d series selectors exceed the maximum of %d", len(rawSelectors), l.MaxSelectors)
+	}
+
+	for _, rawSelector := range rawSelectors {
+		if l.MaxQueryLength > 0 && len(rawSelector) > l.MaxQueryLength {
+			return errors.Errorf("series selector length of %d exceeds the maximum of %d", len(rawSelector), l.MaxQueryLength)
+		}
+	}
+
+	return nil
+}
+
+// CheckRange verifies the duration and the resolution of a range query.
+func (l *Limits) CheckRange(start, end time.Time, step time.Duration) error {
+	if l == nil {
+		return nil
+	}
+
+	if queryRange := end.Sub(start); l.MaxRange > 0 && queryRange > l.MaxRange {
+		return errors.Errorf("query range of %s exceeds the maximum of %s", model.Duration(queryRange), model.Duration(l.MaxRange))
+	}
+
+	if l.MinStep > 0 && step > 0 && step < l.MinStep {
+		return errors.Errorf("query resolution step of %s is below the minimum of %s", model.Duration(step), model.Duration(l.MinStep))
+	}
+
+	return nil
+}
+
+// inspectFunc is a parser.Visitor stopping the walk at the first error, unlike parser.Inspect.
+type inspectFunc func(parser.Node, []parser.Node) error
+
+func (f inspectFunc) Visit(node parser.Node, path []parser.Node) (parser.Visitor, error) {
+	if err := f(node, path); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,83 @@
+// +build test
+
+package prom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestLimitsCheckQuery(t *testing.T) {
+	limits := &Limits{
+		MaxLookback:    time.Hour,
+		MaxSelectors:   2,
+		MaxDepth:       5,
+		MaxQueryLength: 64,
+	}
+
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{`rate(a[5m])`, ""},
+		{`a + b`, ""},
+		{`max_over_time(rate(a[5m])[30m:1m])`, ""},
+		{`rate(a[2h])`, "lookback of 2h"},
+		{`max_over_time(rate(a[20m])[50m:1m])`, "lookback of 70m"},
+		{`a + b + c`, "3 series selectors"},
+		{`abs(abs(abs(abs(abs(a)))))`, "query depth of 6"},
+		{`a{job="` + strings.Repeat("x", 64) + `"}`, "query length of 73"},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = limits.CheckQuery(c.input, expr)
+		switch {
+		case c.expect == "" && err != nil:
+			t.Errorf("%s => unexpected error %v", c.input, err)
+		case c.expect != "" && (err == nil || !strings.Contains(err.Error(), c.expect)):
+			t.Errorf("%s => expected error %q, got %v", c.input, c.expect, err)
+		}
+	}
+
+	var unlimited *Limits
+	if err := unlimited.CheckQuery(`a + b + c`, nil); err != nil {
+		t.Errorf("expected no limit, got %v", err)
+	}
+}
+
+func TestLimitsCheckRange(t *testing.T) {
+	limits := &Limits{MaxRange: 24 * time.Hour, MinStep: 30 * time.Second}
+	end := time.Now()
+
+	if err := limits.CheckRange(end.Add(-time.Hour), end, time.Minute); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := limits.CheckRange(end.Add(-48*time.Hour), end, time.Minute); err == nil || !strings.Contains(err.Error(), "query range of 2d") {
+		t.Errorf("expected range error, got %v", err)
+	}
+	if err := limits.CheckRange(end.Add(-time.Hour), end, 15*time.Second); err == nil || !strings.Contains(err.Error(), "step of 15s") {
+		t.Errorf("expected step error, got %v", err)
+	}
+}
+
+func TestLimitsCheckSelectors(t *testing.T) {
+	limits := &Limits{MaxSelectors: 1, MaxQueryLength: 8}
+
+	if err := limits.CheckSelectors([]string{`up`}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := limits.CheckSelectors([]string{`up`, `a`}); err == nil {
+		t.Error("expected selectors error")
+	}
+	if err := limits.CheckSelectors([]string{`up{job="x"}`}); err == nil {
+		t.Error("expected length error")
+	}
+}
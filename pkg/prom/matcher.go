@@ -5,59 +5,100 @@ import (
 
 	promlb "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
 )
 
 const (
 	noneNamespace = "______"
 )
 
-func createMatcher(matcherName string, namespaces []string) *promlb.Matcher {
+func createMatcher(matcherName string, namespaces []string, universe data.Set) *promlb.Matcher {
 	ret := &promlb.Matcher{
 		Name: matcherName,
 	}
 
-	modifyMatcher(ret, namespaces)
+	modifyMatcher(ret, namespaces, universe)
 
 	return ret
 }
 
-func createLabelMatcher(matcherName string, namespaces []string) *prompb.LabelMatcher {
+func createLabelMatcher(matcherName string, namespaces []string, universe data.Set) *prompb.LabelMatcher {
 	ret := &prompb.LabelMatcher{
 		Name: matcherName,
 	}
 
-	modifyLabelMatcher(ret, namespaces)
+	modifyLabelMatcher(ret, namespaces, universe)
 
 	return ret
 }
 
-func modifyMatcher(srcMatcher *promlb.Matcher, namespaces []string) {
-	var tmp *promlb.Matcher
+// modifyMatcher selects no namespace when the namespace matcher cannot be compiled.
+func modifyMatcher(srcMatcher *promlb.Matcher, namespaces []string, universe data.Set) {
+	mType, value := namespaceMatch(namespaces, universe)
 
-	switch len(namespaces) {
-	case 0:
-		tmp = promlb.MustNewMatcher(promlb.MatchEqual, srcMatcher.Name, noneNamespace)
-	case 1:
-		tmp = promlb.MustNewMatcher(promlb.MatchEqual, srcMatcher.Name, namespaces[0])
-	default:
-		tmp = promlb.MustNewMatcher(promlb.MatchRegexp, srcMatcher.Name, join(namespaces))
+	m, err := newMatcher(mType, srcMatcher.Name, value)
+	if err != nil {
+		m, _ = newMatcher(promlb.MatchEqual, srcMatcher.Name, noneNamespace)
 	}
-	*srcMatcher = *tmp
+
+	*srcMatcher = *m
 }
 
-func modifyLabelMatcher(srcMatcher *prompb.LabelMatcher, namespaces []string) {
-	size := len(namespaces)
+func modifyLabelMatcher(srcMatcher *prompb.LabelMatcher, namespaces []string, universe data.Set) {
+	mType, value := namespaceMatch(namespaces, universe)
 
-	if size == 0 {
-		srcMatcher.Type = prompb.LabelMatcher_EQ
-		srcMatcher.Value = noneNamespace
-	} else if size == 1 {
+	switch mType {
+	case promlb.MatchEqual:
 		srcMatcher.Type = prompb.LabelMatcher_EQ
-		srcMatcher.Value = namespaces[0]
-	} else {
+	case promlb.MatchNotEqual:
+		srcMatcher.Type = prompb.LabelMatcher_NEQ
+	case promlb.MatchRegexp:
 		srcMatcher.Type = prompb.LabelMatcher_RE
-		srcMatcher.Value = join(namespaces)
+	case promlb.MatchNotRegexp:
+		srcMatcher.Type = prompb.LabelMatcher_NRE
+	}
+	srcMatcher.Value = value
+}
+
+// namespaceMatch picks the shortest matcher selecting exactly the namespaces:
+// the alternation of the namespaces, with or without their common prefixes factored out,
+// or the complement excluding the other namespaces of the universe.
+// The complement also selects the values missing from the universe, so the universe must hold every namespace value
+// of the series, a nil universe disables the complement.
+func namespaceMatch(namespaces []string, universe data.Set) (promlb.MatchType, string) {
+	switch len(namespaces) {
+	case 0:
+		return promlb.MatchEqual, noneNamespace
+	case 1:
+		return promlb.MatchEqual, namespaces[0]
 	}
+
+	mType, value := promlb.MatchRegexp, join(namespaces)
+	if factored := factor(namespaces); len(factored) < len(value) {
+		value = factored
+	}
+
+	if universe == nil {
+		return mType, value
+	}
+
+	selected := data.NewSet(namespaces...)
+	// the series without namespace label are always excluded
+	excluded := []string{""}
+	for ns := range universe {
+		if _, exist := selected[ns]; !exist {
+			excluded = append(excluded, ns)
+		}
+	}
+
+	if len(excluded) == 1 {
+		return promlb.MatchNotEqual, ""
+	}
+	if complement := factor(excluded); len(complement) < len(value) {
+		return promlb.MatchNotRegexp, complement
+	}
+
+	return mType, value
 }
 
 func toLabelMatchers(matchers []*promlb.Matcher) ([]*prompb.LabelMatcher, error) {
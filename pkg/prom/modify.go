@@ -8,16 +8,22 @@ import (
 )
 
 func ModifyExpression(originalExpr parser.Expr, namespaceSet data.Set) (modifiedExpr string) {
+	return ModifyExpressionWithin(originalExpr, namespaceSet, nil)
+}
+
+// ModifyExpressionWithin restricts the selectors to the namespaces like ModifyExpression,
+// the universe holds every namespace value of the series, see FilterMatchersWithin.
+func ModifyExpressionWithin(originalExpr parser.Expr, namespaceSet, universe data.Set) (modifiedExpr string) {
 	parser.Inspect(originalExpr, func(node parser.Node, _ []parser.Node) error {
 		switch n := node.(type) {
 		case *parser.VectorSelector:
-			n.LabelMatchers = FilterMatchers(namespaceSet, n.LabelMatchers)
+			n.LabelMatchers = FilterMatchersWithin(namespaceSet, universe, n.LabelMatchers)
 		case *parser.MatrixSelector:
 			vs, ok := n.VectorSelector.(*parser.VectorSelector)
 			if !ok {
 				return fmt.Errorf("cannot parse MatrixSelector to VectorSelector")
 			}
-			vs.LabelMatchers = FilterMatchers(namespaceSet, vs.LabelMatchers)
+			vs.LabelMatchers = FilterMatchersWithin(namespaceSet, universe, vs.LabelMatchers)
 		}
 		return nil
 	})
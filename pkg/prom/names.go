@@ -0,0 +1,113 @@
+package prom
+
+import (
+	"regexp/syntax"
+
+	"github.com/juju/errors"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// CheckMetricNames rejects the series selectors of a query without a concrete metric name.
+func CheckMetricNames(expr parser.Expr) error {
+	return parser.Walk(inspectFunc(func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && !HasConcreteMetricName(vs.LabelMatchers) {
+			return errors.Errorf("series selector %s has no concrete metric name", vs)
+		}
+
+		return nil
+	}), expr, nil)
+}
+
+// CheckLabelMatcherNames rejects the remote read matchers without a concrete metric name.
+func CheckLabelMatcherNames(pbMatchers []*prompb.LabelMatcher) error {
+	matchers, err := fromLabelMatchers(pbMatchers)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !HasConcreteMetricName(matchers) {
+		return errors.Errorf("series selector %s has no concrete metric name", &parser.VectorSelector{LabelMatchers: matchers})
+	}
+
+	return nil
+}
+
+// HasConcreteMetricName tells whether the matchers restrict the metric name to a known name, or a known name prefix,
+// so that they don't select every series.
+func HasConcreteMetricName(matchers []*promlb.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name != promlb.MetricName {
+			continue
+		}
+
+		switch m.Type {
+		case promlb.MatchEqual:
+			if m.Value != "" {
+				return true
+			}
+		case promlb.MatchRegexp:
+			re, err := syntax.Parse(m.Value, syntax.Perl)
+			if err == nil && hasLiteralPrefix(re.Simplify()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasLiteralPrefix tells whether the regular expression matches a finite set of strings,
+// or only strings starting with a non-empty literal.
+func hasLiteralPrefix(re *syntax.Regexp) bool {
+	if isFinite(re) {
+		return re.Op != syntax.OpEmptyMatch
+	}
+
+	switch re.Op {
+	case syntax.OpCapture:
+		return hasLiteralPrefix(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			switch sub.Op {
+			case syntax.OpBeginLine, syntax.OpBeginText:
+				continue
+			case syntax.OpLiteral:
+				return len(sub.Rune) != 0
+			case syntax.OpCapture, syntax.OpAlternate:
+				return hasLiteralPrefix(sub)
+			}
+			return false
+		}
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !hasLiteralPrefix(sub) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// isFinite tells whether the regular expression matches a finite set of strings.
+func isFinite(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpLiteral, syntax.OpCharClass,
+		syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	case syntax.OpCapture, syntax.OpConcat, syntax.OpAlternate, syntax.OpQuest:
+		for _, sub := range re.Sub {
+			if !isFinite(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpRepeat:
+		return re.Max >= 0 && isFinite(re.Sub[0])
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+// +build test
+
+package prom
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestCheckMetricNames(t *testing.T) {
+	cases := []struct {
+		input    string
+		concrete bool
+	}{
+		{`up`, true},
+		{`rate(http_requests_total{job="api"}[5m])`, true},
+		{`{__name__="up"}`, true},
+		{`{__name__=~"up|node_load1"}`, true},
+		{`{__name__=~"a|b"}`, true},
+		{`{__name__=~"node_cpu_.*"}`, true},
+		{`{__name__=~"(node|kube)_.+"}`, true},
+		{`{__name__=~".+"}`, false},
+		{`{__name__=~".*",job="api"}`, false},
+		{`{__name__=~".*_total"}`, false},
+		{`{__name__=~"[a-z].*"}`, false},
+		{`{__name__=~"up|.+"}`, false},
+		{`{__name__=~"up|",job="api"}`, true},
+		{`{__name__!=""}`, false},
+		{`{__name__!~"up",job="api"}`, false},
+		{`{job="api"}`, false},
+		{`up + {job="api"}`, false},
+		{`sum(rate({__name__=~".+",job="api"}[5m]))`, false},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = CheckMetricNames(expr)
+		if (err == nil) != c.concrete {
+			t.Errorf("%s => expected concrete metric names %v, got %v", c.input, c.concrete, err)
+		}
+	}
+}
+
+func TestCheckLabelMatcherNames(t *testing.T) {
+	concrete := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+	}
+	if err := CheckLabelMatcherNames(concrete); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	unbounded := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"},
+		{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+	}
+	if err := CheckLabelMatcherNames(unbounded); err == nil {
+		t.Error("expected error for match-all metric name")
+	}
+}
@@ -0,0 +1,241 @@
+package prom
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var (
+	// shardLocalFuncs compute every output series from a single input series.
+	shardLocalFuncs = map[string]struct{}{
+		"abs": {}, "ceil": {}, "floor": {}, "round": {}, "exp": {}, "ln": {}, "log2": {}, "log10": {}, "sqrt": {},
+		"clamp_max": {}, "clamp_min": {}, "rate": {}, "irate": {}, "increase": {}, "delta": {}, "idelta": {},
+		"deriv": {}, "predict_linear": {}, "resets": {}, "changes": {}, "holt_winters": {},
+		"avg_over_time": {}, "min_over_time": {}, "max_over_time": {}, "sum_over_time": {}, "count_over_time": {},
+		"quantile_over_time": {}, "stddev_over_time": {}, "stdvar_over_time": {},
+	}
+)
+
+// ShardPlan merges the partial results of an aggregation run over disjoint sets of namespaces.
+type ShardPlan struct {
+	op parser.ItemType
+	// disjoint is set when the aggregation groups by namespace, the shards have no group in common.
+	disjoint bool
+}
+
+// NewShardPlan tells whether the expression is an aggregation whose result can be merged
+// from the results over disjoint sets of namespaces: a sum, count, min or max of series computed
+// within their namespace, or any aggregation grouped by namespace.
+func NewShardPlan(expr parser.Expr) (*ShardPlan, bool) {
+	agg, ok := unwrapParens(expr).(*parser.AggregateExpr)
+	if !ok || !shardLocal(agg.Expr) {
+		return nil, false
+	}
+
+	if groupsByNamespace(agg) {
+		if agg.Param != nil && !isLiteral(agg.Param) {
+			return nil, false
+		}
+
+		return &ShardPlan{op: agg.Op, disjoint: true}, true
+	}
+
+	switch agg.Op {
+	case parser.SUM, parser.COUNT, parser.MIN, parser.MAX:
+		return &ShardPlan{op: agg.Op}, true
+	}
+
+	return nil, false
+}
+
+// NewRoutePlan tells whether the results of the expression can be merged from the results over
+// disjoint sets of namespaces, like NewShardPlan, or concatenated as every series of the vector
+// is computed within its namespace, like `rate(a[5m])`.
+func NewRoutePlan(expr parser.Expr) (*ShardPlan, bool) {
+	if plan, ok := NewShardPlan(expr); ok {
+		return plan, true
+	}
+
+	if expr.Type() == parser.ValueTypeVector && shardLocal(expr) {
+		return &ShardPlan{disjoint: true}, true
+	}
+
+	return nil, false
+}
+
+// MergeVector merges the instant vectors of the shards.
+func (p *ShardPlan) MergeVector(parts []model.Vector) model.Vector {
+	ret := make(model.Vector, 0)
+	index := make(map[model.Fingerprint]*model.Sample)
+
+	for _, part := range parts {
+		for _, sample := range part {
+			if p.disjoint {
+				ret = append(ret, sample)
+				continue
+			}
+
+			fp := sample.Metric.Fingerprint()
+			if merged, exist := index[fp]; exist {
+				merged.Value = p.merge(merged.Value, sample.Value)
+				continue
+			}
+
+			merged := &model.Sample{Metric: sample.Metric, Value: sample.Value, Timestamp: sample.Timestamp}
+			index[fp] = merged
+			ret = append(ret, merged)
+		}
+	}
+
+	return ret
+}
+
+// MergeMatrix merges the range vectors of the shards, point by point.
+func (p *ShardPlan) MergeMatrix(parts []model.Matrix) model.Matrix {
+	ret := make(model.Matrix, 0)
+	index := make(map[model.Fingerprint]map[model.Time]model.SampleValue)
+	streams := make(map[model.Fingerprint]*model.SampleStream)
+
+	for _, part := range parts {
+		for _, series := range part {
+			if p.disjoint {
+				ret = append(ret, series)
+				continue
+			}
+
+			fp := series.Metric.Fingerprint()
+			points, exist := index[fp]
+			if !exist {
+				points = make(map[model.Time]model.SampleValue, len(series.Values))
+				index[fp] = points
+				streams[fp] = &model.SampleStream{Metric: series.Metric}
+			}
+
+			for _, point := range series.Values {
+				if value, exist := points[point.Timestamp]; exist {
+					points[point.Timestamp] = p.merge(value, point.Value)
+				} else {
+					points[point.Timestamp] = point.Value
+				}
+			}
+		}
+	}
+
+	for fp, stream := range streams {
+		for ts, value := range index[fp] {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: ts, Value: value})
+		}
+		sort.Slice(stream.Values, func(i, j int) bool {
+			return stream.Values[i].Timestamp < stream.Values[j].Timestamp
+		})
+		ret = append(ret, stream)
+	}
+
+	return ret
+}
+
+func (p *ShardPlan) merge(a, b model.SampleValue) model.SampleValue {
+	switch p.op {
+	case parser.MIN:
+		if math.IsNaN(float64(a)) || b < a {
+			return b
+		}
+		return a
+	case parser.MAX:
+		if math.IsNaN(float64(a)) || b > a {
+			return b
+		}
+		return a
+	default:
+		// the sum of the partial sums, or of the partial counts
+		return a + b
+	}
+}
+
+// SplitNamespaces splits the sorted namespaces into at most n shards of consecutive namespaces.
+func SplitNamespaces(namespaces []string, n int) [][]string {
+	if n > len(namespaces) {
+		n = len(namespaces)
+	}
+
+	shards := make([][]string, 0, n)
+	for i := 0; i < n; i++ {
+		shards = append(shards, namespaces[i*len(namespaces)/n:(i+1)*len(namespaces)/n])
+	}
+
+	return shards
+}
+
+// shardLocal tells whether every series of the expression is computed from the series of a single namespace.
+func shardLocal(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.VectorSelector, *parser.MatrixSelector, *parser.NumberLiteral, *parser.StringLiteral:
+		return true
+	case *parser.ParenExpr:
+		return shardLocal(e.Expr)
+	case *parser.UnaryExpr:
+		return shardLocal(e.Expr)
+	case *parser.SubqueryExpr:
+		return shardLocal(e.Expr)
+	case *parser.Call:
+		if _, exist := shardLocalFuncs[e.Func.Name]; !exist {
+			return false
+		}
+		for _, arg := range e.Args {
+			if !shardLocal(arg) {
+				return false
+			}
+		}
+		return true
+	case *parser.AggregateExpr:
+		return groupsByNamespace(e) && shardLocal(e.Expr) && (e.Param == nil || isLiteral(e.Param))
+	case *parser.BinaryExpr:
+		if !shardLocal(e.LHS) || !shardLocal(e.RHS) {
+			return false
+		}
+		if e.VectorMatching == nil || e.LHS.Type() == parser.ValueTypeScalar || e.RHS.Type() == parser.ValueTypeScalar {
+			return true
+		}
+
+		// the vectors match within a namespace
+		return e.VectorMatching.On == containsNamespace(e.VectorMatching.MatchingLabels)
+	}
+
+	return false
+}
+
+func groupsByNamespace(agg *parser.AggregateExpr) bool {
+	return agg.Without != containsNamespace(agg.Grouping)
+}
+
+func containsNamespace(labels []string) bool {
+	for _, label := range labels {
+		if label == namespaceMatchName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLiteral(expr parser.Expr) bool {
+	switch unwrapParens(expr).(type) {
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return true
+	}
+
+	return false
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
@@ -0,0 +1,174 @@
+// +build test
+
+package prom
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestNewShardPlan(t *testing.T) {
+	cases := []struct {
+		input    string
+		sharded  bool
+		disjoint bool
+	}{
+		{`sum(rate(http_requests_total[5m]))`, true, false},
+		{`(sum by (job) (up))`, true, false},
+		{`count(up == 1)`, true, false},
+		{`min(node_load1)`, true, false},
+		{`max without (instance) (max_over_time(up[1h]))`, true, true},
+		{`sum(rate(a[5m]) / rate(b[5m]))`, true, false},
+		{`sum(a * on (namespace, pod) b)`, true, false},
+		{`sum(a * ignoring (pod) b)`, true, false},
+		{`sum(sum by (namespace) (a) / sum by (namespace) (b))`, true, false},
+		{`sum by (namespace) (rate(a[5m]))`, true, true},
+		{`avg without (pod) (a)`, true, true},
+		{`topk by (namespace) (5, a)`, true, true},
+		{`avg(a)`, false, false},
+		{`topk(5, a)`, false, false},
+		{`quantile(0.9, a)`, false, false},
+		{`rate(a[5m])`, false, false},
+		{`sum(a * on (pod) b)`, false, false},
+		{`sum(a * ignoring (namespace) b)`, false, false},
+		{`sum(a / sum(b))`, false, false},
+		{`sum(absent(a))`, false, false},
+		{`sum(label_replace(a, "namespace", "x", "", ""))`, false, false},
+		{`sum(histogram_quantile(0.9, a))`, false, false},
+		{`topk by (namespace) (scalar(sum(a)), a)`, false, false},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plan, ok := NewShardPlan(expr)
+		if ok != c.sharded {
+			t.Errorf("%s => expected sharded %v", c.input, c.sharded)
+			continue
+		}
+		if ok && plan.disjoint != c.disjoint {
+			t.Errorf("%s => expected disjoint %v", c.input, c.disjoint)
+		}
+	}
+}
+
+func TestNewRoutePlan(t *testing.T) {
+	cases := []struct {
+		input    string
+		routed   bool
+		disjoint bool
+	}{
+		{`sum(rate(http_requests_total[5m]))`, true, false},
+		{`sum by (namespace) (a)`, true, true},
+		{`rate(a[5m])`, true, true},
+		{`(a / on (namespace, pod) b) * 100`, true, true},
+		{`a > 0`, true, true},
+		{`avg(a)`, false, false},
+		{`a * on (pod) b`, false, false},
+		{`label_replace(a, "namespace", "x", "", "")`, false, false},
+		{`absent(a)`, false, false},
+		{`a[5m]`, false, false},
+		{`1 + 1`, false, false},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plan, ok := NewRoutePlan(expr)
+		if ok != c.routed {
+			t.Errorf("%s => expected routed %v", c.input, c.routed)
+			continue
+		}
+		if ok && plan.disjoint != c.disjoint {
+			t.Errorf("%s => expected disjoint %v", c.input, c.disjoint)
+		}
+	}
+}
+
+func TestSplitNamespaces(t *testing.T) {
+	namespaces := []string{"a", "b", "c", "d", "e"}
+
+	expected := [][]string{{"a"}, {"b", "c"}, {"d", "e"}}
+	if shards := SplitNamespaces(namespaces, 3); !reflect.DeepEqual(shards, expected) {
+		t.Errorf("expected %v, got %v", expected, shards)
+	}
+
+	if shards := SplitNamespaces(namespaces, 10); len(shards) != len(namespaces) {
+		t.Errorf("expected a shard per namespace, got %v", shards)
+	}
+}
+
+func TestShardPlanMerge(t *testing.T) {
+	metric := model.Metric{"job": "api"}
+	other := model.Metric{"job": "db"}
+
+	cases := []struct {
+		input    string
+		expected model.SampleValue
+	}{
+		{`sum by (job) (up)`, 5},
+		{`count by (job) (up)`, 5},
+		{`min by (job) (up)`, 1},
+		{`max by (job) (up)`, 4},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, ok := NewShardPlan(expr)
+		if !ok {
+			t.Fatalf("%s => expected to be sharded", c.input)
+		}
+
+		vector := plan.MergeVector([]model.Vector{
+			{{Metric: metric, Value: 4, Timestamp: 1000}},
+			{{Metric: metric, Value: 1, Timestamp: 1000}, {Metric: other, Value: 2, Timestamp: 1000}},
+		})
+		if len(vector) != 2 || vector[0].Value != c.expected || vector[1].Value != 2 {
+			t.Errorf("%s => expected %v, got %v", c.input, c.expected, vector)
+		}
+
+		matrix := plan.MergeMatrix([]model.Matrix{
+			{{Metric: metric, Values: []model.SamplePair{{Timestamp: 1000, Value: 4}, {Timestamp: 2000, Value: 3}}}},
+			{{Metric: metric, Values: []model.SamplePair{{Timestamp: 0, Value: 7}, {Timestamp: 1000, Value: 1}}}},
+		})
+		expectedValues := []model.SamplePair{{Timestamp: 0, Value: 7}, {Timestamp: 1000, Value: c.expected}, {Timestamp: 2000, Value: 3}}
+		if len(matrix) != 1 || !reflect.DeepEqual(matrix[0].Values, expectedValues) {
+			t.Errorf("%s => expected %v, got %v", c.input, expectedValues, matrix)
+		}
+	}
+
+	// NaN is replaced by any value, as in Prometheus
+	expr, _ := parser.ParseExpr(`min(up)`)
+	plan, _ := NewShardPlan(expr)
+	vector := plan.MergeVector([]model.Vector{
+		{{Metric: model.Metric{}, Value: model.SampleValue(math.NaN())}},
+		{{Metric: model.Metric{}, Value: 3}},
+	})
+	if len(vector) != 1 || vector[0].Value != 3 {
+		t.Errorf("expected NaN to be replaced, got %v", vector)
+	}
+
+	// the groups by namespace are concatenated
+	expr, _ = parser.ParseExpr(`topk by (namespace) (1, up)`)
+	plan, _ = NewShardPlan(expr)
+	vector = plan.MergeVector([]model.Vector{
+		{{Metric: model.Metric{"namespace": "a"}, Value: 1}},
+		{{Metric: model.Metric{"namespace": "b"}, Value: 2}},
+	})
+	if len(vector) != 2 {
+		t.Errorf("expected the groups of both shards, got %v", vector)
+	}
+}
@@ -0,0 +1,98 @@
+package prom
+
+import (
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var (
+	// emptyPreservingFuncs return no series when their vector argument has none.
+	emptyPreservingFuncs = map[string]struct{}{
+		"abs": {}, "ceil": {}, "floor": {}, "round": {}, "exp": {}, "ln": {}, "log2": {}, "log10": {}, "sqrt": {},
+		"clamp_max": {}, "clamp_min": {}, "rate": {}, "irate": {}, "increase": {}, "delta": {}, "idelta": {},
+		"deriv": {}, "predict_linear": {}, "resets": {}, "changes": {}, "holt_winters": {},
+		"avg_over_time": {}, "min_over_time": {}, "max_over_time": {}, "sum_over_time": {}, "count_over_time": {},
+		"quantile_over_time": {}, "stddev_over_time": {}, "stdvar_over_time": {},
+		"label_replace": {}, "label_join": {}, "histogram_quantile": {}, "sort": {}, "sort_desc": {}, "timestamp": {},
+		"day_of_month": {}, "day_of_week": {}, "days_in_month": {}, "hour": {}, "minute": {}, "month": {}, "year": {},
+	}
+)
+
+// Simplify removes the subexpressions of a rewritten expression which are provably empty,
+// as their selectors match no namespace, and tells whether the whole expression is provably empty.
+// The expression is modified, `a_empty + b` is empty and `a_empty or b` is simplified to `b`.
+func Simplify(expr parser.Expr) (parser.Expr, bool) {
+	var empty bool
+
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		return e, selectsNoNamespace(e.LabelMatchers)
+	case *parser.MatrixSelector:
+		_, empty = Simplify(e.VectorSelector)
+		return e, empty
+	case *parser.SubqueryExpr:
+		e.Expr, empty = Simplify(e.Expr)
+		return e, empty
+	case *parser.ParenExpr:
+		e.Expr, empty = Simplify(e.Expr)
+		return e, empty
+	case *parser.UnaryExpr:
+		e.Expr, empty = Simplify(e.Expr)
+		return e, empty
+	case *parser.AggregateExpr:
+		// the aggregation of no series has no group
+		e.Expr, empty = Simplify(e.Expr)
+		if e.Param != nil {
+			e.Param, _ = Simplify(e.Param)
+		}
+		return e, empty
+	case *parser.Call:
+		for idx, arg := range e.Args {
+			var argEmpty bool
+			e.Args[idx], argEmpty = Simplify(arg)
+			empty = empty || argEmpty
+		}
+		if _, exist := emptyPreservingFuncs[e.Func.Name]; !exist {
+			// like absent, which returns a series when its argument has none
+			return e, false
+		}
+		return e, empty
+	case *parser.BinaryExpr:
+		var lhsEmpty, rhsEmpty bool
+		e.LHS, lhsEmpty = Simplify(e.LHS)
+		e.RHS, rhsEmpty = Simplify(e.RHS)
+
+		switch e.Op {
+		case parser.LOR:
+			switch {
+			case lhsEmpty && rhsEmpty:
+				return e, true
+			case lhsEmpty:
+				return e.RHS, false
+			case rhsEmpty:
+				return e.LHS, false
+			}
+			return e, false
+		case parser.LUNLESS:
+			if !lhsEmpty && rhsEmpty {
+				return e.LHS, false
+			}
+			return e, lhsEmpty
+		}
+
+		// the scalars are never empty, and the vector operations have no match
+		return e, lhsEmpty || rhsEmpty
+	}
+
+	return expr, false
+}
+
+func selectsNoNamespace(matchers []*promlb.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == namespaceMatchName && m.Type == promlb.MatchEqual && m.Value == noneNamespace {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+// +build test
+
+package prom
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+func TestSimplify(t *testing.T) {
+	namespaceSet := data.NewSet("ns-a", "ns-b")
+
+	cases := []struct {
+		input    string
+		expected string
+		empty    bool
+	}{
+		{`a{namespace="ns-c"}`, `a{namespace="______"}`, true},
+		{`a{namespace="ns-a"}`, `a{namespace="ns-a"}`, false},
+		{`rate(a{namespace="ns-c"}[5m])`, `rate(a{namespace="______"}[5m])`, true},
+		{`sum by (pod) (rate(a{namespace="ns-c"}[5m]))`, `sum by(pod) (rate(a{namespace="______"}[5m]))`, true},
+		{`max_over_time(a{namespace="ns-c"}[1h:5m])`, `max_over_time(a{namespace="______"}[1h:5m])`, true},
+		{`-a{namespace="ns-c"} * 2`, `-a{namespace="______"} * 2`, true},
+		{`a{namespace="ns-c"} + b`, `a{namespace="______"} + b{namespace=~"ns-a|ns-b"}`, true},
+		{`b > bool on (pod) a{namespace="ns-c"}`, `b{namespace=~"ns-a|ns-b"} > bool on(pod) a{namespace="______"}`, true},
+		{`a{namespace="ns-c"} or b`, `b{namespace=~"ns-a|ns-b"}`, false},
+		{`b or a{namespace="ns-c"}`, `b{namespace=~"ns-a|ns-b"}`, false},
+		{`a{namespace="ns-c"} or a{namespace="ns-d"}`, `a{namespace="______"} or a{namespace="______"}`, true},
+		{`(a{namespace="ns-c"} or b) / 2`, `(b{namespace=~"ns-a|ns-b"}) / 2`, false},
+		{`b unless a{namespace="ns-c"}`, `b{namespace=~"ns-a|ns-b"}`, false},
+		{`a{namespace="ns-c"} unless b`, `a{namespace="______"} unless b{namespace=~"ns-a|ns-b"}`, true},
+		{`b and a{namespace="ns-c"}`, `b{namespace=~"ns-a|ns-b"} and a{namespace="______"}`, true},
+		{`absent(a{namespace="ns-c"})`, `absent(a{namespace="______"})`, false},
+		{`scalar(a{namespace="ns-c"})`, `scalar(a{namespace="______"})`, false},
+		{`vector(1) or a{namespace="ns-c"}`, `vector(1)`, false},
+		{`count(a{namespace="ns-c"}) or vector(0)`, `vector(0)`, false},
+		{`sum(rate(a[5m]))`, `sum(rate(a{namespace=~"ns-a|ns-b"}[5m]))`, false},
+	}
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ModifyExpressionWithin(expr, namespaceSet, nil)
+
+		expr, empty := Simplify(expr)
+		if output := expr.String(); output != c.expected || empty != c.empty {
+			t.Errorf("%s => expected %s (empty %v), got %s (empty %v)", c.input, c.expected, c.empty, output, empty)
+		}
+	}
+}
@@ -1,15 +1,12 @@
 package prom
 
 import (
-	"fmt"
-	"regexp"
-
 	promlb "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/rancher/prometheus-auth/pkg/data"
 )
 
-func translateMatcher(namespaceSet data.Set, srcMatcher *promlb.Matcher) {
+func translateMatcher(namespaceSet, universe data.Set, srcMatcher *promlb.Matcher) {
 	if namespaceSet == nil || srcMatcher == nil {
 		return
 	}
@@ -26,23 +23,23 @@ func translateMatcher(namespaceSet data.Set, srcMatcher *promlb.Matcher) {
 			namespaces = stringSliceIgnore(namespaces, &value)
 		}
 
-		modifyMatcher(srcMatcher, namespaces)
+		modifyMatcher(srcMatcher, namespaces, universe)
 	case promlb.MatchRegexp: // =~
 		namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
 			return srcMatcher.Matches(*ns)
 		})
 
-		modifyMatcher(srcMatcher, namespaces)
+		modifyMatcher(srcMatcher, namespaces, universe)
 	case promlb.MatchNotRegexp: // !~
 		namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
 			return srcMatcher.Matches(*ns)
 		})
 
-		modifyMatcher(srcMatcher, namespaces)
+		modifyMatcher(srcMatcher, namespaces, universe)
 	}
 }
 
-func translateLabelMatcher(namespaceSet data.Set, srcMatcher *prompb.LabelMatcher) {
+func translateLabelMatcher(namespaceSet, universe data.Set, srcMatcher *prompb.LabelMatcher) {
 	if namespaceSet == nil || srcMatcher == nil {
 		return
 	}
@@ -59,24 +56,24 @@ func translateLabelMatcher(namespaceSet data.Set, srcMatcher *prompb.LabelMatche
 			namespaces = stringSliceIgnore(namespaces, &value)
 		}
 
-		modifyLabelMatcher(srcMatcher, namespaces)
+		modifyLabelMatcher(srcMatcher, namespaces, universe)
 	case prompb.LabelMatcher_RE: // =~
-		valueRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", value))
+		valueRegexp, err := compileRegexp(value)
 		if err == nil {
 			namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
 				return valueRegexp.MatchString(*ns)
 			})
 
-			modifyLabelMatcher(srcMatcher, namespaces)
+			modifyLabelMatcher(srcMatcher, namespaces, universe)
 		}
 	case prompb.LabelMatcher_NRE: // !~
-		valueRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", value))
+		valueRegexp, err := compileRegexp(value)
 		if err == nil {
 			namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
 				return !valueRegexp.MatchString(*ns)
 			})
 
-			modifyLabelMatcher(srcMatcher, namespaces)
+			modifyLabelMatcher(srcMatcher, namespaces, universe)
 		}
 	}
 }
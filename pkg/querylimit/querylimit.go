@@ -0,0 +1,196 @@
+package querylimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/common/model"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// Duration is a Prometheus duration like "30s" or "31d".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := model.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// Limits of the queries, a zero value means unlimited, or inherited from the default limits in an override.
+type Limits struct {
+	MaxRange       Duration `json:"maxRange,omitempty"`
+	MaxLookback    Duration `json:"maxLookback,omitempty"`
+	MinStep        Duration `json:"minStep,omitempty"`
+	MaxSelectors   int      `json:"maxSelectors,omitempty"`
+	MaxDepth       int      `json:"maxDepth,omitempty"`
+	MaxQueryLength int      `json:"maxQueryLength,omitempty"`
+	MaxSeries      int      `json:"maxSeries,omitempty"`
+}
+
+// Override replaces the default limits for the members of the groups,
+// or for the queries accessing the namespaces of the projects.
+type Override struct {
+	Groups   []string `json:"groups,omitempty"`
+	Projects []string `json:"projects,omitempty"`
+	Limits   Limits   `json:"limits"`
+}
+
+// Config is the YAML file of the query limits, the first matching override applies.
+type Config struct {
+	Default   Limits     `json:"default"`
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Annotatef(err, "unable to read query limits %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return cfg, errors.Annotatef(err, "unable to parse query limits %s", path)
+	}
+
+	return cfg, nil
+}
+
+// HasSeriesBudget tells whether any limits bound the estimated series of the queries.
+func (c Config) HasSeriesBudget() bool {
+	if c.Default.MaxSeries > 0 {
+		return true
+	}
+	for _, o := range c.Overrides {
+		if o.Limits.MaxSeries > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+type override struct {
+	groups   data.Set
+	projects data.Set
+	limits   *prom.Limits
+}
+
+// Resolver picks the query limits of a request.
+type Resolver struct {
+	defaults  *prom.Limits
+	overrides []override
+	projectOf func(namespace string) string
+}
+
+func NewResolver(cfg Config, projectOf func(namespace string) string) (*Resolver, error) {
+	r := &Resolver{
+		defaults:  cfg.Default.merge(Limits{}),
+		overrides: make([]override, 0, len(cfg.Overrides)),
+		projectOf: projectOf,
+	}
+
+	for idx, o := range cfg.Overrides {
+		if len(o.Groups) == 0 && len(o.Projects) == 0 {
+			return nil, errors.Errorf("query limits override %d matches neither groups nor projects", idx)
+		}
+		if len(o.Projects) != 0 && projectOf == nil {
+			return nil, errors.New("query limits by project require Kubernetes")
+		}
+
+		r.overrides = append(r.overrides, override{
+			groups:   data.NewSet(o.Groups...),
+			projects: data.NewSet(o.Projects...),
+			limits:   o.Limits.merge(cfg.Default),
+		})
+	}
+
+	return r, nil
+}
+
+// For returns the limits of the user accessing the namespaces.
+func (r *Resolver) For(info *user.DefaultInfo, namespaceSet data.Set) *prom.Limits {
+	if r == nil {
+		return nil
+	}
+
+	var projects data.Set
+	for _, o := range r.overrides {
+		for _, group := range info.Groups {
+			if _, exist := o.groups[group]; exist {
+				return o.limits
+			}
+		}
+
+		if len(o.projects) == 0 {
+			continue
+		}
+		if projects == nil {
+			projects = data.Set{}
+			for ns := range namespaceSet {
+				if project := r.projectOf(ns); project != "" {
+					projects[project] = struct{}{}
+				}
+			}
+		}
+		for project := range projects {
+			if _, exist := o.projects[project]; exist {
+				return o.limits
+			}
+		}
+	}
+
+	return r.defaults
+}
+
+func (l Limits) merge(defaults Limits) *prom.Limits {
+	ret := &prom.Limits{
+		MaxRange:       time.Duration(l.MaxRange),
+		MaxLookback:    time.Duration(l.MaxLookback),
+		MinStep:        time.Duration(l.MinStep),
+		MaxSelectors:   l.MaxSelectors,
+		MaxDepth:       l.MaxDepth,
+		MaxQueryLength: l.MaxQueryLength,
+		MaxSeries:      l.MaxSeries,
+	}
+
+	if ret.MaxRange == 0 {
+		ret.MaxRange = time.Duration(defaults.MaxRange)
+	}
+	if ret.MaxLookback == 0 {
+		ret.MaxLookback = time.Duration(defaults.MaxLookback)
+	}
+	if ret.MinStep == 0 {
+		ret.MinStep = time.Duration(defaults.MinStep)
+	}
+	if ret.MaxSelectors == 0 {
+		ret.MaxSelectors = defaults.MaxSelectors
+	}
+	if ret.MaxDepth == 0 {
+		ret.MaxDepth = defaults.MaxDepth
+	}
+	if ret.MaxQueryLength == 0 {
+		ret.MaxQueryLength = defaults.MaxQueryLength
+	}
+	if ret.MaxSeries == 0 {
+		ret.MaxSeries = defaults.MaxSeries
+	}
+
+	return ret
+}
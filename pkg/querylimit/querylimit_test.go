@@ -0,0 +1,84 @@
+// +build test
+
+package querylimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const testConfig = `
+default:
+  maxRange: 7d
+  maxLookback: 1d
+  minStep: 15s
+  maxSelectors: 10
+  maxSeries: 100000
+overrides:
+- groups: [sre]
+  limits:
+    maxRange: 31d
+    maxSeries: 2000000
+- projects: ["c-1:p-batch"]
+  limits:
+    minStep: 1m
+`
+
+func TestResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "limits.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projects := map[string]string{"ns-batch": "c-1:p-batch", "ns-web": "c-1:p-web"}
+	resolver, err := NewResolver(cfg, func(namespace string) string {
+		return projects[namespace]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := 24 * time.Hour
+
+	limits := resolver.For(&user.DefaultInfo{Name: "alice"}, data.NewSet("ns-web"))
+	if limits.MaxRange != 7*day || limits.MaxLookback != day || limits.MinStep != 15*time.Second || limits.MaxSelectors != 10 || limits.MaxSeries != 100000 {
+		t.Errorf("unexpected default limits %+v", limits)
+	}
+
+	limits = resolver.For(&user.DefaultInfo{Name: "bob", Groups: []string{"sre"}}, data.NewSet("ns-batch"))
+	if limits.MaxRange != 31*day || limits.MinStep != 15*time.Second || limits.MaxSelectors != 10 || limits.MaxSeries != 2000000 {
+		t.Errorf("unexpected group limits %+v", limits)
+	}
+
+	limits = resolver.For(&user.DefaultInfo{Name: "carol"}, data.NewSet("ns-web", "ns-batch"))
+	if limits.MaxRange != 7*day || limits.MinStep != time.Minute || limits.MaxSeries != 100000 {
+		t.Errorf("unexpected project limits %+v", limits)
+	}
+
+	if _, err := NewResolver(cfg, nil); err == nil {
+		t.Error("expected error for project limits without project lookup")
+	}
+
+	var unlimited *Resolver
+	if unlimited.For(&user.DefaultInfo{Name: "alice"}, nil) != nil {
+		t.Error("expected no limits")
+	}
+}
@@ -0,0 +1,251 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// Endpoint classes sharing a limit.
+const (
+	ClassQuery      = "query"
+	ClassQueryRange = "query_range"
+	ClassSeries     = "series"
+	ClassFederate   = "federate"
+	ClassRead       = "read"
+)
+
+// Keys of the token buckets.
+const (
+	// KeyUser gives a bucket to every user, service accounts included.
+	KeyUser = "user"
+	// KeyGroup gives a bucket to every group, a request consumes a token of each group of the user.
+	KeyGroup = "group"
+	// KeyProject gives a bucket to every Rancher project, a request consumes a token of each project it can access.
+	KeyProject = "project"
+)
+
+const (
+	idleBucketTTL = 10 * time.Minute
+)
+
+var (
+	classByPath = map[string]string{
+		"/api/v1/query":       ClassQuery,
+		"/api/v1/query_range": ClassQueryRange,
+		"/api/v1/series":      ClassSeries,
+		"/federate":           ClassFederate,
+		"/api/v1/read":        ClassRead,
+	}
+
+	throttledRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of the requests rejected by the per-tenant rate limits.",
+		},
+		[]string{"class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(throttledRequests)
+}
+
+// Config is the YAML file of the rate limits.
+type Config struct {
+	// Key is "user", "group" or "project".
+	Key string `json:"key"`
+	// Limits by endpoint class, the classes without limit are not throttled.
+	Limits map[string]Limit `json:"limits"`
+}
+
+type Limit struct {
+	// RequestsPerSecond refills the bucket.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is the size of the bucket.
+	Burst int `json:"burst"`
+}
+
+// ClassOf returns the endpoint class of a request path, or "" if it is not limited.
+func ClassOf(path string) string {
+	return classByPath[path]
+}
+
+// ProjectLookup returns the project of a namespace, or "" if it belongs to none.
+type ProjectLookup func(namespace string) string
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter holds a token bucket per endpoint class and tenant.
+type Limiter struct {
+	cfg       Config
+	projectOf ProjectLookup
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Annotatef(err, "unable to read rate limits %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return cfg, errors.Annotatef(err, "unable to parse rate limits %s", path)
+	}
+
+	return cfg, nil
+}
+
+func NewLimiter(ctx context.Context, cfg Config, projectOf ProjectLookup) (*Limiter, error) {
+	switch cfg.Key {
+	case KeyUser, KeyGroup:
+	case KeyProject:
+		if projectOf == nil {
+			return nil, errors.New("rate limits by project require Kubernetes")
+		}
+	default:
+		return nil, errors.Errorf("unknown rate limit key %q, expected %q, %q or %q", cfg.Key, KeyUser, KeyGroup, KeyProject)
+	}
+
+	for class, limit := range cfg.Limits {
+		if !validClass(class) {
+			return nil, errors.Errorf("unknown endpoint class %q", class)
+		}
+		if limit.RequestsPerSecond <= 0 || limit.Burst <= 0 {
+			return nil, errors.Errorf("rate limit of %q needs positive requestsPerSecond and burst", class)
+		}
+	}
+
+	l := &Limiter{
+		cfg:       cfg,
+		projectOf: projectOf,
+		buckets:   make(map[string]*bucket),
+	}
+	go l.gc(ctx)
+
+	return l, nil
+}
+
+// Allow takes a token of every bucket of the request, otherwise it takes none
+// and returns how long to wait before retrying.
+func (l *Limiter) Allow(class string, info *user.DefaultInfo, namespaceSet data.Set) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	limit, exist := l.cfg.Limits[class]
+	if !exist {
+		return 0, true
+	}
+
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var retryAfter time.Duration
+	for _, key := range l.keysOf(info, namespaceSet) {
+		bucketKey := class + "/" + key
+		b, exist := l.buckets[bucketKey]
+		if !exist {
+			b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst)}
+			l.buckets[bucketKey] = b
+		}
+		b.lastSeen = now
+
+		reservation := b.limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+
+	if retryAfter == 0 {
+		return 0, true
+	}
+
+	for _, reservation := range reservations {
+		reservation.CancelAt(now)
+	}
+	throttledRequests.WithLabelValues(class).Inc()
+
+	return retryAfter, false
+}
+
+func (l *Limiter) keysOf(info *user.DefaultInfo, namespaceSet data.Set) []string {
+	switch l.cfg.Key {
+	case KeyGroup:
+		if len(info.Groups) != 0 {
+			keys := make([]string, 0, len(info.Groups))
+			for _, group := range info.Groups {
+				keys = append(keys, "group:"+group)
+			}
+			return keys
+		}
+	case KeyProject:
+		projects := data.Set{}
+		for ns := range namespaceSet {
+			if project := l.projectOf(ns); project != "" {
+				projects[project] = struct{}{}
+			}
+		}
+		if len(projects) != 0 {
+			keys := projects.Values()
+			for idx := range keys {
+				keys[idx] = "project:" + keys[idx]
+			}
+			return keys
+		}
+	}
+
+	// users without group or project are limited on their own
+	return []string{"user:" + info.Name}
+}
+
+func (l *Limiter) gc(ctx context.Context) {
+	ticker := time.NewTicker(idleBucketTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if now.Sub(b.lastSeen) > idleBucketTTL {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func validClass(class string) bool {
+	for _, c := range classByPath {
+		if c == class {
+			return true
+		}
+	}
+
+	return false
+}
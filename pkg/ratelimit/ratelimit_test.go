@@ -0,0 +1,110 @@
+// +build test
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{
+		Key: KeyGroup,
+		Limits: map[string]Limit{
+			ClassQueryRange: {RequestsPerSecond: 0.001, Burst: 2},
+		},
+	}
+	limiter, err := NewLimiter(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &user.DefaultInfo{Name: "alice", Groups: []string{"team-a"}}
+	bob := &user.DefaultInfo{Name: "bob", Groups: []string{"team-a", "team-b"}}
+	carol := &user.DefaultInfo{Name: "carol", Groups: []string{"team-b"}}
+
+	if _, ok := limiter.Allow(ClassQueryRange, alice, nil); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if _, ok := limiter.Allow(ClassQueryRange, bob, nil); !ok {
+		t.Fatal("expected the second request to be allowed")
+	}
+	if retryAfter, ok := limiter.Allow(ClassQueryRange, alice, nil); ok || retryAfter <= 0 {
+		t.Fatalf("expected team-a to be throttled, got %v, %v", retryAfter, ok)
+	}
+
+	// the rejected requests of bob don't consume the bucket of team-b
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.Allow(ClassQueryRange, bob, nil); ok {
+			t.Fatal("expected bob to be throttled by team-a")
+		}
+	}
+	if _, ok := limiter.Allow(ClassQueryRange, carol, nil); !ok {
+		t.Fatal("expected team-b to be allowed")
+	}
+
+	if _, ok := limiter.Allow(ClassQuery, alice, nil); !ok {
+		t.Fatal("expected the classes without limit to be allowed")
+	}
+	if _, ok := limiter.Allow(ClassOf("/api/v1/label/job/values"), alice, nil); !ok {
+		t.Fatal("expected the unclassified paths to be allowed")
+	}
+}
+
+func TestLimiterByProject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{
+		Key: KeyProject,
+		Limits: map[string]Limit{
+			ClassQuery: {RequestsPerSecond: 0.001, Burst: 1},
+		},
+	}
+	if _, err := NewLimiter(ctx, cfg, nil); err == nil {
+		t.Fatal("expected error without project lookup")
+	}
+
+	projects := map[string]string{"ns-a": "c-1:p-a", "ns-b": "c-1:p-b"}
+	limiter, err := NewLimiter(ctx, cfg, func(namespace string) string {
+		return projects[namespace]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+	if _, ok := limiter.Allow(ClassQuery, alice, data.NewSet("ns-a")); !ok {
+		t.Fatal("expected the first request of project a to be allowed")
+	}
+	if _, ok := limiter.Allow(ClassQuery, bob, data.NewSet("ns-a", "ns-b")); ok {
+		t.Fatal("expected project a to be throttled")
+	}
+	if _, ok := limiter.Allow(ClassQuery, bob, data.NewSet("ns-b")); !ok {
+		t.Fatal("expected project b to be allowed")
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	invalid := []Config{
+		{Key: "tenant"},
+		{Key: KeyUser, Limits: map[string]Limit{"labels": {RequestsPerSecond: 1, Burst: 1}}},
+		{Key: KeyUser, Limits: map[string]Limit{ClassSeries: {RequestsPerSecond: 1}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewLimiter(ctx, cfg, nil); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
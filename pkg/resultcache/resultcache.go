@@ -0,0 +1,247 @@
+package resultcache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	// bucketTTL bounds the staleness of the cached history, like late samples or deleted series.
+	bucketTTL = 6 * time.Hour
+	// maxPointsPerRequest is the resolution limit of Prometheus.
+	maxPointsPerRequest = 11000
+)
+
+var (
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "query_range_cache_requests_total",
+			Help:      "Number of the range query time buckets looked up in the results cache by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+}
+
+type Config struct {
+	// Size is the maximum number of the cached time buckets.
+	Size int
+	// BucketSize is the duration of a time bucket.
+	BucketSize time.Duration
+	// MaxFreshness is the duration before now whose results are never cached, as the samples may still arrive.
+	MaxFreshness time.Duration
+}
+
+// Fetcher queries the upstream range of the expression.
+type Fetcher func(ctx context.Context, r promapiv1.Range) (model.Matrix, promapiv1.Warnings, error)
+
+// Cache keeps the range query results in time buckets aligned to the epoch,
+// keyed by the rewritten expression, which embeds the namespaces of the tenant.
+type Cache struct {
+	cfg     Config
+	buckets *cache.LRUExpireCache
+}
+
+func NewCache(cfg Config) (*Cache, error) {
+	if cfg.Size <= 0 {
+		return nil, errors.New("size of the results cache must be positive")
+	}
+	if cfg.BucketSize <= 0 {
+		return nil, errors.New("bucket size of the results cache must be positive")
+	}
+	if cfg.MaxFreshness < 0 {
+		return nil, errors.New("max freshness of the results cache must not be negative")
+	}
+
+	return &Cache{
+		cfg:     cfg,
+		buckets: cache.NewLRUExpireCache(cfg.Size),
+	}, nil
+}
+
+// Cacheable tells whether the points of the range query are aligned to its step,
+// only then the points of a bucket are the same in all the queries.
+func (c *Cache) Cacheable(start time.Time, step time.Duration) bool {
+	if c == nil {
+		return false
+	}
+
+	stepMs := durationMs(step)
+	return stepMs > 0 && timeMs(start)%stepMs == 0 && durationMs(c.cfg.BucketSize)/stepMs < maxPointsPerRequest
+}
+
+type bucket struct {
+	// first and last points of the bucket.
+	first, last int64
+	// from and to are the points to fetch, the whole bucket if it is cacheable.
+	from, to  int64
+	cacheable bool
+	key       string
+	matrix    model.Matrix
+}
+
+// QueryRange answers the range query from the cached buckets, fetching the missing ones.
+// Consecutive missing buckets are fetched in a single upstream request.
+func (c *Cache) QueryRange(ctx context.Context, query string, r promapiv1.Range, fetch Fetcher) (model.Matrix, promapiv1.Warnings, error) {
+	startMs, endMs, stepMs := timeMs(r.Start), timeMs(r.End), durationMs(r.Step)
+	bucketMs := durationMs(c.cfg.BucketSize)
+	freshMs := timeMs(time.Now().Add(-c.cfg.MaxFreshness))
+
+	var buckets []*bucket
+	for idx := floorDiv(startMs, bucketMs); idx <= floorDiv(endMs, bucketMs); idx++ {
+		b := &bucket{
+			first: ceilDiv(idx*bucketMs, stepMs) * stepMs,
+			last:  floorDiv(idx*bucketMs+bucketMs-1, stepMs) * stepMs,
+		}
+		if b.first > b.last {
+			continue
+		}
+
+		b.cacheable = idx*bucketMs+bucketMs-1 < freshMs
+		b.from, b.to = b.first, b.last
+		if !b.cacheable {
+			b.from, b.to = max(b.first, startMs), min(b.last, endMs)
+		}
+
+		if b.cacheable {
+			b.key = fmt.Sprintf("%s\x00%d\x00%d", query, stepMs, idx)
+			if cached, exist := c.buckets.Get(b.key); exist {
+				cacheRequests.WithLabelValues("hit").Inc()
+				b.matrix = cached.(model.Matrix)
+			} else {
+				cacheRequests.WithLabelValues("miss").Inc()
+			}
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	var warnings promapiv1.Warnings
+	for i := 0; i < len(buckets); {
+		if buckets[i].matrix != nil {
+			i++
+			continue
+		}
+
+		// consecutive missing buckets
+		j := i + 1
+		for j < len(buckets) && buckets[j].matrix == nil && (buckets[j].to-buckets[i].from)/stepMs < maxPointsPerRequest {
+			j++
+		}
+
+		run := buckets[i:j]
+		matrix, runWarnings, err := fetch(ctx, promapiv1.Range{
+			Start: model.Time(run[0].from).Time(),
+			End:   model.Time(run[len(run)-1].to).Time(),
+			Step:  r.Step,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings = append(warnings, runWarnings...)
+
+		for _, b := range run {
+			b.matrix = slice(matrix, b.from, b.to)
+			if b.cacheable && len(runWarnings) == 0 {
+				c.buckets.Add(b.key, b.matrix, bucketTTL)
+			}
+		}
+
+		i = j
+	}
+
+	return merge(buckets, startMs, endMs), warnings, nil
+}
+
+// slice returns the points of the series between from and to.
+func slice(matrix model.Matrix, from, to int64) model.Matrix {
+	ret := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		lo := sort.Search(len(series.Values), func(i int) bool {
+			return int64(series.Values[i].Timestamp) >= from
+		})
+		hi := sort.Search(len(series.Values), func(i int) bool {
+			return int64(series.Values[i].Timestamp) > to
+		})
+		if lo == hi {
+			continue
+		}
+
+		ret = append(ret, &model.SampleStream{
+			Metric: series.Metric,
+			Values: series.Values[lo:hi:hi],
+		})
+	}
+
+	return ret
+}
+
+// merge joins the points of the series of the buckets between start and end.
+func merge(buckets []*bucket, startMs, endMs int64) model.Matrix {
+	series := make(map[model.Fingerprint]*model.SampleStream)
+	for _, b := range buckets {
+		for _, s := range slice(b.matrix, startMs, endMs) {
+			fp := s.Metric.Fingerprint()
+			merged, exist := series[fp]
+			if !exist {
+				merged = &model.SampleStream{Metric: s.Metric}
+				series[fp] = merged
+			}
+			merged.Values = append(merged.Values, s.Values...)
+		}
+	}
+
+	ret := make(model.Matrix, 0, len(series))
+	for _, s := range series {
+		ret = append(ret, s)
+	}
+	sort.Sort(ret)
+
+	return ret
+}
+
+func timeMs(t time.Time) int64 {
+	return int64(model.TimeFromUnixNano(t.UnixNano()))
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func ceilDiv(a, b int64) int64 {
+	return -floorDiv(-a, b)
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
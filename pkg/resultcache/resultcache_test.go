@@ -0,0 +1,140 @@
+// +build test
+
+package resultcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+type fakeUpstream struct {
+	ranges []promapiv1.Range
+}
+
+// fetch returns a series valued by the timestamp of its points,
+// and a second series only before the epoch second 7200.
+func (f *fakeUpstream) fetch(_ context.Context, r promapiv1.Range) (model.Matrix, promapiv1.Warnings, error) {
+	f.ranges = append(f.ranges, r)
+
+	up := &model.SampleStream{Metric: model.Metric{"__name__": "up", "namespace": "ns-a"}}
+	old := &model.SampleStream{Metric: model.Metric{"__name__": "up", "namespace": "ns-b"}}
+	for t := r.Start; !t.After(r.End); t = t.Add(r.Step) {
+		ts := model.TimeFromUnixNano(t.UnixNano())
+		up.Values = append(up.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts.Unix())})
+		if ts.Unix() < 7200 {
+			old.Values = append(old.Values, model.SamplePair{Timestamp: ts, Value: 1})
+		}
+	}
+
+	ret := model.Matrix{up}
+	if len(old.Values) != 0 {
+		ret = append(ret, old)
+	}
+
+	return ret, nil, nil
+}
+
+func checkPoints(t *testing.T, matrix model.Matrix, start, end time.Time, step time.Duration) {
+	var up *model.SampleStream
+	for _, series := range matrix {
+		if series.Metric["namespace"] == "ns-a" {
+			up = series
+		}
+	}
+	if up == nil {
+		t.Fatalf("expected the series of ns-a in %v", matrix)
+	}
+
+	expected := int(end.Sub(start)/step) + 1
+	if len(up.Values) != expected {
+		t.Fatalf("expected %d points, got %d", expected, len(up.Values))
+	}
+	for i, point := range up.Values {
+		if ts := start.Add(time.Duration(i) * step).Unix(); point.Timestamp.Unix() != ts || int64(point.Value) != ts {
+			t.Fatalf("unexpected point %d %v", i, point)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache, err := NewCache(Config{Size: 100, BucketSize: time.Hour, MaxFreshness: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := time.Minute
+	if cache.Cacheable(time.Unix(90, 0), step) {
+		t.Error("expected a start not aligned to the step not to be cacheable")
+	}
+	if !cache.Cacheable(time.Unix(120, 0), step) {
+		t.Error("expected a start aligned to the step to be cacheable")
+	}
+
+	upstream := &fakeUpstream{}
+	start, end := time.Unix(1800, 0), time.Unix(3*3600+1800, 0)
+
+	matrix, _, err := cache.QueryRange(context.Background(), "up", promapiv1.Range{Start: start, End: end, Step: step}, upstream.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPoints(t, matrix, start, end, step)
+	if len(matrix) != 2 || matrix[1].Values[len(matrix[1].Values)-1].Timestamp.Unix() != 7140 {
+		t.Errorf("unexpected series %v", matrix)
+	}
+	if len(upstream.ranges) != 1 || upstream.ranges[0].Start.Unix() != 0 || upstream.ranges[0].End.Unix() != 4*3600-60 {
+		t.Errorf("expected the whole buckets to be fetched at once, got %v", upstream.ranges)
+	}
+
+	// shifted by a bucket, only the new bucket is fetched
+	upstream.ranges = nil
+	start, end = start.Add(time.Hour), end.Add(time.Hour)
+	matrix, _, err = cache.QueryRange(context.Background(), "up", promapiv1.Range{Start: start, End: end, Step: step}, upstream.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPoints(t, matrix, start, end, step)
+	if len(upstream.ranges) != 1 || upstream.ranges[0].Start.Unix() != 4*3600 || upstream.ranges[0].End.Unix() != 5*3600-60 {
+		t.Errorf("expected only the missing bucket to be fetched, got %v", upstream.ranges)
+	}
+
+	// another expression does not share the buckets
+	upstream.ranges = nil
+	if _, _, err := cache.QueryRange(context.Background(), `up{namespace="ns-a"}`, promapiv1.Range{Start: start, End: end, Step: step}, upstream.fetch); err != nil {
+		t.Fatal(err)
+	}
+	if len(upstream.ranges) != 1 {
+		t.Errorf("expected the other expression to be fetched, got %v", upstream.ranges)
+	}
+}
+
+func TestCacheFreshTail(t *testing.T) {
+	cache, err := NewCache(Config{Size: 100, BucketSize: time.Hour, MaxFreshness: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := 30 * time.Second
+	end := time.Now().Truncate(step)
+	start := end.Add(-3 * time.Hour)
+
+	for i := 0; i < 2; i++ {
+		upstream := &fakeUpstream{}
+		matrix, _, err := cache.QueryRange(context.Background(), "up", promapiv1.Range{Start: start, End: end, Step: step}, upstream.fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPoints(t, matrix, start, end, step)
+
+		last := upstream.ranges[len(upstream.ranges)-1]
+		if !last.End.Equal(end) {
+			t.Errorf("expected the fresh tail to be fetched up to the end, got %v", upstream.ranges)
+		}
+		if i == 1 && (len(upstream.ranges) != 1 || end.Sub(last.Start) > 2*time.Hour) {
+			t.Errorf("expected only the fresh tail to be fetched again, got %v", upstream.ranges)
+		}
+	}
+}
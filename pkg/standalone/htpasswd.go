@@ -0,0 +1,122 @@
+package standalone
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shaPrefix = "{SHA}"
+
+	verifiedPasswordTTL  = 30 * time.Second
+	maxVerifiedPasswords = 1024
+)
+
+func parseHtpasswd(raw []byte) (map[string]string, error) {
+	ret := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("malformed line %d", lineNum)
+		}
+
+		name, hash := parts[0], parts[1]
+		if !strings.HasPrefix(hash, shaPrefix) && !isBcrypt(hash) {
+			return nil, errors.Errorf("unsupported hash of user %q on line %d, only bcrypt and SHA are supported", name, lineNum)
+		}
+
+		ret[name] = hash
+	}
+
+	return ret, scanner.Err()
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func verifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, shaPrefix) {
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash[len(shaPrefix):], base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// verifiedPasswords remembers the successful password verifications briefly, as bcrypt is slow by design.
+// They are keyed by an HMAC of the credentials with a random key of the process, the passwords never stay in memory.
+type verifiedPasswords struct {
+	key []byte
+	now func() time.Time
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newVerifiedPasswords() (*verifiedPasswords, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Annotate(err, "unable to generate the password cache key")
+	}
+
+	return &verifiedPasswords{
+		key:     key,
+		now:     time.Now,
+		expires: make(map[string]time.Time),
+	}, nil
+}
+
+func (v *verifiedPasswords) verify(name, hash, password string) bool {
+	// the user name has no colon, nor the hash, so the fields can't be shifted
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(name + ":" + password + ":" + hash))
+	key := hex.EncodeToString(mac.Sum(nil))
+
+	now := v.now()
+	v.mu.Lock()
+	expires, exist := v.expires[key]
+	v.mu.Unlock()
+	if exist && now.Before(expires) {
+		return true
+	}
+
+	if !verifyPassword(hash, password) {
+		return false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.expires) >= maxVerifiedPasswords {
+		for k, e := range v.expires {
+			if !now.Before(e) {
+				delete(v.expires, k)
+			}
+		}
+	}
+	if len(v.expires) < maxVerifiedPasswords {
+		v.expires[key] = now.Add(verifiedPasswordTTL)
+	}
+
+	return true
+}
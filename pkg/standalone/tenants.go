@@ -0,0 +1,303 @@
+package standalone
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the YAML file describing the tenants without Kubernetes,
+// the namespaces are the values of the tenant label in the metrics,
+// admins can access all metrics.
+type Config struct {
+	Htpasswd string        `json:"htpasswd,omitempty"`
+	Users    []UserConfig  `json:"users,omitempty"`
+	Groups   []GroupConfig `json:"groups,omitempty"`
+}
+
+type UserConfig struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Admin      bool     `json:"admin,omitempty"`
+}
+
+type GroupConfig struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Admin      bool     `json:"admin,omitempty"`
+}
+
+type tenantSet struct {
+	users       map[string]UserConfig
+	groups      map[string]GroupConfig
+	tokenUsers  map[string]string
+	credentials map[string]string
+	modTimes    map[string]time.Time
+}
+
+// Tenants serves the users, groups and tenant label values of a standalone config file,
+// it implements kube.Namespaces and kube.Nodes.
+type Tenants struct {
+	path     string
+	verified *verifiedPasswords
+
+	mu  sync.RWMutex
+	set *tenantSet
+}
+
+func NewTenants(ctx context.Context, path string, reloadInterval time.Duration) (*Tenants, error) {
+	verified, err := newVerifiedPasswords()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tenants{
+		path:     path,
+		verified: verified,
+	}
+
+	set, err := loadTenantSet(path)
+	if err != nil {
+		return nil, err
+	}
+	t.set = set
+
+	if reloadInterval > 0 {
+		go t.run(ctx, reloadInterval)
+	}
+
+	return t, nil
+}
+
+func (t *Tenants) run(ctx context.Context, reloadInterval time.Duration) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.changed() {
+				continue
+			}
+
+			set, err := loadTenantSet(t.path)
+			if err != nil {
+				log.WithError(err).Errorf("failed to reload standalone config %s, keep serving the previous one", t.path)
+				continue
+			}
+
+			t.mu.Lock()
+			t.set = set
+			t.mu.Unlock()
+
+			log.Infof("reloaded standalone config %s", t.path)
+		}
+	}
+}
+
+func (t *Tenants) changed() bool {
+	t.mu.RLock()
+	modTimes := t.set.modTimes
+	t.mu.RUnlock()
+
+	for path, modTime := range modTimes {
+		stat, err := os.Stat(path)
+		if err != nil || !stat.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tenants) current() *tenantSet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.set
+}
+
+func (t *Tenants) AuthenticateToken(token string) (*user.DefaultInfo, bool) {
+	set := t.current()
+
+	name, exist := set.tokenUsers[hashToken(token)]
+	if !exist {
+		return nil, false
+	}
+
+	return set.userInfo(name), true
+}
+
+// HasCredentials tells whether some users authenticate with a password.
+func (t *Tenants) HasCredentials() bool {
+	return t != nil && len(t.current().credentials) != 0
+}
+
+func (t *Tenants) AuthenticateBasic(name, password string) (*user.DefaultInfo, bool) {
+	set := t.current()
+
+	hash, exist := set.credentials[name]
+	if !exist {
+		return nil, false
+	}
+
+	if !t.verified.verify(name, hash, password) {
+		return nil, false
+	}
+
+	return set.userInfo(name), true
+}
+
+func (t *Tenants) QueryByUser(info *user.DefaultInfo) data.Set {
+	set := t.current()
+
+	ret := data.Set{}
+	if u, exist := set.users[info.Name]; exist {
+		for _, ns := range u.Namespaces {
+			ret[ns] = struct{}{}
+		}
+	}
+
+	for _, name := range info.Groups {
+		if g, exist := set.groups[name]; exist {
+			for _, ns := range g.Namespaces {
+				ret[ns] = struct{}{}
+			}
+		}
+	}
+
+	return ret
+}
+
+func (t *Tenants) CanList(info *user.DefaultInfo) bool {
+	set := t.current()
+
+	if u, exist := set.users[info.Name]; exist && u.Admin {
+		return true
+	}
+
+	for _, name := range info.Groups {
+		if g, exist := set.groups[name]; exist && g.Admin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *tenantSet) userInfo(name string) *user.DefaultInfo {
+	info := &user.DefaultInfo{
+		Name: name,
+		UID:  name,
+	}
+
+	if u, exist := s.users[name]; exist {
+		info.Groups = u.Groups
+	}
+
+	return info
+}
+
+func loadTenantSet(path string) (*tenantSet, error) {
+	set := &tenantSet{
+		users:       map[string]UserConfig{},
+		groups:      map[string]GroupConfig{},
+		tokenUsers:  map[string]string{},
+		credentials: map[string]string{},
+		modTimes:    map[string]time.Time{},
+	}
+
+	raw, err := readFile(path, set.modTimes)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+		return nil, errors.Annotatef(err, "unable to parse standalone config %s", path)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name == "" {
+			return nil, errors.Errorf("standalone config %s has an user without name", path)
+		}
+		if _, exist := set.users[u.Name]; exist {
+			return nil, errors.Errorf("standalone config %s has duplicated user %q", path, u.Name)
+		}
+		set.users[u.Name] = u
+
+		if u.Token != "" {
+			tokenHash := hashToken(u.Token)
+			if _, exist := set.tokenUsers[tokenHash]; exist {
+				return nil, errors.Errorf("standalone config %s has duplicated token for user %q", path, u.Name)
+			}
+			set.tokenUsers[tokenHash] = u.Name
+		}
+	}
+
+	for _, g := range cfg.Groups {
+		if g.Name == "" {
+			return nil, errors.Errorf("standalone config %s has a group without name", path)
+		}
+		set.groups[g.Name] = g
+	}
+
+	if cfg.Htpasswd != "" {
+		htpasswdPath := cfg.Htpasswd
+		if !filepath.IsAbs(htpasswdPath) {
+			htpasswdPath = filepath.Join(filepath.Dir(path), htpasswdPath)
+		}
+
+		raw, err := readFile(htpasswdPath, set.modTimes)
+		if err != nil {
+			return nil, err
+		}
+
+		set.credentials, err = parseHtpasswd(raw)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to parse htpasswd %s", htpasswdPath)
+		}
+	}
+
+	return set, nil
+}
+
+func readFile(path string, modTimes map[string]time.Time) ([]byte, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to stat %s", path)
+	}
+	modTimes[path] = stat.ModTime()
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read %s", path)
+	}
+
+	return raw, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,170 @@
+// +build test
+
+package standalone
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const testConfig = `
+htpasswd: htpasswd
+users:
+- name: alice
+  groups: [team-a]
+  namespaces: [ns-a]
+- name: exporter
+  token: static-token
+  namespaces: [ns-b]
+groups:
+- name: team-a
+  namespaces: [ns-c, ns-d]
+- name: ops
+  admin: true
+`
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(dir, "tenants.yaml")
+	writeFile(t, configPath, testConfig)
+	writeFile(t, filepath.Join(dir, "htpasswd"), "alice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tenants, err := NewTenants(ctx, configPath, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, ok := tenants.AuthenticateBasic("alice", "alice-password")
+	if !ok {
+		t.Fatal("expected alice to authenticate")
+	}
+	if got, want := tenants.QueryByUser(alice), data.NewSet("ns-a", "ns-c", "ns-d"); got.String() != want.String() {
+		t.Errorf("alice: got namespaces %s, want %s", got, want)
+	}
+	if tenants.CanList(alice) {
+		t.Error("alice should not be an admin")
+	}
+
+	if _, ok := tenants.AuthenticateBasic("alice", "wrong"); ok {
+		t.Error("expected wrong password to fail")
+	}
+
+	bob, ok := tenants.AuthenticateBasic("bob", "password")
+	if !ok {
+		t.Fatal("expected bob to authenticate with SHA password")
+	}
+	if got := tenants.QueryByUser(bob); len(got) != 0 {
+		t.Errorf("bob: expected no namespaces, got %s", got)
+	}
+
+	exporter, ok := tenants.AuthenticateToken("static-token")
+	if !ok {
+		t.Fatal("expected static token to authenticate")
+	}
+	if got := tenants.QueryByUser(exporter).String(); got != "ns-b" {
+		t.Errorf("exporter: got namespaces %s, want ns-b", got)
+	}
+
+	if _, ok := tenants.AuthenticateToken("guess"); ok {
+		t.Error("expected unknown token to fail")
+	}
+
+	if !tenants.CanList(&user.DefaultInfo{Name: "carol", Groups: []string{"ops"}}) {
+		t.Error("expected ops group to be admin")
+	}
+
+	// hot reload
+	time.Sleep(20 * time.Millisecond)
+	writeFile(t, configPath, testConfig+"- name: team-b\n  namespaces: [ns-e]\n")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(configPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got := tenants.QueryByUser(&user.DefaultInfo{Name: "dave", Groups: []string{"team-b"}}).String(); got == "ns-e" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("standalone config was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// invalid config keeps the previous one
+	writeFile(t, configPath, "users: [")
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(configPath, past, past); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := tenants.AuthenticateToken("static-token"); !ok {
+		t.Error("expected the previous config to be kept after a failed reload")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifiedPasswords(t *testing.T) {
+	verified, err := newVerifiedPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	verified.now = func() time.Time { return now }
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHash, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.verify("alice", string(hash), "wrong") || len(verified.expires) != 0 {
+		t.Errorf("expected the wrong password refused and not cached, got %d entries", len(verified.expires))
+	}
+	if !verified.verify("alice", string(hash), "password") || !verified.verify("alice", string(hash), "password") || len(verified.expires) != 1 {
+		t.Errorf("expected the password verified and cached once, got %d entries", len(verified.expires))
+	}
+	for key := range verified.expires {
+		if len(key) != 64 {
+			t.Errorf("expected the entries keyed by an HMAC, got %q", key)
+		}
+	}
+	if verified.verify("alice", string(otherHash), "password") {
+		t.Error("expected the cached password refused once the hash changes")
+	}
+
+	now = now.Add(verifiedPasswordTTL)
+	if !verified.verify("alice", string(hash), "password") || len(verified.expires) != 1 {
+		t.Errorf("expected the expired password verified again, got %d entries", len(verified.expires))
+	}
+}
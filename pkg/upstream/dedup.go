@@ -0,0 +1,552 @@
+package upstream
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	promgo "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// initialPenalty is the gap filled from the other replica when the scrape interval of a replica is unknown.
+	initialPenalty = 5000
+)
+
+var (
+	replicaErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prometheus_auth",
+			Name:      "upstream_replica_errors_total",
+			Help:      "Number of the failed requests to a replica of an upstream, answered by the other replicas.",
+		},
+		[]string{"upstream", "replica"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicaErrors)
+}
+
+// each calls the function concurrently for every replica, and fails with the error of the first replica when all of them fail.
+func (u *Upstream) each(ctx context.Context, fn func(ctx context.Context, idx int, r *replica) error) error {
+	errs := make([]error, len(u.replicas))
+
+	var wg sync.WaitGroup
+	for idx, r := range u.replicas {
+		wg.Add(1)
+		go func(idx int, r *replica) {
+			defer wg.Done()
+			errs[idx] = fn(ctx, idx, r)
+		}(idx, r)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == len(errs) {
+		return errs[0]
+	}
+
+	for idx, err := range errs {
+		if err != nil {
+			replicaErrors.WithLabelValues(u.Name, u.replicas[idx].url.Host).Inc()
+			log.Warnf("replica %s of upstream %q failed: %v", u.replicas[idx].url.Host, u.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// first calls the function for the replicas one after the other, until a replica answers,
+// and fails with the error of the first replica when all of them fail.
+func (u *Upstream) first(ctx context.Context, fn func(ctx context.Context, idx int, r *replica) error) error {
+	var firstErr error
+	for idx, r := range u.replicas {
+		err := fn(ctx, idx, r)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil || idx == len(u.replicas)-1 {
+			break
+		}
+
+		replicaErrors.WithLabelValues(u.Name, r.url.Host).Inc()
+		log.Warnf("replica %s of upstream %q failed, querying the next one: %v", r.url.Host, u.Name, err)
+	}
+
+	return firstErr
+}
+
+// withoutReplica returns the metric without the replica label, the metric is not modified.
+func (u *Upstream) withoutReplica(metric model.Metric) model.Metric {
+	if _, exist := metric[model.LabelName(u.replicaLabel)]; !exist {
+		return metric
+	}
+
+	ret := metric.Clone()
+	delete(ret, model.LabelName(u.replicaLabel))
+
+	return ret
+}
+
+// dedupValue merges the query results of the replicas, the results of the first replicas win.
+func (u *Upstream) dedupValue(values []model.Value) model.Value {
+	vectors := make([]model.Vector, 0, len(values))
+	matrices := make([]model.Matrix, 0, len(values))
+	var first model.Value
+	for _, value := range values {
+		switch v := value.(type) {
+		case model.Vector:
+			vectors = append(vectors, v)
+		case model.Matrix:
+			matrices = append(matrices, v)
+		}
+		if first == nil {
+			first = value
+		}
+	}
+
+	switch first.(type) {
+	case model.Vector:
+		return u.dedupVector(vectors)
+	case model.Matrix:
+		return u.dedupMatrix(matrices)
+	}
+
+	return first
+}
+
+// mergeable tells whether the query results of the replicas can be merged series by series and step by step.
+// An aggregation or a range function over the missed scrapes of a replica returns a wrong value instead of no value,
+// such results are not merged, like the selectors of the absent function.
+func mergeable(query string) bool {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+
+	ret := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.AggregateExpr, *parser.MatrixSelector, *parser.SubqueryExpr:
+			ret = false
+		case *parser.Call:
+			if n.Func.Name == "absent" {
+				ret = false
+			}
+		}
+		return nil
+	})
+
+	return ret
+}
+
+func (u *Upstream) dedupVector(parts []model.Vector) model.Vector {
+	ret := make(model.Vector, 0)
+	seen := make(map[model.Fingerprint]struct{})
+
+	for _, part := range parts {
+		for _, sample := range part {
+			metric := u.withoutReplica(sample.Metric)
+			fp := metric.Fingerprint()
+			if _, exist := seen[fp]; exist {
+				continue
+			}
+			seen[fp] = struct{}{}
+
+			ret = append(ret, &model.Sample{Metric: metric, Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+	}
+
+	return ret
+}
+
+// dedupMatrix fills the missing points of the series of the first replicas from the other ones,
+// the points of the evaluated series are aligned on the steps of the query.
+func (u *Upstream) dedupMatrix(parts []model.Matrix) model.Matrix {
+	ret := make(model.Matrix, 0)
+	index := make(map[model.Fingerprint]*model.SampleStream)
+	filled := make(map[model.Fingerprint]map[model.Time]struct{})
+
+	for _, part := range parts {
+		for _, series := range part {
+			metric := u.withoutReplica(series.Metric)
+			fp := metric.Fingerprint()
+
+			stream, exist := index[fp]
+			if !exist {
+				stream = &model.SampleStream{Metric: metric, Values: append([]model.SamplePair(nil), series.Values...)}
+				index[fp] = stream
+				ret = append(ret, stream)
+				continue
+			}
+
+			points, exist := filled[fp]
+			if !exist {
+				points = make(map[model.Time]struct{}, len(stream.Values))
+				for _, point := range stream.Values {
+					points[point.Timestamp] = struct{}{}
+				}
+				filled[fp] = points
+			}
+
+			for _, point := range series.Values {
+				if _, exist := points[point.Timestamp]; !exist {
+					points[point.Timestamp] = struct{}{}
+					stream.Values = append(stream.Values, point)
+				}
+			}
+		}
+	}
+
+	for fp := range filled {
+		values := index[fp].Values
+		sort.Slice(values, func(i, j int) bool {
+			return values[i].Timestamp < values[j].Timestamp
+		})
+	}
+
+	return ret
+}
+
+func (u *Upstream) dedupLabelSets(parts [][]model.LabelSet) []model.LabelSet {
+	ret := make([]model.LabelSet, 0)
+	seen := make(map[model.Fingerprint]struct{})
+
+	for _, part := range parts {
+		for _, set := range part {
+			metric := u.withoutReplica(model.Metric(set))
+			fp := metric.Fingerprint()
+			if _, exist := seen[fp]; !exist {
+				seen[fp] = struct{}{}
+				ret = append(ret, model.LabelSet(metric))
+			}
+		}
+	}
+
+	return ret
+}
+
+// dedupMetricFamilies merges the federations of the replicas by metric family,
+// the series of the first replicas win.
+func (u *Upstream) dedupMetricFamilies(parts [][]*promgo.MetricFamily) []*promgo.MetricFamily {
+	families := MergeMetricFamilies(parts)
+
+	for _, family := range families {
+		metrics := make([]*promgo.Metric, 0, len(family.Metric))
+		seen := make(map[string]struct{}, len(family.Metric))
+		for _, metric := range family.Metric {
+			labels := make([]*promgo.LabelPair, 0, len(metric.Label))
+			for _, label := range metric.Label {
+				if label.GetName() != u.replicaLabel {
+					labels = append(labels, label)
+				}
+			}
+
+			key := metricKey(labels)
+			if _, exist := seen[key]; exist {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			metric.Label = labels
+			metrics = append(metrics, metric)
+		}
+		family.Metric = metrics
+	}
+
+	return families
+}
+
+// dedupReadResponses merges the series of the replicas query by query, see dedupSamples.
+func (u *Upstream) dedupReadResponses(parts []*prompb.ReadResponse, queries int) *prompb.ReadResponse {
+	ret := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, queries)}
+
+	for idx := 0; idx < queries; idx++ {
+		result := &prompb.QueryResult{}
+		index := make(map[string]*prompb.TimeSeries)
+
+		for _, part := range parts {
+			if part == nil || idx >= len(part.Results) {
+				continue
+			}
+
+			for _, ts := range part.Results[idx].Timeseries {
+				labels := make([]prompb.Label, 0, len(ts.Labels))
+				for _, label := range ts.Labels {
+					if label.Name != u.replicaLabel {
+						labels = append(labels, label)
+					}
+				}
+
+				key := labelsKey(labels)
+				if merged, exist := index[key]; exist {
+					merged.Samples = dedupSamples(merged.Samples, ts.Samples)
+					continue
+				}
+
+				merged := &prompb.TimeSeries{Labels: labels, Samples: ts.Samples}
+				index[key] = merged
+				result.Timeseries = append(result.Timeseries, merged)
+			}
+		}
+
+		ret.Results = append(ret.Results, result)
+	}
+
+	return ret
+}
+
+// dedupSamples merges the raw samples of two replicas of a series like Thanos does: the samples of a replica
+// are kept until the next sample of the other replica is earlier than its own by more than a penalty,
+// twice its scrape interval, then the other replica is followed.
+func dedupSamples(a, b []prompb.Sample) []prompb.Sample {
+	ret := make([]prompb.Sample, 0, len(a))
+	i, j := 0, 0
+	useA := true
+	penaltyA, penaltyB := penalty(a), penalty(b)
+	lastT := int64(math.MinInt64)
+
+	for {
+		for i < len(a) && a[i].Timestamp <= lastT {
+			i++
+		}
+		for j < len(b) && b[j].Timestamp <= lastT {
+			j++
+		}
+
+		switch {
+		case i == len(a) && j == len(b):
+			return ret
+		case i == len(a):
+			useA = false
+		case j == len(b):
+			useA = true
+		case useA && b[j].Timestamp < a[i].Timestamp-penaltyA:
+			useA = false
+		case !useA && a[i].Timestamp < b[j].Timestamp-penaltyB:
+			useA = true
+		}
+
+		var next prompb.Sample
+		if useA {
+			next = a[i]
+		} else {
+			next = b[j]
+		}
+		lastT = next.Timestamp
+		ret = append(ret, next)
+	}
+}
+
+// penalty is twice the scrape interval of a replica, the shortest one between its samples.
+func penalty(samples []prompb.Sample) int64 {
+	interval := int64(math.MaxInt64)
+	for idx := 1; idx < len(samples); idx++ {
+		if delta := samples[idx].Timestamp - samples[idx-1].Timestamp; delta > 0 && delta < interval {
+			interval = delta
+		}
+	}
+	if interval == math.MaxInt64 {
+		return initialPenalty
+	}
+
+	return 2 * interval
+}
+
+func metricKey(labels []*promgo.LabelPair) string {
+	sb := &strings.Builder{}
+	for _, label := range labels {
+		sb.WriteString(label.GetName())
+		sb.WriteByte(0)
+		sb.WriteString(label.GetValue())
+		sb.WriteByte(0)
+	}
+
+	return sb.String()
+}
+
+func labelsKey(labels []prompb.Label) string {
+	sb := &strings.Builder{}
+	for _, label := range labels {
+		sb.WriteString(label.Name)
+		sb.WriteByte(0)
+		sb.WriteString(label.Value)
+		sb.WriteByte(0)
+	}
+
+	return sb.String()
+}
+
+// replicatedAPI queries every replica of the upstream and deduplicates their results,
+// the other endpoints are answered by the first replica.
+type replicatedAPI struct {
+	promapiv1.API
+	upstream *Upstream
+}
+
+func (a *replicatedAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, promapiv1.Warnings, error) {
+	u := a.upstream
+	if !mergeable(query) {
+		var value model.Value
+		var warnings promapiv1.Warnings
+		err := u.first(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+			value, warnings, err = r.api.Query(ctx, query, ts)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return u.dedupValue([]model.Value{value}), warnings, nil
+	}
+
+	values := make([]model.Value, len(u.replicas))
+	warnings := make([]promapiv1.Warnings, len(u.replicas))
+	err := u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		values[idx], warnings[idx], err = r.api.Query(ctx, query, ts)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return u.dedupValue(values), mergeWarnings(warnings), nil
+}
+
+func (a *replicatedAPI) QueryRange(ctx context.Context, query string, r promapiv1.Range) (model.Value, promapiv1.Warnings, error) {
+	u := a.upstream
+	if !mergeable(query) {
+		var value model.Value
+		var warnings promapiv1.Warnings
+		err := u.first(ctx, func(ctx context.Context, idx int, rep *replica) (err error) {
+			value, warnings, err = rep.api.QueryRange(ctx, query, r)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return u.dedupValue([]model.Value{value}), warnings, nil
+	}
+
+	values := make([]model.Value, len(u.replicas))
+	warnings := make([]promapiv1.Warnings, len(u.replicas))
+	err := u.each(ctx, func(ctx context.Context, idx int, rep *replica) (err error) {
+		values[idx], warnings[idx], err = rep.api.QueryRange(ctx, query, r)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return u.dedupValue(values), mergeWarnings(warnings), nil
+}
+
+func (a *replicatedAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, promapiv1.Warnings, error) {
+	u := a.upstream
+	sets := make([][]model.LabelSet, len(u.replicas))
+	warnings := make([]promapiv1.Warnings, len(u.replicas))
+
+	err := u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		sets[idx], warnings[idx], err = r.api.Series(ctx, matches, startTime, endTime)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return u.dedupLabelSets(sets), mergeWarnings(warnings), nil
+}
+
+func (a *replicatedAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, promapiv1.Warnings, error) {
+	u := a.upstream
+	parts := make([]model.LabelValues, len(u.replicas))
+	warnings := make([]promapiv1.Warnings, len(u.replicas))
+
+	err := u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		parts[idx], warnings[idx], err = r.api.LabelValues(ctx, label)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[model.LabelValue]struct{})
+	values := make(model.LabelValues, 0)
+	for _, part := range parts {
+		for _, value := range part {
+			if _, exist := seen[value]; !exist {
+				seen[value] = struct{}{}
+				values = append(values, value)
+			}
+		}
+	}
+	sort.Sort(values)
+
+	return values, mergeWarnings(warnings), nil
+}
+
+// replicatedMetricNames lists the metric names of every replica of the upstream.
+type replicatedMetricNames struct {
+	upstream *Upstream
+}
+
+func (l *replicatedMetricNames) Names(ctx context.Context, namespaces []string, start, end time.Time) ([]string, error) {
+	u := l.upstream
+	parts := make([][]string, len(u.replicas))
+
+	err := u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		parts[idx], err = r.metricNames.Names(ctx, namespaces, start, end)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for _, part := range parts {
+		for _, name := range part {
+			if _, exist := seen[name]; !exist {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func mergeWarnings(parts []promapiv1.Warnings) promapiv1.Warnings {
+	var ret promapiv1.Warnings
+	seen := make(map[string]struct{})
+	for _, warnings := range parts {
+		for _, warning := range warnings {
+			if _, exist := seen[warning]; !exist {
+				seen[warning] = struct{}{}
+				ret = append(ret, warning)
+			}
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,221 @@
+// +build test
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func newTestReplicas(t *testing.T, handlers ...http.HandlerFunc) *Upstream {
+	urls := make([]*url.URL, 0, len(handlers))
+	for _, handler := range handlers {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+
+		u, _ := url.Parse(server.URL)
+		urls = append(urls, u)
+	}
+
+	u, err := New(context.Background(), "ha", urls, Options{ReplicaLabel: "prometheus_replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestDedupSamples(t *testing.T) {
+	samples := func(timestamps ...int64) []prompb.Sample {
+		ret := make([]prompb.Sample, 0, len(timestamps))
+		for _, ts := range timestamps {
+			ret = append(ret, prompb.Sample{Timestamp: ts})
+		}
+		return ret
+	}
+	timestamps := func(samples []prompb.Sample) []int64 {
+		ret := make([]int64, 0, len(samples))
+		for _, s := range samples {
+			ret = append(ret, s.Timestamp)
+		}
+		return ret
+	}
+
+	// the replicas scrape every 15s, 7s apart, the first one misses 60s to 120s
+	a := samples(0, 15000, 30000, 45000, 60000, 120000, 135000)
+	b := samples(7000, 22000, 37000, 52000, 67000, 82000, 97000, 112000, 127000, 142000)
+
+	var testCases = []struct {
+		a, b     []prompb.Sample
+		expected []int64
+	}{
+		{a: a, b: nil, expected: timestamps(a)},
+		{a: nil, b: b, expected: timestamps(b)},
+		{a: a, b: a, expected: timestamps(a)},
+		{a: a, b: b, expected: []int64{0, 15000, 30000, 45000, 60000, 67000, 82000, 97000, 112000, 127000, 142000}},
+		{a: b[:4], b: a, expected: []int64{7000, 22000, 37000, 52000, 60000, 120000, 135000}},
+	}
+	for _, tc := range testCases {
+		if got := timestamps(dedupSamples(tc.a, tc.b)); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v + %v => expected %v, got %v", timestamps(tc.a), timestamps(tc.b), tc.expected, got)
+		}
+	}
+}
+
+func TestReplicatedQuery(t *testing.T) {
+	replica := func(name string, points string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/query":
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a","prometheus_replica":%q},"value":[1,"1"]}]}}`, name)
+			case "/api/v1/query_range":
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a","prometheus_replica":%q},"values":[%s]}]}}`, name, points)
+			case "/api/v1/series":
+				fmt.Fprintf(w, `{"status":"success","data":[{"__name__":"up","prometheus_replica":%q}]}`, name)
+			}
+		}
+	}
+	down := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}
+
+	u := newTestReplicas(t, replica("a", `[1,"1"],[3,"3"]`), replica("b", `[1,"10"],[2,"20"],[3,"30"]`))
+	if !u.Replicated() {
+		t.Fatal("expected a replicated upstream")
+	}
+
+	val, _, err := u.API.Query(context.Background(), "up", time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{job="a"} => 1 @[1]`; val.String() != expected {
+		t.Errorf("expected %s, got %s", expected, val)
+	}
+
+	val, _, err = u.API.QueryRange(context.Background(), "up", promapiv1.Range{Start: time.Unix(1, 0), End: time.Unix(3, 0), Step: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix := val.(model.Matrix)
+	if len(matrix) != 1 || matrix[0].Metric.String() != `{job="a"}` {
+		t.Fatalf("expected a single series without the replica label, got %s", matrix)
+	}
+	expected := []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 20}, {Timestamp: 3000, Value: 3}}
+	if !reflect.DeepEqual(matrix[0].Values, expected) {
+		t.Errorf("expected the gap filled from the other replica %v, got %v", expected, matrix[0].Values)
+	}
+
+	// the aggregations are not merged, they are sent to the next replica only when the first one fails
+	var queried []string
+	counted := func(name string, handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			queried = append(queried, name)
+			handler(w, r)
+		}
+	}
+	aggregation := promapiv1.Range{Start: time.Unix(1, 0), End: time.Unix(3, 0), Step: time.Second}
+
+	u = newTestReplicas(t, counted("a", replica("a", `[1,"1"],[3,"3"]`)), counted("b", replica("b", `[1,"10"],[2,"20"],[3,"30"]`)))
+	val, _, err = u.API.QueryRange(context.Background(), "sum(rate(up[5m]))", aggregation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix = val.(model.Matrix)
+	expected = []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 3}}
+	if len(matrix) != 1 || !reflect.DeepEqual(matrix[0].Values, expected) {
+		t.Errorf("expected the aggregation of the first replica only %v, got %s", expected, matrix)
+	}
+	if !reflect.DeepEqual(queried, []string{"a"}) {
+		t.Errorf("expected the first replica queried only, got %v", queried)
+	}
+
+	queried = nil
+	u = newTestReplicas(t, counted("a", down), counted("b", replica("b", `[1,"10"]`)))
+	val, _, err = u.API.QueryRange(context.Background(), "sum(rate(up[5m]))", aggregation)
+	if err != nil || len(val.(model.Matrix)) != 1 {
+		t.Errorf("expected the aggregation of the other replica, got %v, %v", val, err)
+	}
+	if !reflect.DeepEqual(queried, []string{"a", "b"}) {
+		t.Errorf("expected the other replica queried after the failure, got %v", queried)
+	}
+	if _, _, err := newTestReplicas(t, down, down).API.Query(context.Background(), "sum(up)", time.Unix(1, 0)); err == nil {
+		t.Error("expected an error when every replica is down")
+	}
+
+	u = newTestReplicas(t, replica("a", `[1,"1"],[3,"3"]`), replica("b", `[1,"10"],[2,"20"],[3,"30"]`))
+
+	series, _, err := u.API.Series(context.Background(), []string{"up"}, time.Unix(0, 0), time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || series[0].String() != `{__name__="up"}` {
+		t.Errorf("expected the series deduplicated, got %v", series)
+	}
+
+	u = newTestReplicas(t, down, replica("b", `[1,"10"]`))
+	if val, _, err := u.API.Query(context.Background(), "up", time.Unix(1, 0)); err != nil || len(val.(model.Vector)) != 1 {
+		t.Errorf("expected the answer of the other replica, got %v, %v", val, err)
+	}
+
+	u = newTestReplicas(t, down, down)
+	if _, _, err := u.API.Query(context.Background(), "up", time.Unix(1, 0)); err == nil {
+		t.Error("expected an error when every replica is down")
+	}
+}
+
+func TestMergeable(t *testing.T) {
+	var testCases = []struct {
+		query    string
+		expected bool
+	}{
+		{query: `up`, expected: true},
+		{query: `up{namespace="ns-a"} / on(instance) node_load1 > 1`, expected: true},
+		{query: `abs(up)`, expected: true},
+		{query: `sum(up)`, expected: false},
+		{query: `rate(http_requests_total[5m])`, expected: false},
+		{query: `max_over_time(up[1h:5m])`, expected: false},
+		{query: `absent(up)`, expected: false},
+		{query: `up{`, expected: false},
+	}
+	for _, tc := range testCases {
+		if got := mergeable(tc.query); got != tc.expected {
+			t.Errorf("%s: expected mergeable %v, got %v", tc.query, tc.expected, got)
+		}
+	}
+}
+
+func TestReplicatedFederate(t *testing.T) {
+	replica := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "# TYPE up untyped")
+			fmt.Fprintf(w, "up{namespace=\"ns-a\",prometheus_replica=%q} 1 1000\n", name)
+			if name == "b" {
+				fmt.Fprintf(w, "up{namespace=\"ns-b\",prometheus_replica=%q} 1 1000\n", name)
+			}
+		}
+	}
+
+	u := newTestReplicas(t, replica("a"), replica("b"))
+	families, err := u.Federate(context.Background(), []string{"up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("expected the series of both replicas deduplicated, got %v", families)
+	}
+	for _, metric := range families[0].Metric {
+		if len(metric.Label) != 1 {
+			t.Errorf("expected the replica label dropped, got %v", metric.Label)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type proxyAttemptKey struct{}
+
+// proxyAttempt is the state of a request sent to a replica, the failures of all but the last replica are not answered.
+type proxyAttempt struct {
+	last   bool
+	failed error
+}
+
+// failoverProxy proxies the requests to the first replica answering,
+// the next replica is tried when a replica cannot be reached or fails with a 5xx status.
+type failoverProxy struct {
+	upstream *Upstream
+	proxies  []*httputil.ReverseProxy
+}
+
+func newFailoverProxy(u *Upstream) *failoverProxy {
+	p := &failoverProxy{upstream: u}
+	for _, r := range u.replicas {
+		proxy := httputil.NewSingleHostReverseProxy(r.url)
+		proxy.ModifyResponse = modifyReplicaResponse
+		proxy.ErrorHandler = replicaErrorHandler
+		p.proxies = append(p.proxies, proxy)
+	}
+
+	return p
+}
+
+func (p *failoverProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the body is sent again to the next replica
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for idx, proxy := range p.proxies {
+		attempt := &proxyAttempt{last: idx == len(p.proxies)-1}
+		req := r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, attempt))
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		proxy.ServeHTTP(w, req)
+		if attempt.failed == nil {
+			return
+		}
+
+		host := p.upstream.replicas[idx].url.Host
+		replicaErrors.WithLabelValues(p.upstream.Name, host).Inc()
+		log.Warnf("replica %s of upstream %q failed, proxying to the next one: %v", host, p.upstream.Name, attempt.failed)
+
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+func modifyReplicaResponse(resp *http.Response) error {
+	attempt, _ := resp.Request.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	if attempt != nil && !attempt.last && resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func replicaErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	attempt, _ := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	if attempt != nil && !attempt.last && r.Context().Err() == nil {
+		attempt.failed = err
+		return
+	}
+
+	log.Warnf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,55 @@
+// +build test
+
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFailoverProxy(t *testing.T) {
+	answer := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(name + ":" + string(body)))
+		}
+	}
+	down := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	unreachable := func(u *Upstream) *Upstream {
+		u.replicas[0].url, _ = url.Parse(closed.URL)
+		u.Proxy = newFailoverProxy(u)
+		return u
+	}
+
+	var testCases = []struct {
+		name           string
+		upstream       *Upstream
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "first replica", upstream: newTestReplicas(t, answer("a"), answer("b")), expectedStatus: http.StatusOK, expectedBody: "a:query=up"},
+		{name: "5xx", upstream: newTestReplicas(t, down, answer("b")), expectedStatus: http.StatusOK, expectedBody: "b:query=up"},
+		{name: "connection error", upstream: unreachable(newTestReplicas(t, answer("a"), answer("b"))), expectedStatus: http.StatusOK, expectedBody: "b:query=up"},
+		{name: "every replica down", upstream: newTestReplicas(t, down, down), expectedStatus: http.StatusServiceUnavailable, expectedBody: "down\n"},
+		{name: "single replica", upstream: newTestReplicas(t, down), expectedStatus: http.StatusServiceUnavailable, expectedBody: "down\n"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=up"))
+		res := httptest.NewRecorder()
+		tc.upstream.Proxy.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatus || res.Body.String() != tc.expectedBody {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.name, tc.expectedStatus, tc.expectedBody, res.Code, res.Body)
+		}
+	}
+}
+
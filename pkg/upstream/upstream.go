@@ -0,0 +1,418 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/metricnames"
+
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	promapi "github.com/prometheus/client_golang/api"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	promgo "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultName is the upstream of --proxy-url, serving the namespaces of no route.
+	DefaultName = "default"
+
+	epFederate = "/federate"
+	epRead     = "/api/v1/read"
+)
+
+// Route sends the requests over the namespaces, or the namespaces of the projects, to the upstream.
+type Route struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Replicas   []string `json:"replicas,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Projects   []string `json:"projects,omitempty"`
+}
+
+// Config is the YAML file of the upstream routes, a namespace is owned by a single route.
+type Config struct {
+	Upstreams []Route `json:"upstreams"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Annotatef(err, "unable to read upstreams %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return cfg, errors.Annotatef(err, "unable to parse upstreams %s", path)
+	}
+
+	return cfg, nil
+}
+
+// Options are shared by the upstreams.
+type Options struct {
+	// ReplicaLabel is the external label distinguishing the replicas of an upstream, dropped from the deduplicated series.
+	ReplicaLabel        string
+	MetricNamesCacheTTL time.Duration
+}
+
+// MetricNames lists the metric names of the namespaces, see metricnames.Lister.
+type MetricNames interface {
+	Names(ctx context.Context, namespaces []string, start, end time.Time) ([]string, error)
+}
+
+// Upstream is a Prometheus serving the series of some namespaces, possibly as a group of HA replicas
+// whose results are deduplicated. The proxy serves the first replica answering.
+type Upstream struct {
+	Name        string
+	URL         *url.URL
+	API         promapiv1.API
+	Proxy       http.Handler
+	MetricNames MetricNames
+
+	replicas     []*replica
+	replicaLabel string
+}
+
+type replica struct {
+	url         *url.URL
+	client      promapi.Client
+	api         promapiv1.API
+	metricNames *metricnames.Lister
+}
+
+func New(ctx context.Context, name string, urls []*url.URL, opts Options) (*Upstream, error) {
+	if len(urls) == 0 {
+		return nil, errors.Errorf("upstream %q has no URL", name)
+	}
+
+	u := &Upstream{
+		Name:         name,
+		URL:          urls[0],
+		replicaLabel: opts.ReplicaLabel,
+	}
+	for _, replicaURL := range urls {
+		client, err := promapi.NewClient(promapi.Config{
+			Address: replicaURL.String(),
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to new Prometheus client of upstream %q", name)
+		}
+
+		u.replicas = append(u.replicas, &replica{
+			url:         replicaURL,
+			client:      client,
+			api:         promapiv1.NewAPI(client),
+			metricNames: metricnames.NewLister(ctx, client, opts.MetricNamesCacheTTL),
+		})
+	}
+
+	if u.Replicated() {
+		u.API = &replicatedAPI{API: u.replicas[0].api, upstream: u}
+		u.MetricNames = &replicatedMetricNames{upstream: u}
+		u.Proxy = newFailoverProxy(u)
+	} else {
+		u.API = u.replicas[0].api
+		u.Proxy = httputil.NewSingleHostReverseProxy(urls[0])
+		u.MetricNames = u.replicas[0].metricNames
+	}
+
+	return u, nil
+}
+
+// Replicated tells whether the upstream is a group of HA replicas.
+func (u *Upstream) Replicated() bool {
+	return u != nil && len(u.replicas) > 1
+}
+
+// ReplicaURLs returns the URLs of the replicas, in the order they are failed over.
+func (u *Upstream) ReplicaURLs() []*url.URL {
+	ret := make([]*url.URL, 0, len(u.replicas))
+	for _, r := range u.replicas {
+		ret = append(ret, r.url)
+	}
+
+	return ret
+}
+
+// Federate returns the metric families of the series matching the selectors.
+func (u *Upstream) Federate(ctx context.Context, matches []string) ([]*promgo.MetricFamily, error) {
+	parts := make([][]*promgo.MetricFamily, len(u.replicas))
+	err := u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		parts[idx], err = u.federate(ctx, r, matches)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.Replicated() {
+		return parts[0], nil
+	}
+
+	return u.dedupMetricFamilies(parts), nil
+}
+
+func (u *Upstream) federate(ctx context.Context, r *replica, matches []string) ([]*promgo.MetricFamily, error) {
+	reqURL := r.client.URL(epFederate, nil)
+	reqURL.RawQuery = url.Values{"match[]": matches}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+
+	resp, body, err := r.client.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s of upstream %q failed with status %d: %s", epFederate, u.Name, resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to decode the federation of upstream %q", u.Name)
+	}
+
+	ret := make([]*promgo.MetricFamily, 0, len(families))
+	for _, family := range families {
+		ret = append(ret, family)
+	}
+
+	return ret, nil
+}
+
+// Read answers the remote read request with sampled results, as the streamed chunks cannot be merged.
+func (u *Upstream) Read(ctx context.Context, readReq *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	sampledReq := *readReq
+	sampledReq.AcceptedResponseTypes = nil
+
+	marshaledData, err := sampledReq.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*prompb.ReadResponse, len(u.replicas))
+	err = u.each(ctx, func(ctx context.Context, idx int, r *replica) (err error) {
+		parts[idx], err = u.read(ctx, r, marshaledData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.Replicated() {
+		return parts[0], nil
+	}
+
+	return u.dedupReadResponses(parts, len(readReq.Queries)), nil
+}
+
+func (u *Upstream) read(ctx context.Context, r *replica, marshaledData []byte) (*prompb.ReadResponse, error) {
+	reqURL := r.client.URL(epRead, nil)
+	req, err := http.NewRequest(http.MethodPost, reqURL.String(), bytes.NewReader(snappy.Encode(nil, marshaledData)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, body, err := r.client.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s of upstream %q failed with status %d: %s", epRead, u.Name, resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	uncompressedData, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to decode the remote read of upstream %q", u.Name)
+	}
+
+	readResp := &prompb.ReadResponse{}
+	if err := readResp.Unmarshal(uncompressedData); err != nil {
+		return nil, errors.Annotatef(err, "unable to decode the remote read of upstream %q", u.Name)
+	}
+
+	return readResp, nil
+}
+
+// Partition is the subset of the accessible namespaces owned by an upstream.
+type Partition struct {
+	Upstream   *Upstream
+	Namespaces data.Set
+}
+
+// Router finds the upstreams owning the namespaces, by name first, then by project.
+type Router struct {
+	upstreams   []*Upstream
+	byNamespace map[string]int
+	byProject   map[string]int
+	projectOf   func(namespace string) string
+}
+
+func NewRouter(ctx context.Context, cfg Config, defaults *Upstream, opts Options, projectOf func(namespace string) string) (*Router, error) {
+	r := &Router{
+		upstreams:   make([]*Upstream, 0, len(cfg.Upstreams)+1),
+		byNamespace: make(map[string]int),
+		byProject:   make(map[string]int),
+		projectOf:   projectOf,
+	}
+
+	names := data.NewSet(DefaultName)
+	for idx, route := range cfg.Upstreams {
+		if route.Name == "" {
+			return nil, errors.Errorf("upstream %d has no name", idx)
+		}
+		if _, exist := names[route.Name]; exist {
+			return nil, errors.Errorf("upstream %q is duplicated", route.Name)
+		}
+		names[route.Name] = struct{}{}
+
+		if len(route.Namespaces) == 0 && len(route.Projects) == 0 {
+			return nil, errors.Errorf("upstream %q owns neither namespaces nor projects", route.Name)
+		}
+		if len(route.Projects) != 0 && projectOf == nil {
+			return nil, errors.New("upstreams by project require Kubernetes")
+		}
+
+		urls := make([]*url.URL, 0, 1+len(route.Replicas))
+		for _, rawURL := range append([]string{route.URL}, route.Replicas...) {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to parse the URL of upstream %q", route.Name)
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return nil, errors.Errorf("upstream %q has no absolute URL", route.Name)
+			}
+			urls = append(urls, u)
+		}
+
+		upstream, err := New(ctx, route.Name, urls, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ns := range route.Namespaces {
+			if owner, exist := r.byNamespace[ns]; exist {
+				return nil, errors.Errorf("namespace %q is owned by upstreams %q and %q", ns, r.upstreams[owner].Name, route.Name)
+			}
+			r.byNamespace[ns] = len(r.upstreams)
+		}
+		for _, project := range route.Projects {
+			if owner, exist := r.byProject[project]; exist {
+				return nil, errors.Errorf("project %q is owned by upstreams %q and %q", project, r.upstreams[owner].Name, route.Name)
+			}
+			r.byProject[project] = len(r.upstreams)
+		}
+
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	r.upstreams = append(r.upstreams, defaults)
+
+	return r, nil
+}
+
+// Routed tells whether the namespaces are spread over several upstreams.
+func (r *Router) Routed() bool {
+	return r != nil && len(r.upstreams) > 1
+}
+
+// Partition splits the namespaces by upstream, in the order of the configuration, the default upstream is last.
+func (r *Router) Partition(namespaceSet data.Set) []Partition {
+	if r == nil {
+		return nil
+	}
+
+	sets := make([]data.Set, len(r.upstreams))
+	for ns := range namespaceSet {
+		idx := r.indexOf(ns)
+		if sets[idx] == nil {
+			sets[idx] = data.NewSet()
+		}
+		sets[idx][ns] = struct{}{}
+	}
+
+	ret := make([]Partition, 0, len(sets))
+	for idx, set := range sets {
+		if set != nil {
+			ret = append(ret, Partition{Upstream: r.upstreams[idx], Namespaces: set})
+		}
+	}
+
+	return ret
+}
+
+func (r *Router) indexOf(namespace string) int {
+	if idx, exist := r.byNamespace[namespace]; exist {
+		return idx
+	}
+
+	if len(r.byProject) != 0 {
+		if idx, exist := r.byProject[r.projectOf(namespace)]; exist {
+			return idx
+		}
+	}
+
+	return len(r.upstreams) - 1
+}
+
+// MergeMetricFamilies merges the federations of the upstreams by metric family, sorted by name.
+func MergeMetricFamilies(parts [][]*promgo.MetricFamily) []*promgo.MetricFamily {
+	ret := make([]*promgo.MetricFamily, 0)
+	index := make(map[string]*promgo.MetricFamily)
+
+	for _, part := range parts {
+		for _, family := range part {
+			if merged, exist := index[family.GetName()]; exist {
+				merged.Metric = append(merged.Metric, family.Metric...)
+				continue
+			}
+
+			index[family.GetName()] = family
+			ret = append(ret, family)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetName() < ret[j].GetName()
+	})
+
+	return ret
+}
+
+// MergeReadResponses concatenates the series of the upstreams query by query.
+func MergeReadResponses(parts []*prompb.ReadResponse, queries int) *prompb.ReadResponse {
+	results := make([]*prompb.QueryResult, 0, queries)
+	for i := 0; i < queries; i++ {
+		results = append(results, &prompb.QueryResult{})
+	}
+
+	for _, part := range parts {
+		for idx, result := range part.GetResults() {
+			if idx < queries {
+				results[idx].Timeseries = append(results[idx].Timeseries, result.Timeseries...)
+			}
+		}
+	}
+
+	return &prompb.ReadResponse{
+		Results: results,
+	}
+}
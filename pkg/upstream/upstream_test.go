@@ -0,0 +1,184 @@
+// +build test
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	promgo "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+func newTestRouter(t *testing.T, cfg Config, projectOf func(string) string) *Router {
+	defaultURL, _ := url.Parse("http://default:9090")
+	defaults, err := New(context.Background(), DefaultName, []*url.URL{defaultURL}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRouter(context.Background(), cfg, defaults, Options{}, projectOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestNewRouter(t *testing.T) {
+	defaultURL, _ := url.Parse("http://default:9090")
+	defaults, _ := New(context.Background(), DefaultName, []*url.URL{defaultURL}, Options{})
+	projectOf := func(string) string { return "" }
+
+	invalid := []Config{
+		{Upstreams: []Route{{URL: "http://a:9090", Namespaces: []string{"a"}}}},
+		{Upstreams: []Route{{Name: DefaultName, URL: "http://a:9090", Namespaces: []string{"a"}}}},
+		{Upstreams: []Route{{Name: "a", URL: "http://a:9090"}}},
+		{Upstreams: []Route{{Name: "a", URL: "a:9090", Namespaces: []string{"a"}}}},
+		{Upstreams: []Route{{Name: "a", URL: "http://a:9090", Namespaces: []string{"a"}}, {Name: "b", URL: "http://b:9090", Namespaces: []string{"a"}}}},
+		{Upstreams: []Route{{Name: "a", URL: "http://a:9090", Projects: []string{"p"}}, {Name: "b", URL: "http://b:9090", Projects: []string{"p"}}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewRouter(context.Background(), cfg, defaults, Options{}, projectOf); err == nil {
+			t.Errorf("%+v => expected an error", cfg)
+		}
+	}
+
+	byProject := Config{Upstreams: []Route{{Name: "a", URL: "http://a:9090", Projects: []string{"p"}}}}
+	if _, err := NewRouter(context.Background(), byProject, defaults, Options{}, nil); err == nil {
+		t.Error("expected the routes by project to require a project lookup")
+	}
+}
+
+func TestRouterPartition(t *testing.T) {
+	projects := map[string]string{"ns-b": "c-1:p-1", "ns-c": "c-1:p-1"}
+	r := newTestRouter(t, Config{Upstreams: []Route{
+		{Name: "a", URL: "http://a:9090", Namespaces: []string{"ns-a", "ns-c"}},
+		{Name: "b", URL: "http://b:9090", Projects: []string{"c-1:p-1"}},
+	}}, func(ns string) string { return projects[ns] })
+
+	partitions := r.Partition(data.NewSet("ns-a", "ns-b", "ns-c", "ns-d"))
+
+	got := map[string]string{}
+	for _, p := range partitions {
+		got[p.Upstream.Name] = p.Namespaces.String()
+	}
+	expected := map[string]string{"a": "ns-a,ns-c", "b": "ns-b", DefaultName: "ns-d"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if partitions[len(partitions)-1].Upstream.Name != DefaultName {
+		t.Error("expected the default upstream last")
+	}
+
+	if partitions := r.Partition(data.NewSet("ns-a")); len(partitions) != 1 || partitions[0].Upstream.Name != "a" {
+		t.Errorf("expected the single upstream of the namespace, got %v", partitions)
+	}
+	if partitions := (*Router)(nil).Partition(data.NewSet("ns-a")); partitions != nil {
+		t.Error("expected no partition without routes")
+	}
+}
+
+func TestUpstreamFederate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != epFederate || r.URL.Query().Get("match[]") != `up{namespace="ns-a"}` {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintln(w, "# TYPE up untyped")
+		fmt.Fprintln(w, `up{namespace="ns-a",pod="a"} 1 1000`)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	upstream, err := New(context.Background(), "a", []*url.URL{u}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := upstream.Federate(context.Background(), []string{`up{namespace="ns-a"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "up" || len(families[0].Metric) != 1 {
+		t.Errorf("unexpected metric families %v", families)
+	}
+
+	if _, err := upstream.Federate(context.Background(), []string{"up"}); err == nil {
+		t.Error("expected the upstream error")
+	}
+}
+
+func TestUpstreamRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		uncompressed, _ := snappy.Decode(nil, compressed)
+
+		req := &prompb.ReadRequest{}
+		if err := req.Unmarshal(uncompressed); err != nil || len(req.AcceptedResponseTypes) != 0 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "namespace", Value: "ns-a"}}},
+		}}}}
+		marshaled, _ := resp.Marshal()
+		w.Write(snappy.Encode(nil, marshaled))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	upstream, err := New(context.Background(), "a", []*url.URL{u}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readReq := &prompb.ReadRequest{
+		Queries:               []*prompb.Query{{}},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	}
+	resp, err := upstream.Read(context.Background(), readReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+	if len(readReq.AcceptedResponseTypes) != 1 {
+		t.Error("expected the request not to be modified")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := "a", "b"
+	families := MergeMetricFamilies([][]*promgo.MetricFamily{
+		{{Name: &b, Metric: []*promgo.Metric{{}}}},
+		nil,
+		{{Name: &a, Metric: []*promgo.Metric{{}}}, {Name: &b, Metric: []*promgo.Metric{{}}}},
+	})
+	if len(families) != 2 || families[0].GetName() != "a" || len(families[1].Metric) != 2 {
+		t.Errorf("unexpected merged metric families %v", families)
+	}
+
+	series := func(ns string) *prompb.TimeSeries {
+		return &prompb.TimeSeries{Labels: []prompb.Label{{Name: "namespace", Value: ns}}}
+	}
+	resp := MergeReadResponses([]*prompb.ReadResponse{
+		{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{series("ns-a")}}, {}}},
+		nil,
+		{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{series("ns-b")}}, {Timeseries: []*prompb.TimeSeries{series("ns-b")}}}},
+	}, 2)
+	if len(resp.Results) != 2 || len(resp.Results[0].Timeseries) != 2 || len(resp.Results[1].Timeseries) != 1 {
+		t.Errorf("unexpected merged response %v", resp)
+	}
+}